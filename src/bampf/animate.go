@@ -31,6 +31,36 @@ type animation interface {
 // ones, and discards completed animations.
 type animator struct {
 	animations []animation
+	steps      float64 // Fractional animation steps owed, see timeScale.
+}
+
+// timeScale slows down or speeds up the game. Animations and energy
+// changes happen timeScale times per update, so 0.5 runs at half speed.
+var timeScale = 1.0
+
+// testMode makes tests quick and repeatable. Sounds are not played and
+// animations are wrapped up the first time they are stepped.
+var testMode = false
+
+// setTimeScale changes the game speed, see timeScale. The scale is
+// kept between 0.1 and 2.
+func setTimeScale(scale float64) {
+	switch {
+	case scale < 0.1:
+		scale = 0.1
+	case scale > 2:
+		scale = 2
+	}
+	timeScale = scale
+}
+
+// scaledSteps adds timeScale to the given fractional step count and
+// returns the number of whole steps that are now due.
+func scaledSteps(accum *float64) (steps int) {
+	*accum += timeScale
+	steps = int(*accum)
+	*accum -= float64(steps)
+	return steps
 }
 
 // addAnimation adds a new animation to the list active of animations.
@@ -46,12 +76,24 @@ func (a *animator) addAnimation(ani animation) {
 }
 
 // animate runs each of the active animations one step. It is expected to be
-// called each update loop.
+// called each update loop. Animations are stepped less or more often when
+// the timeScale is changed.
 func (a *animator) animate(deltaTime float64) {
+	for steps := scaledSteps(&a.steps); steps > 0; steps-- {
+		a.step(deltaTime)
+	}
+}
+
+// step runs each of the active animations one step.
+func (a *animator) step(deltaTime float64) {
 	active := []animation{}
 	startA := len(a.animations)
 	for _, animation := range a.animations {
 		if animation.Animate(deltaTime) {
+			if testMode {
+				animation.Wrap()
+				continue
+			}
 			active = append(active, animation)
 		}
 	}
@@ -11,6 +11,7 @@ package main
 
 import (
 	"log"
+	"math"
 	"runtime/debug"
 	"vu"
 )
@@ -56,6 +57,8 @@ type bampf struct {
 	wx, wy      int               // Application window size.
 	ani         *animator         // Handles short animations.
 	launchLevel int               // Choosen by the user on the launch screen.
+	bg1Angle    float64           // Launch backdrop rotation kept across launch screens.
+	bg2Angle    float64           // Launch backdrop rotation kept across launch screens.
 }
 
 // Overall application state transitions. These are used as input
@@ -82,6 +85,14 @@ func (mp *bampf) Create(eng vu.Engine) {
 	mp.eng.Action() // run the engine until the user decides to quit.
 }
 
+// maxDeltaTime caps the update time passed to animations. The time between
+// updates can be very large after the window has been minimized and capping
+// it stops animations from jumping when the window is restored.
+const maxDeltaTime = 1.0 / 15
+
+// clampDeltaTime limits the given update time to maxDeltaTime.
+func clampDeltaTime(deltaTime float64) float64 { return math.Min(deltaTime, maxDeltaTime) }
+
 // Update is a regular engine callback and is passed onto the currently
 // active screen. Update will run many times a second and should return
 // promptly.
@@ -89,8 +100,11 @@ func (mp *bampf) Update(input *vu.Input) {
 	if input.Resized {
 		mp.resize()
 	}
+	if l, ok := mp.screens["launch"].(*launch); ok && l.anim != nil {
+		l.anim.onFocus(input.Focus) // avoid a jump when focus returns.
+	}
 	if input.Focus {
-		mp.ani.animate(input.Dt) // run active animations
+		mp.ani.animate(clampDeltaTime(input.Dt)) // run active animations
 		if mp.active != nil {
 			mp.active.update(input)
 		}
@@ -104,7 +118,7 @@ func (mp *bampf) Update(input *vu.Input) {
 func (mp *bampf) createScreens() *bampf {
 	gameScreen, gameReactions := newGameScreen(mp)
 	mp.screens = map[string]screen{
-		"launch":  newLaunchScreen(mp),
+		"launch":  newLaunchScreen(mp, newSaver().restoreOptions()),
 		"game":    gameScreen,
 		"end":     newEndScreen(mp),
 		"options": newOptionsScreen(mp, gameReactions),
@@ -197,9 +211,27 @@ func (mp *bampf) transitionToEndScreen() {
 // to the start menu in order to choose a new game.
 func (mp *bampf) returnToMenu() {
 	mp.prior.transition(deactivate)
-	mp.active.transition(deactivate)
+	if mp.active != mp.prior {
+		mp.active.transition(deactivate)
+	}
 	mp.active = mp.screens["launch"]
 	mp.active.transition(activate)
+	if mp.ani != nil {
+		if fadeIn := mp.active.fadeIn(); fadeIn != nil {
+			mp.ani.addAnimation(fadeIn)
+		}
+	}
+}
+
+// quitToMenu abandons the level being played and goes straight back to
+// the launch screen without going through the options screen. Ignored
+// unless the game screen is active.
+func (mp *bampf) quitToMenu() {
+	if mp.active == nil || mp.active != mp.screens["game"] {
+		return
+	}
+	mp.prior = mp.active
+	mp.state(choose)
 }
 
 // toggleOptions shows or hides the options screen.
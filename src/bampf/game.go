@@ -102,6 +102,7 @@ func (g *game) active(event int) int {
 		g.disableKeys()
 		g.eng.ShowCursor(true)
 		g.cl.setVisible(false)
+		g.cl.retirePlayer()
 		g.state = g.deactive
 	case activate:
 		// ignored. Possible when the animation was skipped before
@@ -124,6 +125,7 @@ func (g *game) paused(event int) int {
 		g.state = g.active
 	case deactivate:
 		g.cl.setVisible(false)
+		g.cl.retirePlayer()
 		g.state = g.deactive
 	default:
 		log.Printf("game: paused state: invalid transition %d", event)
@@ -263,6 +265,7 @@ func (g *game) reactions() map[string]vu.Reaction {
 		"C":   vu.NewReactOnce("cloak", func() { g.cl.cloak() }),
 		"T":   vu.NewReactOnce("teleport", func() { g.cl.teleport() }),
 		"Esc": vu.NewReactOnce("options", func() { g.mp.toggleOptions() }),
+		"Q":   vu.NewReactOnce("menu", func() { g.mp.quitToMenu() }),
 		"Sp":  vu.NewReactOnce("skip", func() { g.mp.ani.skip() }),
 	}
 	return g.restoreBindings(reactions)
@@ -338,6 +341,14 @@ func (g *game) healthUpdated(health, warn, high int) {
 	}
 }
 
+// tookDamage is a callback whenever the player loses cells to damage.
+// The player shakes unless shaking has been turned off.
+func (g *game) tookDamage(loss int) {
+	if shake := g.cl.player.newShakeAnimation(loss); shake != nil {
+		g.mp.ani.addAnimation(shake)
+	}
+}
+
 // setLevel updates to the requested level, generating a new level if necessary.
 func (g *game) setLevel(lvl int) {
 	if g.cl != nil {
@@ -347,6 +358,10 @@ func (g *game) setLevel(lvl int) {
 		g.levels[lvl] = newLevel(g, lvl)
 	}
 	g.cl = g.levels[lvl]
+	if g.cl.player == nil { // retired when the last game was abandoned.
+		g.cl.player = g.cl.makePlayer(g.eng, g.cl.hd.scene, g.cl.num+1)
+		g.cl.player.resetEnergy()
+	}
 	g.cl.activate(g)
 	g.cl.updateKeys(g.reacts)
 }
@@ -456,10 +471,25 @@ var gameMuster = []int{1, 5, 25, 50, 100}
 // collected.
 var gameCellGain = []int{1, 2, 4, 8, 8}
 
+// gameMaxLevel is the last playable level.
+func gameMaxLevel() int { return len(gameCellGain) - 1 }
+
 // gameCellLoss gives the per-level number of cells lost for each collision
 // with a sentinel. These are multiples of the corresponding cell gains.
 var gameCellLoss = []int{1, 12, 24, 48, 64}
 
+// levelDamage is the number of cells lost for each collision with a
+// sentinel on the given level.
+func levelDamage(level int) int {
+	switch {
+	case level < 0:
+		level = 0
+	case level >= len(gameCellLoss):
+		level = len(gameCellLoss) - 1
+	}
+	return gameCellLoss[level]
+}
+
 // lastSpot is used during debug to return the player to their previous position
 // when fly mode is turned off.
 type lastSpot struct {
@@ -4,8 +4,15 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"sort"
+	"strconv"
 	"vu"
+	"vu/audio"
 )
 
 // launch is the application menu/start screen.  It is the first screen after the
@@ -16,29 +23,60 @@ type launch struct {
 	scene      vu.Scene               // Group of model objects for the start screen.
 	eng        vu.Engine              // The 3D engine.
 	anim       *startAnimation        // The start button animation.
+	fade       *fadeStartAnimation    // The fade out animation, if any.
+	entry      *fadeInAnimation       // The fade in animation, if any.
+	banim      *buttonAnimation       // The button animation, if any.
+	countdown  *countdownAnimation    // The start countdown, if any.
 	buttons    []*button              // The game select and option screen buttons.
 	bg1        vu.Part                // Background rotating one way.
 	bg2        vu.Part                // Background rotating the other way.
 	buttonSize int                    // Width and height of each button.
 	mp         *bampf                 // Needed for toggling the option screen.
 	reacts     map[string]vu.Reaction // User input handlers for this screen.
+	keys       map[string]string      // Key bindings: reaction name to key.
+	opts       *launchOptions         // User settings for the launch screen.
+	saver      *Saver                 // Persists the options. Nil for no saving.
 	state      func(int)              // Current screen state.
 	mx, my     int                    // Current mouse locations.
+	tick       int                    // Number of updates.
+	lastSkip   int                    // Tick of the last skip, 0 for none.
+	hovered    *button                // Button under the mouse, if any.
+	hoverNoise audio.SoundMaker       // Optional sound for a newly hovered button.
+	preview    int                    // Level shown by the start animation.
+	phase      float64                // Last button layout progress, see layout.
+
+	// pending holds transitions that arrived while evolving. They are
+	// retried, in order, once evolving ends, see deferEvent.
+	pending  []int
+	retrying bool // Pending transitions are being retried.
+
+	// optionsAnchor is where the options button is placed, either below
+	// the level buttons or in a screen corner, see setOptionsButtonAnchor.
+	optionsAnchor int
+
+	// onLevel is optionally called with the level and sentinel damage
+	// when a level button is hovered. Used to preview level difficulty.
+	onLevel func(level, damage int)
 }
 
 // launch implements the screen interface.
-func (l *launch) fadeIn() animation        { return nil }
-func (l *launch) fadeOut() animation       { return l.newFadeAnimation() }
+func (l *launch) fadeIn() animation        { return l.newFadeInAnimation() }
+func (l *launch) fadeOut() animation       { return l.newExitAnimation() }
 func (l *launch) resize(width, height int) { l.handleResize(width, height) }
 func (l *launch) update(input *vu.Input)   { l.handleUpdate(input) }
-func (l *launch) transition(event int)     { l.state(event) }
+func (l *launch) transition(event int)     { l.handleTransition(event) }
 
 // newLaunchScreen creates the start screen. Measurements are 1 pixel == 1 unit
-// because the launch screen is done as an overlay.
-func newLaunchScreen(mp *bampf) screen {
+// because the launch screen is done as an overlay. The option key bindings
+// map the launch reactions, "click", "next", "options", "prev", "skip", and
+// "start", to keys.
+// Reactions without a binding use the default key from launchKeys.
+func newLaunchScreen(mp *bampf, opts *launchOptions) screen {
 	l := &launch{}
 	l.state = l.deactive
 	l.mp = mp
+	l.opts = opts
+	l.saver = newSaver()
 	l.eng = mp.eng
 	l.scene = l.eng.AddScene(vu.VO)
 	l.scene.Set2D()
@@ -46,38 +84,43 @@ func newLaunchScreen(mp *bampf) screen {
 	l.buttonSize = 64
 
 	// the start screen only reacts to mouse clicks.
-	l.reacts = map[string]vu.Reaction{
-		"Lm":  vu.NewReactOnce("click", func() { l.click(l.mx, l.my) }),
-		"Esc": vu.NewReactOnce("options", func() { l.mp.toggleOptions() }),
-		"Sp":  vu.NewReactOnce("skip", func() { l.mp.ani.skip() }),
+	l.keys = launchKeys()
+	for name, key := range opts.Keys {
+		l.keys[name] = key
 	}
+	l.reacts = map[string]vu.Reaction{}
+	l.reacts[l.keys["skip"]] = vu.NewReactOnce("skip", func() { l.skip() })
+	l.enableKeys()
+
+	// the start button and background preview the level last chosen
+	// by the user.
+	l.mp.launchLevel = clampLevel(opts.Level)
+	l.preview = l.mp.launchLevel
 
 	// create the background.
-	l.bg1 = l.scene.AddPart()
-	l.bg1.SetFacade("icon", "uv").SetMaterial("half")
-	l.bg1.SetTexture("backdrop", 10)
-	l.bg2 = l.scene.AddPart()
-	l.bg2.SetFacade("icon", "uv").SetMaterial("half")
-	l.bg2.SetTexture("backdrop", -10)
+	l.addBackdrop(l.scene.AddPart(), l.scene.AddPart())
 
 	// add the animated start button to the scene.
 	l.anim = newStartAnimation(mp, l.scene.AddPart(), l.w, l.h)
 
-	// create the other buttons. Note that the names, eg. "lvl0", are the icon
-	// image names.
+	// create a button for each level followed by the options button.
 	buttonPart := l.scene.AddPart()
 	sz := int(l.buttonSize)
-	l.buttons = []*button{
-		newButton(l.eng, buttonPart, sz, "lvl0", vu.NewReaction("setLevel", func() { l.startAt(0) })),
-		newButton(l.eng, buttonPart, sz, "lvl1", vu.NewReaction("setLevel", func() { l.startAt(1) })),
-		newButton(l.eng, buttonPart, sz, "lvl2", vu.NewReaction("setLevel", func() { l.startAt(2) })),
-		newButton(l.eng, buttonPart, sz, "lvl3", vu.NewReaction("setLevel", func() { l.startAt(3) })),
-		newButton(l.eng, buttonPart, sz, "lvl4", vu.NewReaction("setLevel", func() { l.startAt(4) })),
-		newButton(l.eng, buttonPart, sz, "options", l.reacts["Esc"]),
+	l.buttons = []*button{}
+	for level, meta := range levels() {
+		lvl := level
+		action := vu.NewReaction("setLevel", func() { l.startAt(lvl) })
+		l.buttons = append(l.buttons, newButton(l.eng, buttonPart, sz, meta.icon, action))
 	}
+	l.buttons = append(l.buttons, newButton(l.eng, buttonPart, sz, "options", l.reacts[l.keys["options"]]))
 	for _, btn := range l.buttons {
 		btn.icon.SetScale(1, 1, 0)
 	}
+
+	// label a hovered level button with the sentinel damage for that level.
+	l.onLevel = func(level, damage int) {
+		l.buttons[level].label(l.eng, buttonPart, strconv.Itoa(damage))
+	}
 	l.layout(0)
 	l.handleResize(l.w, l.h)
 
@@ -96,7 +139,7 @@ func (l *launch) deactive(event int) {
 		l.enableKeys()
 		l.state = l.active
 	default:
-		log.Printf("start: clean state: invalid transition %d", event)
+		l.invalid("clean", event)
 	}
 }
 
@@ -107,14 +150,16 @@ func (l *launch) active(event int) {
 		l.disableKeys()
 		l.state = l.evolving
 	case pause:
+		l.abort()
 		l.disableKeys()
 		l.state = l.paused
 	case deactivate:
+		l.abort()
 		l.disableKeys()
 		l.scene.SetVisible(false)
 		l.state = l.deactive
 	default:
-		log.Printf("start: active state: invalid transition %d", event)
+		l.invalid("active", event)
 	}
 }
 
@@ -125,7 +170,7 @@ func (l *launch) paused(event int) {
 		l.enableKeys()
 		l.state = l.active
 	default:
-		log.Printf("start: paused state: invalid transition %d", event)
+		l.invalid("paused", event)
 	}
 }
 
@@ -133,29 +178,181 @@ func (l *launch) paused(event int) {
 func (l *launch) evolving(event int) {
 	switch event {
 	case deactivate:
+		l.abort()
 		l.scene.SetVisible(false)
 		l.state = l.deactive
 	default:
-		log.Printf("start: evolving state: invalid transition %d", event)
+		l.deferEvent(event)
+	}
+}
+
+// handleTransition applies the event to the current state and then gives
+// any pending transitions another chance.
+func (l *launch) handleTransition(event int) {
+	l.state(event)
+	l.retryEvents()
+}
+
+// launchPendingMax is the most transitions kept waiting for a state that
+// accepts them. The oldest transition is dropped when there are more.
+const launchPendingMax = 4
+
+// deferEvent keeps a transition that arrived while the screen was busy
+// evolving so that it can be applied later, see retryEvents.
+func (l *launch) deferEvent(event int) {
+	if len(l.pending) >= launchPendingMax {
+		log.Printf("start: dropped transition %d", l.pending[0])
+		l.pending = l.pending[1:]
+	}
+	if !l.retrying {
+		log.Printf("start: evolving state: deferred transition %d", event)
+	}
+	l.pending = append(l.pending, event)
+}
+
+// invalid logs and ignores a transition the given state doesn't accept.
+func (l *launch) invalid(state string, event int) {
+	if l.retrying {
+		log.Printf("start: %s state: dropped deferred transition %d", state, event)
+		return
 	}
+	log.Printf("start: %s state: invalid transition %d", state, event)
+}
+
+// retryEvents applies the pending transitions, in order, to the current
+// state. Transitions stay pending while the screen is still evolving and
+// are dropped if the state that follows evolving doesn't accept them.
+// For example a pause is meaningless once the screen has been deactivated.
+func (l *launch) retryEvents() {
+	if l.retrying || len(l.pending) == 0 {
+		return
+	}
+	l.retrying = true
+	pending := l.pending
+	l.pending = nil
+	for _, event := range pending {
+		l.state(event)
+	}
+	l.retrying = false
+}
+
+// abort stops any launch screen animations that are still running. This
+// is called when the screen is left before the animations have finished.
+// Completed animations are not affected.
+func (l *launch) abort() {
+	if l.fade != nil {
+		l.fade.Abort()
+	}
+	if l.entry != nil {
+		l.entry.Abort()
+	}
+	if l.banim != nil {
+		l.banim.Abort()
+	}
+	if l.countdown != nil {
+		l.countdown.Abort()
+	}
+}
+
+// isAnimating returns true while the button or fade animation is running.
+func (l *launch) isAnimating() bool {
+	return (l.fade != nil && l.fade.state == 1) || (l.banim != nil && l.banim.state == 1)
 }
 
 // disableKeys disallows certain keys when the screen is not active.
 func (l *launch) disableKeys() {
-	delete(l.reacts, "Esc")
-	delete(l.reacts, "Lm")
+	delete(l.reacts, l.keys["options"])
+	delete(l.reacts, l.keys["click"])
+	delete(l.reacts, l.keys["start"])
+	delete(l.reacts, l.keys["next"])
+	delete(l.reacts, l.keys["prev"])
+	for level := range gameCellGain {
+		delete(l.reacts, strconv.Itoa(level))
+	}
 }
 
-// enableKeys reenables previously disabled keys.
+// enableKeys reenables previously disabled keys. The number keys choose
+// the level, the next and previous keys cycle through the levels, and the
+// start key begins the game.
 func (l *launch) enableKeys() {
-	l.reacts["Esc"] = vu.NewReactOnce("options", func() { l.mp.toggleOptions() })
-	l.reacts["Lm"] = vu.NewReactOnce("click", func() { l.click(l.mx, l.my) })
+	l.reacts[l.keys["options"]] = vu.NewReactOnce("options", func() { l.mp.toggleOptions() })
+	l.reacts[l.keys["click"]] = vu.NewReactOnce("click", func() { l.click(l.mx, l.my) })
+	l.reacts[l.keys["start"]] = vu.NewReactOnce("start", func() { l.mp.state(play) })
+	l.reacts[l.keys["next"]] = vu.NewReactOnce("next", func() { l.cycleLevel(1) })
+	l.reacts[l.keys["prev"]] = vu.NewReactOnce("prev", func() { l.cycleLevel(-1) })
+	for level := range gameCellGain {
+		lvl := level
+		l.reacts[strconv.Itoa(lvl)] = vu.NewReactOnce("setLevel", func() { l.startAt(lvl) })
+	}
+}
+
+// reactionNames returns the sorted keys that currently have a launch screen
+// reaction. A settings screen can use these to show the bindings.
+func (l *launch) reactionNames() []string {
+	keys := []string{}
+	for key := range l.reacts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rebind moves the named launch reaction bound to oldKey over to newKey.
+// The new binding is kept when the keys are disabled and enabled again and
+// is saved with the options. False is returned if oldKey is not bound to
+// a named reaction or if newKey is already in use. The level number keys
+// are always in use, even while the keys are disabled.
+func (l *launch) rebind(oldKey, newKey string) bool {
+	if _, used := l.reacts[newKey]; used || oldKey == newKey {
+		return false
+	}
+	for level := range gameCellGain {
+		if newKey == strconv.Itoa(level) {
+			return false
+		}
+	}
+	for _, key := range l.keys {
+		if key == newKey {
+			return false
+		}
+	}
+	for name, key := range l.keys {
+		if key != oldKey {
+			continue
+		}
+		l.keys[name] = newKey
+		if reaction, ok := l.reacts[oldKey]; ok {
+			delete(l.reacts, oldKey)
+			l.reacts[newKey] = reaction
+		}
+		if l.opts.Keys == nil {
+			l.opts.Keys = map[string]string{}
+		}
+		l.opts.Keys[name] = newKey
+		if l.saver != nil {
+			l.saver.persistOptions(l.opts)
+		}
+		return true
+	}
+	return false
+}
+
+// launchKeys are the default launch screen key bindings.
+func launchKeys() map[string]string {
+	return map[string]string{
+		"click":   "Lm",
+		"next":    "Wu",
+		"options": "Esc",
+		"prev":    "Wd",
+		"skip":    "Sp",
+		"start":   "Ret",
+	}
 }
 
 // handleResize adjusts the screen to the current window size.
 func (l *launch) handleResize(width, height int) {
 	l.setSize(0, 0, width, height)
-	l.anim.resize(width, height)
+	l.anim.resize(l.w, l.h)
 
 	// resize the background to match.
 	if l.bg1 != nil {
@@ -168,18 +365,105 @@ func (l *launch) handleResize(width, height int) {
 		l.bg2.SetScale(float64(size), float64(size), 1)
 		l.bg2.SetLocation(float64(l.w/2)-5, float64(l.h/2)-5, 1)
 	}
-	l.layout(1)
+
+	// keep the button animation progress so that a resize part way
+	// through the animation doesn't jump the buttons to the end.
+	phase := 1.0
+	if l.banim != nil && l.banim.state == 1 {
+		phase = l.phase
+	}
+	l.layout(phase)
 }
 
 // startAt allows the user to begin at any difficulty level. It is used as the action
-// for the start screen choose-difficulty buttons.
+// for the start screen choose-difficulty buttons. Levels outside the playable
+// range are clamped. The choice is remembered for the next game session.
 func (l *launch) startAt(level int) {
+	if clamped := clampLevel(level); clamped != level {
+		log.Printf("launch: level %d clamped to %d", level, clamped)
+		level = clamped
+	}
 	l.mp.launchLevel = level
+	l.preview = level
 	l.anim.showLevel(level)
+	l.setBackdrop(levelBackdrop(level))
+	l.opts.Level = level
+	if l.saver != nil {
+		l.saver.persistOptions(l.opts)
+	}
+}
+
+// cycleLevel starts at the level that is step levels away from the
+// currently previewed level. Levels wrap around at either end.
+func (l *launch) cycleLevel(step int) {
+	levels := gameMaxLevel() + 1
+	l.startAt(((l.preview+step)%levels + levels) % levels)
 }
 
-// setSize adjusts the start screen dimensions.
+// levelMeta describes one of the playable levels for the launch screen.
+type levelMeta struct {
+	icon  string // Level button image name, eg. "lvl0".
+	title string // Display name of the level.
+	cores int    // Cells in a full trooper for the level, see coreTotals.
+	tag   string // Who the level is recommended for.
+}
+
+// levelTitles and levelTags are shown for each level, see levels.
+var levelTitles = []string{"Training", "Easy", "Normal", "Hard", "Expert"}
+var levelTags = []string{"new players", "casual", "regular", "experienced", "veterans"}
+
+// levels returns the description of each playable level in level order.
+// The launch screen has a button for each level.
+func levels() []levelMeta {
+	metas := make([]levelMeta, gameMaxLevel()+1)
+	for level := range metas {
+		_, _, cores := coreTotals(level)
+		metas[level] = levelMeta{icon: fmt.Sprintf("lvl%d", level), cores: cores}
+		metas[level].title = fmt.Sprintf("Level %d", level)
+		if level < len(levelTitles) {
+			metas[level].title = levelTitles[level]
+		}
+		if level < len(levelTags) {
+			metas[level].tag = levelTags[level]
+		}
+	}
+	return metas
+}
+
+// clampLevel returns the given level limited to the playable levels.
+func clampLevel(level int) int {
+	switch {
+	case level < 0:
+		return 0
+	case level > gameMaxLevel():
+		return gameMaxLevel()
+	}
+	return level
+}
+
+// setButtonIcons changes the button images, in button order, without
+// recreating the buttons. This allows the imagery to be swapped at runtime.
+// The buttons are unchanged if the number of names doesn't match.
+func (l *launch) setButtonIcons(names []string) error {
+	if len(names) != len(l.buttons) {
+		return fmt.Errorf("launch: %d button icons for %d buttons", len(names), len(l.buttons))
+	}
+	for cnt, btn := range l.buttons {
+		btn.setIcon(names[cnt])
+	}
+	return nil
+}
+
+// setSize adjusts the start screen dimensions. The window size can be 0
+// when the window is minimized so sizes are kept at 1 or more to avoid an
+// empty projection.
 func (l *launch) setSize(x, y, width, height int) {
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
 	l.x, l.y, l.w, l.h = 0, 0, width, height
 	l.scene.SetOrthographic(0, float64(l.w), 0, float64(l.h), 0, 10)
 	l.cx, l.cy = l.center()
@@ -187,6 +471,8 @@ func (l *launch) setSize(x, y, width, height int) {
 
 // handleUpdate runs things that need doing every game loop.
 func (l *launch) handleUpdate(input *vu.Input) {
+	l.tick++
+	l.retryEvents()
 	l.mx, l.my = input.Mx, input.My
 	for key, _ := range input.Down {
 		if reaction, ok := l.reacts[key]; ok {
@@ -194,16 +480,49 @@ func (l *launch) handleUpdate(input *vu.Input) {
 		}
 	}
 	l.hover()
-	l.rotateBackdrop()
-	l.anim.rotate(input.Gt, input.Dt)
+	dt := clampDeltaTime(input.Dt)
+	l.rotateBackdrop(dt)
+	l.anim.rotate(input.Gt, dt)
 }
 
-// hover hilites any button the mouse is over.
+// launchSkipTicks is the number of updates that further skip requests are
+// ignored after a skip. This stops one long key press from skipping
+// through several animations.
+const launchSkipTicks = 30
+
+// skip wraps up the current animations unless there was a recent skip.
+func (l *launch) skip() {
+	if l.lastSkip > 0 && l.tick-l.lastSkip < launchSkipTicks {
+		return
+	}
+	l.lastSkip = l.tick
+	l.mp.ani.skip()
+}
+
+// hover hilites any button the mouse is over. The hover sound, if any,
+// is played only when the mouse moves onto a different button. Moving onto
+// a level button also reports the level damage to onLevel.
 func (l *launch) hover() {
 	l.anim.hover(l.mx, l.my)
-	for _, btn := range l.buttons {
-		btn.hover(l.mx, l.my)
+	var hovered *button
+	level := -1
+	for cnt, btn := range l.buttons {
+		if btn.hover(l.mx, l.my) {
+			hovered = btn
+			if cnt < len(levels()) {
+				level = cnt // the first buttons choose the level.
+			}
+		}
 	}
+	if hovered != nil && hovered != l.hovered {
+		if l.hoverNoise != nil && !testMode {
+			l.hoverNoise.Play()
+		}
+		if level >= 0 && l.onLevel != nil {
+			l.onLevel(level, levelDamage(level))
+		}
+	}
+	l.hovered = hovered
 }
 
 // click is called when the user presses the left mouse button.
@@ -219,59 +538,299 @@ func (l *launch) click(mx, my int) {
 }
 
 // layout positions the buttons to the lower-middle part of the screen.
+// Windows too narrow for a row of level buttons get a column of buttons
+// along the left edge instead.
 func (l *launch) layout(buttonIndex float64) {
-	if len(l.buttons) != 6 {
+	if len(l.buttons) != len(levels())+1 {
 		log.Printf("start.layout: buttons changed without updating layout.")
 		return
 	}
+	l.phase = buttonIndex
 	cy := (l.cy - float64(l.h/2) + float64(2*l.buttonSize))
-	dx := buttonIndex * 1.15 * float64(l.buttonSize)
+	spacing := 1.15 * float64(l.buttonSize)
+	dx := buttonIndex * spacing
 	cx := l.cx
-	l.buttons[0].position(cx-dx*2, cy)
-	l.buttons[1].position(cx-dx, cy)
-	l.buttons[2].position(cx, cy)
-	l.buttons[3].position(cx+dx, cy)
-	l.buttons[4].position(cx+dx*2, cy)
-	l.buttons[5].position(cx, cy-float64(l.buttonSize)-10)
+	last := len(l.buttons) - 2 // index of the last level button.
+	if rowWidth := float64(last)*spacing + float64(l.buttonSize); rowWidth > float64(l.w) {
+		cx = float64(l.buttonSize)
+		for cnt, btn := range l.buttons[:last+1] {
+			btn.position(cx, cy+dx*float64(last-cnt))
+		}
+		l.layoutOptions(cx, cy-float64(l.buttonSize)-10)
+		return
+	}
+	for cnt, btn := range l.buttons[:last+1] {
+		btn.position(cx+dx*(float64(cnt)-float64(last)/2), cy)
+	}
+	l.layoutOptions(cx, cy-float64(l.buttonSize)-10)
+}
+
+// Options button anchors, see setOptionsButtonAnchor.
+const (
+	anchorBelow       = iota // Below the level buttons. The default.
+	anchorBottomLeft         // Bottom left screen corner.
+	anchorBottomRight        // Bottom right screen corner.
+	anchorTopLeft            // Top left screen corner.
+	anchorTopRight           // Top right screen corner.
+)
+
+// setOptionsButtonAnchor docks the options button to a screen corner, or
+// back below the level buttons with anchorBelow. This keeps the options
+// button clear of the start animation on unusual window shapes.
+func (l *launch) setOptionsButtonAnchor(corner int) {
+	if corner < anchorBelow || corner > anchorTopRight {
+		log.Printf("start.setOptionsButtonAnchor: invalid corner %d", corner)
+		return
+	}
+	l.optionsAnchor = corner
+	l.layout(1)
+}
+
+// layoutOptions positions the options button. The given location is used
+// when the button is not anchored to a corner.
+func (l *launch) layoutOptions(cx, cy float64) {
+	inset := float64(l.buttonSize)/2 + 10
+	left, right := inset, float64(l.w)-inset
+	bottom, top := inset, float64(l.h)-inset
+	switch l.optionsAnchor {
+	case anchorBottomLeft:
+		cx, cy = left, bottom
+	case anchorBottomRight:
+		cx, cy = right, bottom
+	case anchorTopLeft:
+		cx, cy = left, top
+	case anchorTopRight:
+		cx, cy = right, top
+	}
+	l.buttons[len(l.buttons)-1].position(cx, cy)
+}
+
+// layerInfo describes the depth of one of the launch screen parts.
+type layerInfo struct {
+	name string  // Part description, eg. "backdrop1", "button0".
+	z    float64 // Current z location.
+}
+
+// zLayers reports the current z location of the major launch screen parts:
+// the backdrops, the player, the hover overlay, and the buttons. Used to
+// debug overlapping parts. Missing parts are skipped. The backdrops sit
+// behind everything at z 1 while the other parts share z 0, see
+// startAnimation.resize for the hover overlay.
+func (l *launch) zLayers() []layerInfo {
+	layers := []layerInfo{}
+	add := func(name string, part vu.Part) {
+		if part != nil {
+			_, _, z := part.Location()
+			layers = append(layers, layerInfo{name, z})
+		}
+	}
+	add("backdrop1", l.bg1)
+	add("backdrop2", l.bg2)
+	if l.anim != nil {
+		if l.anim.player != nil {
+			add("player", l.anim.player.part)
+		}
+		add("hilite", l.anim.hilite)
+	}
+	for cnt, btn := range l.buttons {
+		add(fmt.Sprintf("button%d", cnt), btn.model)
+	}
+	return layers
+}
+
+// launchState is the part of the launch screen that is restored when the
+// application resumes, see captureState.
+type launchState struct {
+	preview     int  // Level shown by the start animation.
+	selected    int  // Index of the hovered button, -1 for none.
+	buttonsDone bool // The button animation has finished.
+}
+
+// captureState remembers the launch screen so that a recreated screen
+// can pick up where this one left off, see restoreState.
+func (l *launch) captureState() launchState {
+	s := launchState{preview: l.preview, selected: -1}
+	for cnt, btn := range l.buttons {
+		if btn == l.hovered {
+			s.selected = cnt
+		}
+	}
+	s.buttonsDone = l.banim == nil || l.banim.state == 2
+	return s
+}
+
+// restoreState returns the launch screen to a captured state. Buttons that
+// had finished animating are placed directly in their final layout rather
+// than animating again.
+func (l *launch) restoreState(s launchState) {
+	if s.preview != l.preview {
+		l.startAt(s.preview)
+	}
+	l.hovered = nil
+	if s.selected >= 0 && s.selected < len(l.buttons) {
+		l.hovered = l.buttons[s.selected]
+	}
+	if s.buttonsDone && l.banim != nil && l.banim.state != 2 {
+		if l.banim.state == 0 {
+			l.banim.Animate(0) // sets up the final button size.
+		}
+		l.banim.Abort()
+	}
+}
+
+// backdropRate is the number of updates per second that the backdrop
+// Spin option is based on. The backdrop spins the same amount each second
+// regardless of the actual update rate.
+const backdropRate = 50
+
+// addBackdrop sets up the given parts as the start screen backgrounds.
+// The faded background has its own material so that the fade doesn't affect
+// the other "half" parts. The backgrounds continue from the rotation of any
+// earlier launch screen so that recreating the screen doesn't cause a jump.
+func (l *launch) addBackdrop(bg1, bg2 vu.Part) {
+	l.bg1 = bg1
+	l.bg1.SetFacade("icon", "uv").SetMaterial("fade")
+	l.bg1.Spin(0, 0, l.mp.bg1Angle)
+	l.bg2 = bg2
+	l.bg2.SetFacade("icon", "uv").SetMaterial("half")
+	l.bg2.Spin(0, 0, l.mp.bg2Angle)
+	l.setBackdrop(levelBackdrop(l.mp.launchLevel))
+}
+
+// knownBackdrops are the backdrop textures in the images directory.
+// Level backdrops are named "backdrop" followed by the level number, eg.
+// "backdrop2", while level 0 uses the plain "backdrop".
+var knownBackdrops = map[string]bool{"backdrop": true}
+
+// levelBackdrop returns the backdrop texture name for the given level.
+// Levels without their own backdrop texture use the level 0 backdrop.
+func levelBackdrop(level int) string {
+	if name := fmt.Sprintf("backdrop%d", level); level > 0 && knownBackdrops[name] {
+		return name
+	}
+	return "backdrop"
+}
+
+// setBackdrop changes the texture of both start screen backgrounds.
+func (l *launch) setBackdrop(name string) {
+	if l.bg1 == nil || l.bg2 == nil {
+		return
+	}
+	l.bg1.SetTexture(name, 10)
+	l.bg2.SetTexture(name, -10)
 }
 
 // rotateBackdrop rotates the start screen backgrounds in opposite
-// directions and different speeds.
-func (l *launch) rotateBackdrop() {
-	l.bg1.Spin(0, 0, 0.2)
-	l.bg2.Spin(0, 0, -0.166)
+// directions and different speeds. The total rotation is remembered
+// for later launch screens.
+func (l *launch) rotateBackdrop(deltaTime float64) {
+	spin := l.opts.Spin * backdropRate * deltaTime
+	l.bg1.Spin(0, 0, spin)
+	l.bg2.Spin(0, 0, -spin*0.83)
+	l.mp.bg1Angle = math.Mod(l.mp.bg1Angle+spin, 360)
+	l.mp.bg2Angle = math.Mod(l.mp.bg2Angle-spin*0.83, 360)
 }
 
 // launch
 // ===========================================================================
+// launchOptions
+
+// launchOptions are the user settings applied to the launch screen. The
+// fields are public so they can be saved as JSON. Volume and Colorblind
+// are kept for the screens that support them.
+type launchOptions struct {
+	Volume     float64           // Sound volume from 0 to 1.
+	Spin       float64           // Backdrop spin speed.
+	Colorblind bool              // Use the colorblind friendly theme.
+	Level      int               // Default difficulty level.
+	Keys       map[string]string // Launch reaction names to keys.
+	Countdown  bool              // Count down before starting a game.
+}
+
+// defaultOptions are used when there are no saved options.
+func defaultOptions() *launchOptions {
+	return &launchOptions{Volume: 1, Spin: 0.2, Level: 0, Keys: launchKeys()}
+}
+
+// loadOptions reads JSON encoded options. Missing or invalid values are
+// replaced with defaults, as are all values if the JSON can't be read.
+func loadOptions(r io.Reader) *launchOptions {
+	lo := defaultOptions()
+	if err := json.NewDecoder(r).Decode(lo); err != nil {
+		log.Printf("launch.loadOptions: using defaults %s", err)
+		return defaultOptions()
+	}
+	defaults := defaultOptions()
+	if lo.Volume < 0 || lo.Volume > 1 {
+		lo.Volume = defaults.Volume
+	}
+	if lo.Keys == nil {
+		lo.Keys = map[string]string{}
+	}
+	if lo.Spin < 0 {
+		lo.Spin = defaults.Spin
+	}
+	if lo.Level < 0 || lo.Level >= len(gameCellGain) {
+		lo.Level = defaults.Level
+	}
+	for name, key := range lo.Keys {
+		if _, ok := defaults.Keys[name]; !ok || key == "" {
+			delete(lo.Keys, name)
+		}
+	}
+	for name, key := range defaults.Keys {
+		if _, ok := lo.Keys[name]; !ok {
+			lo.Keys[name] = key
+		}
+	}
+	return lo
+}
+
+// saveOptions writes the options as JSON.
+func (lo *launchOptions) saveOptions(w io.Writer) error {
+	return json.NewEncoder(w).Encode(lo)
+}
+
+// launchOptions
+// ===========================================================================
 // fadeStartAnimation fades out the start screen.
 
 // newFadeAnimation creates the launch screen fade out animation.
-func (l *launch) newFadeAnimation() animation {
-	return &fadeStartAnimation{l: l, ticks: 75}
+func (l *launch) newFadeAnimation() animation { return l.newFadeAnimationThen(nil) }
+
+// newFadeAnimationThen creates the launch screen fade out animation that
+// calls onDone, if not nil, once the animation finishes.
+func (l *launch) newFadeAnimationThen(onDone func()) animation {
+	l.fade = &fadeStartAnimation{l: l, ticks: 75, onDone: onDone}
+	return l.fade
 }
 
 // fadeStartAnimation fades out the launch screen when the user starts a game.
 type fadeStartAnimation struct {
-	l     *launch // Main state needed by the animation.
-	ticks int     // Animation run rate - number of animation steps.
-	tkcnt int     // Current step.
-	state int     // Track progress 0:start, 1:run, 2:done.
+	l      *launch // Main state needed by the animation.
+	ticks  int     // Animation run rate - number of animation steps.
+	tkcnt  int     // Current step.
+	state  int     // Track progress 0:start, 1:run, 2:done.
+	onDone func()  // Optional, called once when the animation finishes.
+
+	// starting transparency of the faded parts, restored when done.
+	bgAlpha, hiliteAlpha float64
 }
 
 // Animate fades out the launch screen before transitioning to the first level.
-// Note that this changes the transparency on the global "grey" material
-// and in the related shader (so set it back when done).
+// Only the launch screens own parts are faded and their transparency is
+// put back when done.
 func (f *fadeStartAnimation) Animate(dt float64) bool {
 	switch f.state {
 	case 0:
 		f.l.state(evolve)
+		f.bgAlpha, f.hiliteAlpha = f.l.bg1.Alpha(), f.l.anim.hilite.Alpha()
 		f.l.anim.hilite.SetAlpha(0)
 		f.state = 1
 		return true
 	case 1:
 		f.l.anim.scale -= 200 / float64(f.ticks)
-		f.l.bg1.SetAlpha(f.l.bg1.Alpha() - float64(1)/float64(f.ticks))
+		f.l.bg1.SetAlpha(f.l.bg1.Alpha() - f.bgAlpha/float64(f.ticks))
 		if f.tkcnt >= f.ticks {
 			f.Wrap()
 			return false // animation done.
@@ -283,18 +842,199 @@ func (f *fadeStartAnimation) Animate(dt float64) bool {
 	}
 }
 
-// Wrap stops the animation and puts the alpha values for the material
-// back to what they were (so that others using the same material aren't
-// affected).
+// Wrap stops the animation and puts the alpha values back to what they were
+// so the launch screen is ready to be shown again.
 func (f *fadeStartAnimation) Wrap() {
-	f.l.anim.hilite.SetAlpha(0.3)
-	f.l.bg1.SetAlpha(0.5)
+	f.restore()
 	f.state = 2
 	f.l.state(deactivate)
+	if done := f.onDone; done != nil {
+		f.onDone = nil
+		done()
+	}
+}
+
+// Abort stops the animation without finishing the transition. The alpha
+// values are restored. Abort does nothing if the animation has already
+// completed.
+func (f *fadeStartAnimation) Abort() {
+	if f.state != 2 {
+		f.restore()
+		f.state = 2
+	}
+}
+
+// restore puts back the starting alpha values. Nothing is changed if the
+// animation never started.
+func (f *fadeStartAnimation) restore() {
+	if f.state != 0 {
+		f.l.anim.hilite.SetAlpha(f.hiliteAlpha)
+		f.l.bg1.SetAlpha(f.bgAlpha)
+	}
 }
 
 // fadeStartAnimation
 // ===========================================================================
+// fadeInAnimation fades in the start screen.
+
+// newFadeInAnimation creates the launch screen fade in animation.
+func (l *launch) newFadeInAnimation() animation {
+	l.entry = &fadeInAnimation{l: l, ticks: 25}
+	return l.entry
+}
+
+// fadeInAnimation fades in the launch screen backgrounds and grows the
+// buttons when returning to the launch screen. The buttons are left to
+// the button animation while it is still running.
+type fadeInAnimation struct {
+	l       *launch // Main state needed by the animation.
+	ticks   int     // Animation run rate - number of animation steps.
+	tkcnt   int     // Current step.
+	state   int     // Track progress 0:start, 1:run, 2:done.
+	buttons bool    // The buttons are grown by this animation.
+
+	// final transparency of the backgrounds, restored when done.
+	bg1Alpha, bg2Alpha float64
+}
+
+// Animate ramps the background alpha and the button size up from 0.
+func (f *fadeInAnimation) Animate(dt float64) bool {
+	switch f.state {
+	case 0:
+		f.bg1Alpha, f.bg2Alpha = f.l.bg1.Alpha(), f.l.bg2.Alpha()
+		f.buttons = f.l.banim == nil || f.l.banim.state == 2
+		f.show(0)
+		f.state = 1
+		return true
+	case 1:
+		if f.tkcnt >= f.ticks {
+			f.Wrap()
+			return false // animation done.
+		}
+		f.tkcnt += 1
+		f.show(float64(f.tkcnt) / float64(f.ticks))
+		return true
+	default:
+		return false // animation done.
+	}
+}
+
+// show draws the backgrounds and buttons at the given fraction, from 0
+// to 1, of their final alpha and size.
+func (f *fadeInAnimation) show(fraction float64) {
+	f.l.bg1.SetAlpha(f.bg1Alpha * fraction)
+	f.l.bg2.SetAlpha(f.bg2Alpha * fraction)
+	if f.buttons {
+		size := float64(f.l.buttonSize) * 0.5 * fraction
+		for _, btn := range f.l.buttons {
+			btn.icon.SetScale(size, size, 0)
+		}
+	}
+}
+
+// Wrap stops the animation leaving the backgrounds and buttons at their
+// final alpha and size.
+func (f *fadeInAnimation) Wrap() {
+	f.restore()
+	f.state = 2
+}
+
+// Abort stops the animation and restores the final alpha and size.
+// Abort does nothing if the animation has already completed.
+func (f *fadeInAnimation) Abort() {
+	if f.state != 2 {
+		f.restore()
+		f.state = 2
+	}
+}
+
+// restore puts back the final alpha values and button size. Nothing is
+// changed if the animation never started.
+func (f *fadeInAnimation) restore() {
+	if f.state != 0 {
+		f.show(1)
+	}
+}
+
+// fadeInAnimation
+// ===========================================================================
+// countdownAnimation
+
+// newExitAnimation creates the animation that runs when the user starts
+// a game. The launch screen is faded out, after an optional countdown.
+func (l *launch) newExitAnimation() animation {
+	if l.opts != nil && l.opts.Countdown {
+		return newTransitionAnimation(l.newCountdownAnimation(), l.newFadeAnimation(), nil)
+	}
+	return l.newFadeAnimation()
+}
+
+// newCountdownAnimation creates a 3-2-1 countdown.
+func (l *launch) newCountdownAnimation() animation {
+	l.countdown = &countdownAnimation{l: l, from: 3, ticks: 40}
+	return l.countdown
+}
+
+// countdownAnimation shows a countdown over the start animation before the
+// launch screen fades out. Skipping the animation ends the countdown.
+type countdownAnimation struct {
+	l     *launch // Main state needed by the animation.
+	count vu.Part // Shows the current number.
+	from  int     // First number shown.
+	ticks int     // Animation steps for each number.
+	tkcnt int     // Current step.
+	state int     // Track progress 0:start, 1:run, 2:done.
+}
+
+// Animate shows each number in turn.
+func (ca *countdownAnimation) Animate(dt float64) bool {
+	switch ca.state {
+	case 0:
+		ca.l.disableKeys()
+		ca.count = ca.l.anim.parent.AddPart()
+		ca.count.SetBanner(strconv.Itoa(ca.from), "uv", "weblySleek22", "weblySleek22White")
+		ca.count.SetLocation(ca.l.anim.cx, ca.l.anim.cy, 1)
+		ca.count.SetScale(2, 2, 1)
+		ca.state = 1
+		return true
+	case 1:
+		if ca.tkcnt >= ca.from*ca.ticks {
+			ca.Wrap()
+			return false // animation done.
+		}
+		if ca.tkcnt%ca.ticks == 0 && ca.tkcnt > 0 {
+			ca.count.UpdateBanner(strconv.Itoa(ca.from - ca.tkcnt/ca.ticks))
+		}
+		ca.tkcnt += 1
+		return true
+	default:
+		return false // animation done.
+	}
+}
+
+// Wrap removes the countdown and reenables the keys disabled when the
+// countdown started. The fade out that follows disables them again.
+func (ca *countdownAnimation) Wrap() {
+	if ca.count != nil {
+		ca.l.anim.parent.RemPart(ca.count)
+		ca.count = nil
+	}
+	if ca.state == 1 {
+		ca.l.enableKeys()
+	}
+	ca.state = 2
+}
+
+// Abort stops the countdown. Abort does nothing if the countdown has
+// already completed.
+func (ca *countdownAnimation) Abort() {
+	if ca.state != 2 {
+		ca.Wrap()
+	}
+}
+
+// countdownAnimation
+// ===========================================================================
 // buttonAnimation
 
 // buttonAnimation flips the buttons open on the launch screen as the game begins.
@@ -305,10 +1045,42 @@ type buttonAnimation struct {
 	buttonSc float64 // button original scale animation.
 	buttonSx float64 // button scale animation.
 	buttonSy float64 // button scale animation.
+	speed    float64 // animation progress per second for each phase.
+	onDone   func()  // optional, called once when the animation finishes.
+
+	// ease optionally changes the linear progress of each phase.
+	// Nil keeps the progress linear, see setEase.
+	ease func(progress float64) float64
 }
 
+// buttonSpeed is the default button animation speed.
+const buttonSpeed = 4
+
+// easeIn starts slowly and finishes quickly.
+func easeIn(progress float64) float64 { return progress * progress }
+
+// easeOut starts quickly and finishes slowly.
+func easeOut(progress float64) float64 { return progress * (2 - progress) }
+
+// easeInOut starts and finishes slowly. The midpoint is unchanged.
+func easeInOut(progress float64) float64 { return progress * progress * (3 - 2*progress) }
+
 // newButtonAnimation sets the initial conditions for the button animation.
-func (l *launch) newButtonAnimation() animation { return &buttonAnimation{l: l} }
+func (l *launch) newButtonAnimation() animation { return l.newButtonAnimationThen(nil) }
+
+// newButtonAnimationThen creates the button animation that calls onDone,
+// if not nil, once the animation finishes.
+func (l *launch) newButtonAnimationThen(onDone func()) animation {
+	return l.newButtonAnimationAt(buttonSpeed, onDone)
+}
+
+// newButtonAnimationAt creates the button animation with the given speed.
+// Lower speeds slow the buttons down for reduced motion while very large
+// speeds snap the buttons into place.
+func (l *launch) newButtonAnimationAt(speed float64, onDone func()) animation {
+	l.banim = &buttonAnimation{l: l, speed: speed, onDone: onDone}
+	return l.banim
+}
 
 // Animate get regular calls to run the start screen animation.
 // Float the buttons into position.
@@ -322,21 +1094,20 @@ func (ba *buttonAnimation) Animate(dt float64) bool {
 		ba.state = 1
 		return true
 	case 1:
-		speed := float64(4)
 		if ba.buttonSy < 1.0 {
-			ba.buttonSy += speed * dt
+			ba.buttonSy = math.Min(ba.buttonSy+ba.speed*dt, 1)
 			for _, btn := range ba.l.buttons {
 				sx, _, sz := btn.icon.Scale()
-				btn.icon.SetScale(sx, ba.buttonSc*ba.buttonSy, sz)
+				btn.icon.SetScale(sx, ba.buttonSc*ba.eased(ba.buttonSy), sz)
 			}
 		} else if ba.buttonA < 1.0 {
-			ba.buttonA += speed * dt
-			ba.l.layout(ba.buttonA)
+			ba.buttonA = math.Min(ba.buttonA+ba.speed*dt, 1)
+			ba.l.layout(ba.eased(ba.buttonA))
 		} else if ba.buttonSx < 1.0 {
-			ba.buttonSx += speed * dt
+			ba.buttonSx = math.Min(ba.buttonSx+ba.speed*dt, 1)
 			for _, btn := range ba.l.buttons {
 				_, sy, sz := btn.icon.Scale()
-				btn.icon.SetScale(ba.buttonSc*ba.buttonSx, sy, sz)
+				btn.icon.SetScale(ba.buttonSc*ba.eased(ba.buttonSx), sy, sz)
 			}
 		} else {
 			ba.Wrap()
@@ -348,12 +1119,37 @@ func (ba *buttonAnimation) Animate(dt float64) bool {
 	}
 }
 
+// setEase changes how the buttons move between their start and end
+// positions, for example easeInOut. Nil restores the linear movement.
+func (ba *buttonAnimation) setEase(ease func(progress float64) float64) { ba.ease = ease }
+
+// eased applies the easing function to the given phase progress.
+func (ba *buttonAnimation) eased(progress float64) float64 {
+	if ba.ease == nil {
+		return progress
+	}
+	return ba.ease(progress)
+}
+
 // Wrap stops the button animation and ensures the button scale is exact.
 func (ba *buttonAnimation) Wrap() {
 	ba.state = 2
 	for _, btn := range ba.l.buttons {
 		btn.icon.SetScale(ba.buttonSc, ba.buttonSc, 0)
 	}
+	if done := ba.onDone; done != nil {
+		ba.onDone = nil
+		done()
+	}
+}
+
+// Abort stops the button animation leaving the buttons in their final
+// positions. Abort does nothing if the animation has already completed.
+func (ba *buttonAnimation) Abort() {
+	if ba.state != 2 {
+		ba.l.layout(1)
+		ba.Wrap()
+	}
 }
 
 // buttonAnimation
@@ -363,39 +1159,79 @@ func (ba *buttonAnimation) Wrap() {
 // startAnimation shows a rotating cube that is regenerating cells. This is not a
 // normal animation as it is also used as the game start button.
 type startAnimation struct {
-	area             // Start animation acts like a button.
-	eng    vu.Engine // Engine is needed to create parts.
-	parent vu.Part   // Parent part of the player.
-	cx, cy float64   // Center of the area.
-	player *trooper  // Player can be new or saved.
-	hilite vu.Part   // Hover overlay.
-	scale  float64   // Controls the animation size.
+	area                 // Start animation acts like a button.
+	eng        vu.Engine // Engine is needed to create parts.
+	parent     vu.Part   // Parent part of the player.
+	cx, cy     float64   // Center of the area.
+	player     *trooper  // Player can be new or saved.
+	hilite     vu.Part   // Hover overlay.
+	scale      float64   // Controls the animation size.
+	regenAccum float32   // Time accumulated towards the next regenerated cell.
+	noRegen    bool      // Stops the player from regenerating cells.
+	frozen     bool      // Stops rotation and regeneration, see freeze.
+	unfocused  bool      // The window lost focus, see onFocus.
+	resumed    bool      // Focus has just come back, see onFocus.
+
+	// level changes are animated when there is an animator.
+	ani   *animator            // Runs the level morph animations.
+	morph *levelMorphAnimation // Current level morph, if any.
+
+	// demo mode shows the player losing and regaining cells.
+	demo      bool    // Demo mode is on, see setDemoMode.
+	demoAccum float64 // Time accumulated towards the next demo change.
+	demoLoss  bool    // The next demo change loses cells.
 }
 
-// newStartAnimation creates the start screen animation.
+// newStartAnimation creates the start screen animation. The animation
+// starts by showing the launch level.
 func newStartAnimation(mp *bampf, parent vu.Part, screenWidth, screenHeight int) *startAnimation {
 	sa := &startAnimation{}
 	sa.eng = mp.eng
+	sa.ani = mp.ani
 	sa.parent = parent
 	sa.scale = 200
 	sa.hilite = parent.AddPart()
 	sa.hilite.SetFacade("square", "flat").SetMaterial("white")
 	sa.hilite.SetVisible(false)
 	sa.resize(screenWidth, screenHeight)
-	sa.showLevel(0)
+	sa.showLevel(mp.launchLevel)
 	return sa
 }
 
 // showLevel changes the animation to match the given user level choice.
+// An existing player is faded out while the new player fades in.
 func (sa *startAnimation) showLevel(level int) {
-	if sa.player != nil {
-		sa.player.trash()
+	if level < 0 {
+		log.Printf("start: showLevel: invalid level %d", level)
+		level = 0
 	}
+	if sa.morph != nil {
+		sa.morph.Wrap() // finish any earlier level change.
+	}
+	old := sa.player
 	sa.player = newTrooper(sa.eng, sa.parent.AddPart(), level)
-	sa.player.part.Spin(15, 0, 0)
-	sa.player.part.Spin(0, 0, 15)
+	sa.player.parent = sa.parent
+	sa.regenAccum = 0
+	sa.player.setOrientation(15, 0, 15)
 	sa.player.setScale(sa.scale)
 	sa.player.setLoc(sa.cx, sa.cy, 0)
+	switch {
+	case old == nil:
+	case sa.ani == nil:
+		old.dispose()
+	default:
+		sa.morph = sa.newLevelMorphAnimation(old, sa.player)
+		sa.ani.addAnimation(sa.morph)
+	}
+}
+
+// showState changes the animation to a saved trooper. This allows the
+// start screen to preview the players saved progress.
+func (sa *startAnimation) showState(state trooperState) {
+	sa.showLevel(state.lvl)
+	if err := sa.player.restore(state); err != nil {
+		log.Printf("start: showState: %s", err)
+	}
 }
 
 // resize ensures that animation only takes up most of the available area.
@@ -411,7 +1247,9 @@ func (sa *startAnimation) resize(screenWidth, screenHeight int) {
 	sa.w, sa.h = size*2, size*2
 	sa.x, sa.y = int(sa.cx)-size, int(sa.cy)-size
 
-	// reposition the hover hilite.
+	// reposition the hover hilite. It shares the trooper depth on purpose:
+	// the hilite is a backing square added before the trooper, so it is
+	// drawn behind the trooper rather than covering it.
 	sa.hilite.SetLocation(sa.cx, sa.cy, 0)
 	sa.hilite.SetScale(float64(size), float64(size), 1)
 
@@ -436,14 +1274,168 @@ func (sa *startAnimation) hover(mx, my int) {
 
 // rotate is called each game loop to update the player rotation.
 func (sa *startAnimation) rotate(gameTime, deltaTime float64) {
+	if sa.frozen || sa.unfocused {
+		return
+	}
+	if sa.resumed {
+		sa.resumed = false
+		return // the first delta after regaining focus includes the time away.
+	}
 	spinSpeed := float64(25) // degrees per second.
 	sa.player.part.Spin(0, deltaTime*spinSpeed, 0)
 	sa.player.setScale(sa.scale)
 	sa.player.setLoc(sa.player.loc())
+	sa.player.coolDown(1)
 
 	// regenerate cubes faster as the player gets bigger.
-	rate := (sa.player.lvl + 1) * (sa.player.lvl + 1) * 2
-	if int(gameTime)%(100/rate) == 0 {
-		sa.player.attach()
+	if sa.noRegen {
+		return
+	}
+	if sa.demo {
+		sa.runDemo(deltaTime)
+		return
+	}
+	if cells := sa.regenerate(deltaTime); cells > 0 {
+		if health, _, max := sa.player.health(); cells > max-health {
+			cells = max - health // don't spill over into the shield.
+		}
+		sa.player.regenCores(cells)
+	}
+}
+
+// freeze stops the player from rotating and regenerating while leaving it
+// drawn at its current scale and orientation. This is used for screenshots.
+func (sa *startAnimation) freeze() { sa.frozen = true }
+
+// unfreeze undoes freeze so that the player rotates and regenerates again.
+func (sa *startAnimation) unfreeze() { sa.frozen = false }
+
+// onFocus stops the player rotating and regenerating while the window
+// doesn't have focus. When focus returns the player continues from where
+// it stopped instead of jumping ahead by the time spent without focus.
+func (sa *startAnimation) onFocus(focused bool) {
+	if focused && sa.unfocused {
+		sa.resumed = true
+	}
+	sa.unfocused = !focused
+}
+
+// setAutoRegen turns player cell regeneration on or off. Regeneration is
+// on by default. Turning it off keeps a showState preview at the saved health.
+func (sa *startAnimation) setAutoRegen(on bool) { sa.noRegen = !on }
+
+// demoInterval is the number of seconds between demo mode changes.
+const demoInterval = 1.5
+
+// setDemoMode turns demo mode on or off. In demo mode the player takes
+// turns losing and regaining a chunk of cells, instead of regenerating,
+// to show off the cell mechanics. Demo mode is off by default.
+func (sa *startAnimation) setDemoMode(on bool) {
+	sa.demo = on
+	sa.demoAccum = 0
+	sa.demoLoss = true
+}
+
+// runDemo removes or adds cells each time a demoInterval has passed.
+func (sa *startAnimation) runDemo(deltaTime float64) {
+	sa.demoAccum += deltaTime
+	for sa.demoAccum >= demoInterval {
+		sa.demoAccum -= demoInterval
+		_, mid, max := sa.player.health()
+		cells := (max-mid)/2 + 1
+		if sa.demoLoss {
+			sa.player.detachCores(cells)
+		} else {
+			sa.player.attachCores(cells)
+		}
+		sa.demoLoss = !sa.demoLoss
+	}
+}
+
+// regenerate accumulates elapsed time and returns the number of cells that
+// are due to be attached. This keeps the regeneration speed the same
+// regardless of the frame rate. At most maxRegenCells are returned and any
+// time beyond that is dropped so that a long frame doesn't cause a burst.
+func (sa *startAnimation) regenerate(deltaTime float64) (cells int) {
+	sa.regenAccum += float32(deltaTime)
+	interval := regenInterval(sa.player.lvl)
+	for sa.regenAccum >= interval {
+		if cells == maxRegenCells {
+			sa.regenAccum = 0
+			break
+		}
+		sa.regenAccum -= interval
+		cells++
+	}
+	return cells
+}
+
+// maxRegenCells is the most cells the start screen player regenerates
+// in a single frame.
+const maxRegenCells = 16
+
+// regenInterval is the number of seconds between regenerated cells for
+// the given level. Higher levels have more cells to fill so they regenerate
+// faster, at 2*(level+1)^2 cells per second.
+func regenInterval(level int) float32 {
+	if level < 0 {
+		level = 0
+	}
+	rate := 2 * ((level + 1) * (level + 1)) // cells per second.
+	return 1 / float32(rate)
+}
+
+// startAnimation
+// ===========================================================================
+// levelMorphAnimation
+
+// newLevelMorphAnimation creates the animation that switches the start
+// screen from the old player to the new player.
+func (sa *startAnimation) newLevelMorphAnimation(old, neo *trooper) *levelMorphAnimation {
+	return &levelMorphAnimation{sa: sa, old: old, neo: neo, ticks: 25}
+}
+
+// levelMorphAnimation cross fades between two start screen players.
+// The old player is disposed once the fade completes.
+type levelMorphAnimation struct {
+	sa    *startAnimation // Owner of the players.
+	old   *trooper        // Player being faded out.
+	neo   *trooper        // Player being faded in.
+	ticks int             // Animation run rate - number of animation steps.
+	tkcnt int             // Current step.
+	state int             // Track progress 0:start, 1:run, 2:done.
+}
+
+// Animate fades out the old player and fades in the new player.
+func (lm *levelMorphAnimation) Animate(dt float64) bool {
+	switch lm.state {
+	case 0:
+		lm.neo.setAlpha(0)
+		lm.state = 1
+		return true
+	case 1:
+		if lm.tkcnt >= lm.ticks {
+			lm.Wrap()
+			return false // animation done.
+		}
+		lm.tkcnt += 1
+		fade := float64(lm.tkcnt) / float64(lm.ticks)
+		lm.old.setAlpha(1 - fade)
+		lm.neo.setAlpha(fade)
+		return true
+	default:
+		return false // animation done.
+	}
+}
+
+// Wrap disposes the old player and leaves the new player fully visible.
+func (lm *levelMorphAnimation) Wrap() {
+	if lm.state != 2 {
+		lm.state = 2
+		lm.old.dispose()
+		lm.neo.setAlpha(1)
+		if lm.sa.morph == lm {
+			lm.sa.morph = nil
+		}
 	}
 }
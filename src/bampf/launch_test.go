@@ -0,0 +1,1057 @@
+// Copyright © 2013 Galvanized Logic Inc.
+// Use is governed by a FreeBSD license found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"vu"
+)
+
+func TestRegenerate(t *testing.T) {
+	expected := map[int]int{0: 4, 1: 16, 3: 64} // cells per 2 seconds.
+	for level, cells := range expected {
+		sa := &startAnimation{player: &trooper{lvl: level}}
+		attached := 0
+		for step := 0; step < 64; step++ {
+			attached += sa.regenerate(0.03125)
+		}
+		if attached != cells {
+			t.Errorf("Level %d expected %d cells, got %d", level, cells, attached)
+		}
+	}
+}
+
+func TestFadeIn(t *testing.T) {
+	l := testLaunch()
+	l.bg1, l.bg2 = &testPart{alpha: 0.5}, &testPart{alpha: 0.5}
+	fade := l.fadeIn()
+	fade.Animate(0.02)
+	if l.bg1.Alpha() != 0 || l.bg2.Alpha() != 0 {
+		t.Errorf("Expected the fade to start transparent, got %f %f", l.bg1.Alpha(), l.bg2.Alpha())
+	}
+	fade.Animate(0.02)
+	if alpha := l.bg1.Alpha(); alpha <= 0 || alpha >= 0.5 {
+		t.Errorf("Expected the background to be fading in, got %f", alpha)
+	}
+	for fade.Animate(0.02) {
+	}
+	if l.bg1.Alpha() != 0.5 || l.bg2.Alpha() != 0.5 {
+		t.Errorf("Expected background alpha 0.5, got %f %f", l.bg1.Alpha(), l.bg2.Alpha())
+	}
+	for cnt, btn := range l.buttons {
+		if sx, sy, _ := btn.icon.Scale(); sx != 32 || sy != 32 {
+			t.Errorf("Button %d expected full scale, got %f %f", cnt, sx, sy)
+		}
+	}
+}
+
+func TestAbortFade(t *testing.T) {
+	l := &launch{state: func(int) {}}
+	l.bg1 = &testPart{alpha: 0.5}
+	l.anim = &startAnimation{hilite: &testPart{alpha: 0.3}, scale: 200}
+	fade := l.newFadeAnimation()
+	fade.Animate(0)
+	for cnt := 0; cnt < 10; cnt++ {
+		fade.Animate(0.02)
+	}
+	if l.bg1.Alpha() >= 0.5 || l.anim.hilite.Alpha() != 0 {
+		t.Errorf("Expected fade in progress, got %f %f", l.bg1.Alpha(), l.anim.hilite.Alpha())
+	}
+	l.abort()
+	if l.bg1.Alpha() != 0.5 || l.anim.hilite.Alpha() != 0.3 {
+		t.Errorf("Expected 0.5 0.3, got %f %f", l.bg1.Alpha(), l.anim.hilite.Alpha())
+	}
+	if fade.Animate(0.02) {
+		t.Errorf("Expected aborted animation to be done")
+	}
+}
+
+// testPart is a minimal stand in for engine parts so that models can be
+// tested without a running engine. Methods not needed by the tests are
+// left to the embedded (nil) interface.
+type testPart struct {
+	vu.Part
+	parts      []*testPart
+	added      int // Total number of AddPart calls.
+	x, y, z    float64
+	sx, sy, sz float64
+	alpha      float64
+	visible    bool
+	material   string
+	shader     string
+	texture    string
+	banner     string
+	rot        [4]float64 // Rotation quaternion x, y, z, w.
+	spin       [3]float64 // Degrees spun since the rotation was last set.
+	removed    *[]vu.Part // Optional record of RemPart calls, shared with children.
+}
+
+func (p *testPart) AddPart() vu.Part {
+	child := &testPart{visible: true, alpha: 1, removed: p.removed}
+	p.added++
+	p.parts = append(p.parts, child)
+	return child
+}
+func (p *testPart) RemPart(part vu.Part) {
+	if p.removed != nil {
+		*p.removed = append(*p.removed, part)
+	}
+	for cnt, child := range p.parts {
+		if child == part {
+			p.parts = append(p.parts[:cnt], p.parts[cnt+1:]...)
+			return
+		}
+	}
+}
+func (p *testPart) Dispose()                              {}
+func (p *testPart) SetCullable(cullable bool)             {}
+func (p *testPart) SetFacade(mesh, shader string) vu.Part { p.shader = shader; return p }
+func (p *testPart) SetMaterial(name string) vu.Part       { p.material = name; return p }
+func (p *testPart) SetTexture(name string, spin float64)  { p.texture = name }
+func (p *testPart) Spin(x, y, z float64)                  { p.spin[0] += x; p.spin[1] += y; p.spin[2] += z }
+func (p *testPart) Location() (x, y, z float64)           { return p.x, p.y, p.z }
+func (p *testPart) SetLocation(x, y, z float64)           { p.x, p.y, p.z = x, y, z }
+func (p *testPart) Scale() (x, y, z float64)              { return p.sx, p.sy, p.sz }
+func (p *testPart) SetScale(x, y, z float64)              { p.sx, p.sy, p.sz = x, y, z }
+func (p *testPart) Rotation() (x, y, z, w float64)        { return p.rot[0], p.rot[1], p.rot[2], p.rot[3] }
+func (p *testPart) Alpha() float64                        { return p.alpha }
+func (p *testPart) SetAlpha(alpha float64)                { p.alpha = alpha }
+func (p *testPart) Visible() bool                         { return p.visible }
+func (p *testPart) SetVisible(visible bool)               { p.visible = visible }
+func (p *testPart) SetRotation(x, y, z, w float64) {
+	p.rot = [4]float64{x, y, z, w}
+	p.spin = [3]float64{}
+}
+func (p *testPart) SetBanner(text, shader, glyphs, texture string) {
+	p.banner = text
+}
+func (p *testPart) UpdateBanner(text string) {
+	p.banner = text
+}
+
+func TestShowState(t *testing.T) {
+	saved := newTrooper(nil, &testPart{}, 2)
+	health, mid, max := saved.health()
+	for ; health < mid+(max-mid)/2; health++ {
+		saved.attach()
+	}
+	sa := &startAnimation{parent: &testPart{}, scale: 200}
+	sa.showState(saved.snapshot())
+	if got, _, _ := sa.player.health(); got != health {
+		t.Errorf("Expected health %d, got %d", health, got)
+	}
+	sa.scale = 100
+	sa.rotate(0, 0.01)
+	if sx, _, _ := sa.player.part.Scale(); sx != 100 {
+		t.Errorf("Expected scale 100, got %f", sx)
+	}
+}
+
+func TestRemapClick(t *testing.T) {
+	event := -1
+	mp := &bampf{state: func(e int) { event = e }}
+	l := &launch{mp: mp, reacts: map[string]vu.Reaction{}}
+	l.keys = launchKeys()
+	l.keys["click"] = "Rm"
+	l.anim = &startAnimation{area: area{x: 0, y: 0, w: 100, h: 100}}
+	l.mx, l.my = 50, 50
+	l.enableKeys()
+	if _, ok := l.reacts["Lm"]; ok {
+		t.Errorf("Expected left mouse to be unbound")
+	}
+	if reaction, ok := l.reacts["Rm"]; ok {
+		reaction.Do()
+	}
+	if event != play {
+		t.Errorf("Expected right mouse click to start play, got %d", event)
+	}
+	l.disableKeys()
+	if _, ok := l.reacts["Rm"]; ok {
+		t.Errorf("Expected right mouse to be disabled")
+	}
+}
+
+func TestNarrowLayout(t *testing.T) {
+	l := testLaunch()
+	l.w, l.h = 320, 800
+	l.cx, l.cy = l.center()
+	l.layout(1)
+	for cnt, btn := range l.buttons {
+		if btn.x < 0 || btn.x+btn.w > l.w {
+			t.Errorf("Button %d at %d is off screen", cnt, btn.x)
+		}
+	}
+}
+
+func TestHoverSound(t *testing.T) {
+	noise := &testSound{}
+	l := &launch{hoverNoise: noise}
+	l.anim = &startAnimation{hilite: &testPart{}}
+	for cnt := 0; cnt < 2; cnt++ {
+		btn := &button{area: area{x: cnt * 100, w: 64, h: 64}, hilite: &testPart{}}
+		l.buttons = append(l.buttons, btn)
+	}
+	for _, mx := range []int{10, 20, 30, 80, 110, 120, 130} {
+		l.mx, l.my = mx, 10
+		l.hover()
+	}
+	if noise.plays != 2 {
+		t.Errorf("Expected 2 hover sounds, got %d", noise.plays)
+	}
+}
+
+func TestOptionsRoundTrip(t *testing.T) {
+	lo := &launchOptions{Volume: 0.5, Spin: 0.4, Colorblind: true, Level: 3, Keys: launchKeys(), Countdown: true}
+	lo.Keys["click"] = "Rm"
+	buf := &bytes.Buffer{}
+	if err := lo.saveOptions(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadOptions(buf); !reflect.DeepEqual(got, lo) {
+		t.Errorf("Expected %v, got %v", lo, got)
+	}
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	if got := loadOptions(strings.NewReader(`{"Spin": 0.5,`)); !reflect.DeepEqual(got, defaultOptions()) {
+		t.Errorf("Expected defaults for malformed options, got %v", got)
+	}
+	got := loadOptions(strings.NewReader(`{"Volume": 7, "Spin": -7, "Level": 2, "Keys": {"click": "", "jump": "J"}}`))
+	expected := defaultOptions()
+	expected.Level = 2
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if got := loadOptions(strings.NewReader(`{"Keys": null}`)); !reflect.DeepEqual(got, defaultOptions()) {
+		t.Errorf("Expected default keys for null keys, got %v", got)
+	}
+}
+
+func TestSkipDebounce(t *testing.T) {
+	mp := &bampf{ani: &animator{}}
+	l := &launch{mp: mp, opts: defaultOptions(), keys: launchKeys()}
+	l.reacts = map[string]vu.Reaction{"Sp": vu.NewReactOnce("skip", func() { l.skip() })}
+	l.bg1, l.bg2 = &testPart{}, &testPart{}
+	l.anim = &startAnimation{hilite: &testPart{}, player: newTrooper(nil, &testPart{}, 0)}
+	input := &vu.Input{Down: map[string]int{"Sp": 1}}
+	first, second := &testAnimation{}, &testAnimation{}
+	mp.ani.addAnimation(first)
+	l.handleUpdate(input)
+	mp.ani.addAnimation(second)
+	l.handleUpdate(input)
+	if first.wraps != 1 || second.wraps != 0 {
+		t.Errorf("Expected one skip, got %d %d", first.wraps, second.wraps)
+	}
+	for cnt := 0; cnt < launchSkipTicks; cnt++ {
+		l.handleUpdate(&vu.Input{})
+	}
+	l.handleUpdate(input)
+	if second.wraps != 1 {
+		t.Errorf("Expected skip after the debounce window")
+	}
+}
+
+// testAnimation counts the number of times it is wrapped.
+type testAnimation struct{ wraps int }
+
+func (ta *testAnimation) Animate(dt float64) bool { return true }
+func (ta *testAnimation) Wrap()                   { ta.wraps++ }
+
+func TestAnimationDone(t *testing.T) {
+	l := &launch{state: func(int) {}}
+	l.bg1 = &testPart{alpha: 0.5}
+	l.anim = &startAnimation{hilite: &testPart{alpha: 0.3}, scale: 200}
+	calls := 0
+	fade := l.newFadeAnimationThen(func() { calls++ })
+	for fade.Animate(0.02) {
+	}
+	fade.Wrap()
+	if calls != 1 {
+		t.Errorf("Expected one fade done call, got %d", calls)
+	}
+	calls = 0
+	buttons := l.newButtonAnimationThen(func() { calls++ })
+	for buttons.Animate(0.02) {
+	}
+	if calls != 1 {
+		t.Errorf("Expected one button done call, got %d", calls)
+	}
+}
+
+func TestLevelPreview(t *testing.T) {
+	for level := 1; level < len(gameCellLoss); level++ {
+		if levelDamage(level) <= levelDamage(level-1) {
+			t.Errorf("Expected level %d to do more damage", level)
+		}
+	}
+	reported := map[int]int{}
+	l := &launch{onLevel: func(level, damage int) { reported[level] = damage }}
+	l.anim = &startAnimation{hilite: &testPart{}}
+	for cnt := 0; cnt <= len(levels()); cnt++ {
+		btn := &button{area: area{x: cnt * 100, w: 64, h: 64}, hilite: &testPart{}}
+		l.buttons = append(l.buttons, btn)
+	}
+	for _, mx := range []int{310, 320, len(levels())*100 + 10} {
+		l.mx, l.my = mx, 10
+		l.hover()
+	}
+	if len(reported) != 1 || reported[3] != levelDamage(3) {
+		t.Errorf("Expected level 3 damage %d, got %v", levelDamage(3), reported)
+	}
+}
+
+func TestLevelKeys(t *testing.T) {
+	event := -1
+	mp := &bampf{state: func(e int) { event = e }}
+	l := &launch{mp: mp, opts: defaultOptions(), keys: launchKeys(), reacts: map[string]vu.Reaction{}}
+	l.anim = &startAnimation{parent: &testPart{}}
+	l.enableKeys()
+	for _, key := range []string{"2", "Ret"} {
+		if reaction, ok := l.reacts[key]; ok {
+			reaction.Do()
+		}
+	}
+	if mp.launchLevel != 2 || event != play {
+		t.Errorf("Expected level 2 play, got %d %d", mp.launchLevel, event)
+	}
+	l.disableKeys()
+	if _, ok := l.reacts["2"]; ok {
+		t.Errorf("Expected number keys to be disabled")
+	}
+}
+
+func TestLevelMorph(t *testing.T) {
+	sa := &startAnimation{parent: &testPart{}, scale: 200, ani: &animator{}}
+	sa.showLevel(1)
+	old := sa.player
+	sa.showLevel(2)
+	if sa.morph == nil || old.part == nil {
+		t.Fatalf("Expected the old player to fade out")
+	}
+	for cnt := 0; cnt < 50; cnt++ {
+		sa.ani.animate(0.02)
+	}
+	if old.part != nil || sa.morph != nil {
+		t.Errorf("Expected the old player to be disposed")
+	}
+	if alpha := sa.player.center.Alpha(); alpha != 1 {
+		t.Errorf("Expected new player at full alpha, got %f", alpha)
+	}
+}
+
+func TestButtonIcons(t *testing.T) {
+	l := &launch{}
+	for cnt := 0; cnt < 3; cnt++ {
+		l.buttons = append(l.buttons, newButton(nil, &testPart{}, 64, "lvl0", nil))
+	}
+	if err := l.setButtonIcons([]string{"a", "b"}); err == nil {
+		t.Errorf("Expected an error for the wrong number of icons")
+	}
+	names := []string{"skin0", "skin1", "skin2"}
+	if err := l.setButtonIcons(names); err != nil {
+		t.Fatal(err)
+	}
+	for cnt, btn := range l.buttons {
+		if got := btn.icon.(*testPart).texture; got != names[cnt] {
+			t.Errorf("Button %d expected icon %s, got %s", cnt, names[cnt], got)
+		}
+	}
+}
+
+func TestStartAtClamp(t *testing.T) {
+	mp := &bampf{}
+	l := &launch{mp: mp, opts: defaultOptions()}
+	l.anim = &startAnimation{parent: &testPart{}}
+	for level, expected := range map[int]int{-1: 0, 99: gameMaxLevel(), 2: 2} {
+		l.startAt(level)
+		if mp.launchLevel != expected || l.opts.Level != expected {
+			t.Errorf("Level %d expected %d, got %d", level, expected, mp.launchLevel)
+		}
+	}
+}
+
+func TestButtonSpeed(t *testing.T) {
+	calls := map[float64]int{}
+	for _, speed := range []float64{buttonSpeed, 100} {
+		l := testLaunch()
+		buttons := l.newButtonAnimationAt(speed, nil)
+		for buttons.Animate(0.02) {
+			calls[speed]++
+		}
+	}
+	if calls[100] >= calls[buttonSpeed] {
+		t.Errorf("Expected a faster animation, got %d and %d calls", calls[100], calls[buttonSpeed])
+	}
+}
+
+func TestIsAnimating(t *testing.T) {
+	l := &launch{buttonSize: 64}
+	l.w, l.h = 800, 600
+	l.buttons = append(l.buttons, &button{area: area{w: 64, h: 64}, model: &testPart{}, icon: &testPart{}})
+	if l.isAnimating() {
+		t.Errorf("Expected no animation")
+	}
+	buttons := l.newButtonAnimation()
+	buttons.Animate(0)
+	buttons.Animate(0.02)
+	if !l.isAnimating() {
+		t.Errorf("Expected the button animation to be running")
+	}
+	buttons.Wrap()
+	if l.isAnimating() {
+		t.Errorf("Expected no animation after wrap")
+	}
+}
+
+func TestBackdropRotation(t *testing.T) {
+	spins := []float64{}
+	for _, dt := range []float64{0.02, 0.04} {
+		l := &launch{mp: &bampf{}, opts: defaultOptions()}
+		l.bg1, l.bg2 = &testPart{}, &testPart{}
+		l.anim = &startAnimation{hilite: &testPart{}, player: newTrooper(nil, &testPart{}, 0)}
+		l.handleUpdate(&vu.Input{Dt: dt})
+		bg1, bg2 := l.bg1.(*testPart).spin[2], l.bg2.(*testPart).spin[2]
+		if bg2 != -bg1*0.83 {
+			t.Errorf("Expected relative backdrop speeds to be kept, got %f %f", bg1, bg2)
+		}
+		spins = append(spins, bg1)
+	}
+	if spins[0] == 0 || math.Abs(spins[1]-2*spins[0]) > 1e-9 {
+		t.Errorf("Expected rotation to scale with dt, got %v", spins)
+	}
+}
+
+func TestAutoRegen(t *testing.T) {
+	sa := &startAnimation{parent: &testPart{}, scale: 200}
+	sa.showLevel(2)
+	health, _, _ := sa.player.health()
+	sa.setAutoRegen(false)
+	for cnt := 0; cnt < 100; cnt++ {
+		sa.rotate(0, 0.1)
+	}
+	if got, _, _ := sa.player.health(); got != health {
+		t.Errorf("Expected health %d, got %d", health, got)
+	}
+	sa.setAutoRegen(true)
+	sa.rotate(0, 0.1)
+	if got, _, _ := sa.player.health(); got <= health {
+		t.Errorf("Expected regeneration, got %d", got)
+	}
+}
+
+func TestFadeOwnAlpha(t *testing.T) {
+	l := &launch{state: func(int) {}}
+	l.bg1 = &testPart{alpha: 0.5, material: "fade"}
+	l.bg2 = &testPart{alpha: 0.5, material: "half"}
+	l.anim = &startAnimation{hilite: &testPart{alpha: 0.3}, scale: 200}
+	fade := l.newFadeAnimation()
+	fade.Animate(0)
+	for cnt := 0; cnt < 10; cnt++ {
+		fade.Animate(0.02)
+	}
+	if l.bg1.Alpha() >= 0.5 || l.bg2.Alpha() != 0.5 {
+		t.Errorf("Expected only the faded backdrop to change, got %f %f", l.bg1.Alpha(), l.bg2.Alpha())
+	}
+
+	// the captured alphas are restored, not the ones current at the end.
+	l.bg1.SetAlpha(0.1)
+	for fade.Animate(0.02) {
+	}
+	if l.bg1.Alpha() != 0.5 || l.anim.hilite.Alpha() != 0.3 {
+		t.Errorf("Expected alphas restored, got %f %f", l.bg1.Alpha(), l.anim.hilite.Alpha())
+	}
+	aborted := l.newFadeAnimation().(*fadeStartAnimation)
+	aborted.Animate(0)
+	aborted.Animate(0.02)
+	l.bg1.SetAlpha(0.2)
+	l.anim.hilite.SetAlpha(0.9)
+	aborted.Abort()
+	if l.bg1.Alpha() != 0.5 || l.anim.hilite.Alpha() != 0.3 {
+		t.Errorf("Expected alphas restored after an abort, got %f %f", l.bg1.Alpha(), l.anim.hilite.Alpha())
+	}
+}
+
+func TestWheelLevels(t *testing.T) {
+	mp := &bampf{}
+	l := &launch{mp: mp, opts: defaultOptions(), keys: launchKeys(), reacts: map[string]vu.Reaction{}}
+	l.anim = &startAnimation{parent: &testPart{}}
+	l.preview = gameMaxLevel() - 1
+	l.enableKeys()
+	for _, expected := range []int{gameMaxLevel(), 0, 1} {
+		l.reacts["Wu"].Do()
+		if l.preview != expected || mp.launchLevel != expected {
+			t.Errorf("Expected level %d, got %d", expected, l.preview)
+		}
+	}
+	l.reacts["Wd"].Do()
+	l.reacts["Wd"].Do()
+	if l.preview != gameMaxLevel() {
+		t.Errorf("Expected wheel down to wrap to %d, got %d", gameMaxLevel(), l.preview)
+	}
+	l.disableKeys()
+	if _, ok := l.reacts["Wu"]; ok {
+		t.Errorf("Expected the wheel to be disabled")
+	}
+}
+
+func TestCountdown(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		opts := defaultOptions()
+		opts.Countdown = true
+		l := &launch{state: func(int) {}, opts: opts, keys: launchKeys(), reacts: map[string]vu.Reaction{}}
+		l.bg1 = &testPart{alpha: 0.5}
+		parent := &testPart{}
+		l.anim = &startAnimation{parent: parent, hilite: &testPart{alpha: 0.3}, scale: 200}
+		played := false
+		start := newTransitionAnimation(l.fadeOut(), nil, func() { played = true })
+		start.Animate(0)
+		if len(parent.parts) != 1 || parent.parts[0].banner != "3" {
+			t.Fatalf("Expected the countdown to be shown")
+		}
+		if skip {
+			start.Wrap()
+		} else {
+			for cnt := 0; cnt < 120; cnt++ {
+				start.Animate(0.02)
+			}
+			if played || parent.parts[0].banner != "1" {
+				t.Errorf("Expected play only after the countdown")
+			}
+			for start.Animate(0.02) {
+			}
+		}
+		if !played || len(parent.parts) != 0 {
+			t.Errorf("Expected play after the countdown, skipped %t", skip)
+		}
+	}
+
+	// the skip key ends the countdown and gives the keys back.
+	mp := &bampf{eng: &testLaunchEngine{}, ani: &animator{}}
+	opts := defaultOptions()
+	opts.Countdown = true
+	l := newLaunchScreen(mp, opts).(*launch)
+	l.transition(activate)
+	mp.ani.addAnimation(l.newCountdownAnimation())
+	mp.ani.step(0.02)
+	if _, ok := l.reacts[l.keys["start"]]; ok {
+		t.Errorf("Expected the keys to be disabled during the countdown")
+	}
+	l.handleUpdate(&vu.Input{Down: map[string]int{l.keys["skip"]: 1}, Dt: 0.02})
+	if len(mp.ani.animations) != 0 || l.countdown.count != nil {
+		t.Errorf("Expected the skip key to end the countdown")
+	}
+	if _, ok := l.reacts[l.keys["start"]]; !ok {
+		t.Errorf("Expected the keys to be enabled after the countdown")
+	}
+
+	// the full exit animation is skipped to play.
+	played := false
+	mp.ani.addAnimation(newTransitionAnimation(l.fadeOut(), nil, func() { played = true }))
+	mp.ani.step(0.02)
+	l.tick += launchSkipTicks
+	l.handleUpdate(&vu.Input{Down: map[string]int{l.keys["skip"]: 1}, Dt: 0.02})
+	if !played || l.countdown.count != nil {
+		t.Errorf("Expected the skip key to start play right away")
+	}
+}
+
+func TestClampDeltaTime(t *testing.T) {
+	l := &launch{mp: &bampf{ani: &animator{}}, opts: defaultOptions(), buttonSize: 64}
+	l.bg1, l.bg2 = &testPart{}, &testPart{}
+	l.anim = &startAnimation{hilite: &testPart{}, player: newTrooper(nil, &testPart{}, 0)}
+	l.handleUpdate(&vu.Input{Dt: 10})
+	if spin, max := l.bg1.(*testPart).spin[2], l.opts.Spin*backdropRate*maxDeltaTime; math.Abs(spin-max) > 1e-9 {
+		t.Errorf("Expected the backdrop spin to be capped at %f, got %f", max, spin)
+	}
+	l.buttons = append(l.buttons, &button{area: area{w: 64, h: 64}, model: &testPart{}, icon: &testPart{}})
+	l.mp.ani.addAnimation(l.newButtonAnimation())
+	l.mp.Update(&vu.Input{Focus: true, Dt: 10})
+	if sy, max := l.banim.buttonSy, 0.1+buttonSpeed*maxDeltaTime; math.Abs(sy-max) > 1e-9 {
+		t.Errorf("Expected the button animation to be capped at %f, got %f", max, sy)
+	}
+}
+
+func TestBackdropAngle(t *testing.T) {
+	mp := &bampf{}
+	l := &launch{mp: mp, opts: defaultOptions()}
+	l.addBackdrop(&testPart{}, &testPart{})
+	for cnt := 0; cnt < 10; cnt++ {
+		l.rotateBackdrop(0.02)
+	}
+	bg1, bg2 := l.bg1.(*testPart).spin[2], l.bg2.(*testPart).spin[2]
+	if bg1 == 0 || mp.bg1Angle != bg1 || mp.bg2Angle != bg2 {
+		t.Errorf("Expected angles %f %f, got %f %f", bg1, bg2, mp.bg1Angle, mp.bg2Angle)
+	}
+
+	// a new launch screen continues from the saved angles.
+	l = &launch{mp: mp, opts: defaultOptions()}
+	l.addBackdrop(&testPart{}, &testPart{})
+	if got1, got2 := l.bg1.(*testPart).spin[2], l.bg2.(*testPart).spin[2]; got1 != bg1 || got2 != bg2 {
+		t.Errorf("Expected starting angles %f %f, got %f %f", bg1, bg2, got1, got2)
+	}
+}
+
+func TestButtonEase(t *testing.T) {
+	positions := map[string]float64{}
+	eases := map[string]func(float64) float64{"linear": nil, "inOut": easeInOut}
+	for name, ease := range eases {
+		l := testLaunch()
+		buttons := l.newButtonAnimationAt(buttonSpeed, nil)
+		l.banim.setEase(ease)
+		buttons.Animate(0)
+		for l.banim.buttonA < 0.25 {
+			buttons.Animate(0.25 / buttonSpeed)
+		}
+		positions[name] = l.buttons[4].cx - l.cx
+	}
+	spacing := 1.15 * 64.0
+	if linear := 2 * spacing * 0.25; math.Abs(positions["linear"]-linear) > 1e-9 {
+		t.Errorf("Expected linear position %f, got %f", linear, positions["linear"])
+	}
+	if eased := 2 * spacing * easeInOut(0.25); math.Abs(positions["inOut"]-eased) > 1e-9 || eased >= positions["linear"] {
+		t.Errorf("Expected eased position %f, got %f", eased, positions["inOut"])
+	}
+	for _, progress := range []float64{0, 0.5, 1} {
+		if easeInOut(progress) != progress {
+			t.Errorf("Expected easeInOut to keep %f", progress)
+		}
+	}
+}
+
+func TestStartAnimationLevel(t *testing.T) {
+	mp := &bampf{launchLevel: 3}
+	sa := newStartAnimation(mp, &testPart{}, 800, 600)
+	if level := sa.player.level(); level != 3 {
+		t.Errorf("Expected a level 3 preview, got %d", level)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	options := &testScreen{}
+	mp := &bampf{screens: map[string]screen{"options": options}, active: &testScreen{}}
+	l := &launch{mp: mp, opts: defaultOptions(), keys: launchKeys(), reacts: map[string]vu.Reaction{}}
+	l.enableKeys()
+	if l.rebind("Esc", "Ret") || l.rebind("Tab", "Esc") {
+		t.Errorf("Expected rebinding to used or unbound keys to fail")
+	}
+	if !l.rebind("Esc", "Tab") {
+		t.Fatalf("Expected Esc to be rebound")
+	}
+	names := strings.Join(l.reactionNames(), " ")
+	if !strings.Contains(names, "Tab") || strings.Contains(names, "Esc") {
+		t.Errorf("Expected Tab instead of Esc, got %s", names)
+	}
+	l.disableKeys()
+	l.enableKeys()
+	l.reacts["Tab"].Do()
+	if mp.active != options || l.opts.Keys["options"] != "Tab" {
+		t.Errorf("Expected Tab to toggle the options")
+	}
+
+	// level keys stay reserved while the keys are disabled.
+	l.state = l.active
+	l.transition(pause)
+	if l.rebind("Tab", "2") {
+		t.Errorf("Expected the level keys to be reserved while paused")
+	}
+	l.transition(activate)
+	_, tab := l.reacts["Tab"]
+	if level, ok := l.reacts["2"]; !ok || !tab || level.Name() != "setLevel" || l.keys["options"] != "Tab" {
+		t.Errorf("Expected the options on Tab and the level on 2, got %v", l.reactionNames())
+	}
+}
+
+// testScreen is a minimal stand in for a screen.
+type testScreen struct {
+	screen
+	events []int
+}
+
+func (s *testScreen) transition(event int) { s.events = append(s.events, event) }
+
+func TestDemoMode(t *testing.T) {
+	sa := &startAnimation{parent: &testPart{}, scale: 200}
+	sa.showLevel(2)
+	sa.setDemoMode(true)
+	lost, gained := false, false
+	last, _, _ := sa.player.health()
+	for cnt := 0; cnt < 40; cnt++ {
+		sa.rotate(0, 0.1)
+		health, _, _ := sa.player.health()
+		lost = lost || health < last
+		gained = gained || health > last
+		last = health
+	}
+	if !lost || !gained {
+		t.Errorf("Expected cells to be lost %t and gained %t", lost, gained)
+	}
+}
+
+func TestResizeToZero(t *testing.T) {
+	scene := &testScene{}
+	l := testLaunch()
+	l.scene = scene
+	l.anim = &startAnimation{hilite: &testPart{}}
+	l.handleResize(0, 0)
+	if l.w != 1 || l.h != 1 || scene.right != 1 || scene.top != 1 {
+		t.Errorf("Expected a 1x1 screen, got %dx%d projection %fx%f", l.w, l.h, scene.right, scene.top)
+	}
+	l.handleResize(800, 600)
+	for cnt, btn := range l.buttons {
+		if btn.cx < 0 || btn.cx > 800 || btn.cy < 0 || btn.cy > 600 {
+			t.Errorf("Button %d at %f %f is off screen", cnt, btn.cx, btn.cy)
+		}
+	}
+}
+
+// testScene is a minimal stand in for a scene.
+type testScene struct {
+	vu.Scene
+	right, top float64 // Last orthographic projection.
+}
+
+func (s *testScene) AddPart() vu.Part        { return &testPart{} }
+func (s *testScene) Set2D()                  {}
+func (s *testScene) SetVisible(visible bool) {}
+func (s *testScene) SetOrthographic(left, right, bottom, top, near, far float64) {
+	s.right, s.top = right, top
+}
+
+func TestLevelBackdrop(t *testing.T) {
+	defer func() { delete(knownBackdrops, "backdrop1"); delete(knownBackdrops, "backdrop2") }()
+	knownBackdrops["backdrop1"], knownBackdrops["backdrop2"] = true, true
+	l := &launch{mp: &bampf{}, opts: defaultOptions()}
+	l.anim = &startAnimation{parent: &testPart{}}
+	l.addBackdrop(&testPart{}, &testPart{})
+	for level, name := range map[int]string{2: "backdrop2", 1: "backdrop1", 0: "backdrop", 3: "backdrop"} {
+		l.startAt(level)
+		if bg1, bg2 := l.bg1.(*testPart).texture, l.bg2.(*testPart).texture; bg1 != name || bg2 != name {
+			t.Errorf("Expected level %d backdrop %s, got %s %s", level, name, bg1, bg2)
+		}
+	}
+}
+
+func TestStartFocus(t *testing.T) {
+	sa := &startAnimation{parent: &testPart{}, scale: 200}
+	sa.showLevel(2)
+	part := sa.player.part.(*testPart)
+	sa.rotate(1, 0.02)
+	sa.onFocus(false)
+	sa.rotate(1.02, 0.02)
+	sa.onFocus(true)
+	sa.rotate(61.02, 60) // a minute without focus.
+	sa.rotate(61.04, 0.02)
+	if expected := 0.04 * 25; math.Abs(part.spin[1]-expected) > 1e-9 {
+		t.Errorf("Expected rotation %f from the focused updates, got %f", expected, part.spin[1])
+	}
+}
+
+func TestFreezeStart(t *testing.T) {
+	sa := &startAnimation{parent: &testPart{}, scale: 200}
+	sa.showLevel(2)
+	sa.player.detachCores(10)
+	part := sa.player.part.(*testPart)
+	sa.freeze()
+	health, _, _ := sa.player.health()
+	for cnt := 0; cnt < 5; cnt++ {
+		sa.rotate(0, 0.1)
+	}
+	if part.spin[1] != 0 {
+		t.Errorf("Expected no rotation while frozen, got %f", part.spin[1])
+	}
+	if now, _, _ := sa.player.health(); now != health {
+		t.Errorf("Expected health %d while frozen, got %d", health, now)
+	}
+	sa.unfreeze()
+	sa.rotate(0, 0.1)
+	if part.spin[1] == 0 {
+		t.Errorf("Expected rotation after unfreeze")
+	}
+	if now, _, _ := sa.player.health(); now <= health {
+		t.Errorf("Expected regeneration after unfreeze, got %d", now)
+	}
+}
+
+func TestRegenBatch(t *testing.T) {
+	sa := &startAnimation{player: newTrooper(nil, &testPart{}, 3), scale: 200}
+	before, _, _ := sa.player.health()
+	sa.rotate(0, 0.25) // level 3 regenerates 32 cells a second.
+	if health, _, _ := sa.player.health(); health != before+8 {
+		t.Errorf("Expected 8 cells attached, got %d", health-before)
+	}
+	before, _, _ = sa.player.health()
+	sa.rotate(0, 10)
+	if health, _, _ := sa.player.health(); health != before+maxRegenCells || sa.regenAccum != 0 {
+		t.Errorf("Expected a capped batch of %d cells, got %d", maxRegenCells, health-before)
+	}
+}
+
+func TestRegenInterval(t *testing.T) {
+	if interval := regenInterval(0); interval != 0.5 {
+		t.Errorf("Expected level 0 to regenerate every 0.5 seconds, got %f", interval)
+	}
+	last := regenInterval(0)
+	for level := 1; level <= gameMaxLevel(); level++ {
+		interval := regenInterval(level)
+		if interval >= last {
+			t.Errorf("Level %d expected an interval below %f, got %f", level, last, interval)
+		}
+		last = interval
+	}
+}
+
+func TestQuitToMenu(t *testing.T) {
+	launch, play := &testScreen{}, &testScreen{}
+	mp := &bampf{screens: map[string]screen{"launch": launch, "game": play}}
+	mp.state = mp.playing
+	mp.active = launch
+	mp.quitToMenu()
+	if len(launch.events) != 0 {
+		t.Errorf("Expected quit to be ignored outside the game, got %v", launch.events)
+	}
+	mp.active = play
+	mp.quitToMenu()
+	if mp.active != launch || len(launch.events) != 1 || launch.events[0] != activate {
+		t.Errorf("Expected the launch screen to be activated, got %v", launch.events)
+	}
+	if len(play.events) != 1 || play.events[0] != deactivate {
+		t.Errorf("Expected the game to be deactivated once, got %v", play.events)
+	}
+
+	// the abandoned level player is disposed.
+	lvl := &level{player: newTrooper(nil, &testPart{}, 1)}
+	player := lvl.player
+	lvl.retirePlayer()
+	if lvl.player != nil || player.part != nil {
+		t.Errorf("Expected the level player to be disposed")
+	}
+
+	// a player retired while shaking and warning stops its animations.
+	ani := &animator{}
+	lvl.player = newTrooper(nil, &testPart{}, 2)
+	lvl.player.ani = ani
+	ani.addAnimation(lvl.player.newShakeAnimation(5))
+	lvl.player.setCritical(true)
+	ani.animate(0.02)
+	lvl.retirePlayer()
+	ani.animate(0.02)
+	if len(ani.animations) != 0 {
+		t.Errorf("Expected no animations after retiring, got %d", len(ani.animations))
+	}
+}
+
+func TestTestMode(t *testing.T) {
+	defer func() { testMode = false }()
+	testMode = true
+	l := testLaunch()
+	ani := &animator{}
+	ani.addAnimation(l.newButtonAnimation())
+	ani.animate(0.01)
+	if l.banim.state != 2 || len(ani.animations) != 0 {
+		t.Errorf("Expected the button animation to be done, got state %d", l.banim.state)
+	}
+	sound := &testSound{}
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	tr.noises["teleport"] = sound
+	tr.playNoise("teleport")
+	if sound.plays != 0 {
+		t.Errorf("Expected no sounds in test mode, got %d", sound.plays)
+	}
+}
+
+func TestLaunchState(t *testing.T) {
+	newLaunch := func() *launch {
+		l := testLaunch()
+		l.mp, l.opts = &bampf{}, defaultOptions()
+		l.anim = &startAnimation{parent: &testPart{}, hilite: &testPart{}}
+		l.newButtonAnimation()
+		return l
+	}
+	old := newLaunch()
+	for old.banim.Animate(0.02) {
+	}
+	old.startAt(3)
+	old.hovered = old.buttons[2]
+	state := old.captureState()
+
+	l := newLaunch()
+	l.restoreState(state)
+	if l.preview != 3 || l.anim.player.level() != 3 || l.hovered != l.buttons[2] {
+		t.Errorf("Expected level 3 with button 2 hovered, got %d", l.preview)
+	}
+	if l.banim.Animate(0.02) {
+		t.Errorf("Expected the button animation not to replay")
+	}
+	for cnt, btn := range l.buttons {
+		sx, sy, _ := btn.icon.Scale()
+		if btn.cx != old.buttons[cnt].cx || btn.cy != old.buttons[cnt].cy || sx != 32 || sy != 32 {
+			t.Errorf("Button %d expected at its final layout, got %f,%f scaled %f", cnt, btn.cx, btn.cy, sx)
+		}
+	}
+}
+
+func TestPendingTransitions(t *testing.T) {
+	l := &launch{mp: &bampf{}, scene: &testScene{}, keys: launchKeys(), reacts: map[string]vu.Reaction{}}
+	l.anim = &startAnimation{}
+	l.state = l.evolving
+	l.transition(pause)
+	if len(l.pending) != 1 {
+		t.Fatalf("Expected the pause to wait, got %d pending", len(l.pending))
+	}
+	l.transition(evolve) // still evolving.
+	if len(l.pending) != 2 {
+		t.Fatalf("Expected both transitions to wait, got %d pending", len(l.pending))
+	}
+	l.transition(deactivate)
+	if len(l.pending) != 0 {
+		t.Errorf("Expected the pause to be dropped once deactive, got %d pending", len(l.pending))
+	}
+	l.transition(activate)
+	if _, ok := l.reacts[l.keys["start"]]; !ok || len(l.pending) != 0 {
+		t.Errorf("Expected the screen to be active rather than paused")
+	}
+}
+
+// testLaunch creates an 800x600 launch screen with a button for each
+// level followed by the options button.
+func testLaunch() *launch {
+	l := &launch{buttonSize: 64}
+	l.w, l.h = 800, 600
+	l.cx, l.cy = l.center()
+	for cnt := 0; cnt <= len(levels()); cnt++ {
+		l.buttons = append(l.buttons, &button{area: area{w: 64, h: 64}, model: &testPart{}, icon: &testPart{}})
+	}
+	return l
+}
+
+// testLaunchEngine creates launch screen scenes for newLaunchScreen.
+type testLaunchEngine struct{ testEngine }
+
+func (eng *testLaunchEngine) AddScene(t int) vu.Scene         { return &testScene{} }
+func (eng *testLaunchEngine) Size() (x, y, width, height int) { return 0, 0, 800, 600 }
+
+func TestLevelButtons(t *testing.T) {
+	mp := &bampf{eng: &testLaunchEngine{}, ani: &animator{}}
+	l := newLaunchScreen(mp, defaultOptions()).(*launch)
+	metas := levels()
+	if len(metas) != gameMaxLevel()+1 || len(l.buttons) != len(metas)+1 {
+		t.Fatalf("Expected %d level buttons and options, got %d buttons", len(metas), len(l.buttons))
+	}
+	for cnt, meta := range metas {
+		icon := l.buttons[cnt].icon.(*testPart)
+		if icon.texture != meta.icon || meta.title == "" || meta.tag == "" {
+			t.Errorf("Level %d expected icon %s, got %s", cnt, meta.icon, icon.texture)
+		}
+		if _, _, cores := coreTotals(cnt); meta.cores != cores {
+			t.Errorf("Level %d expected %d cores, got %d", cnt, cores, meta.cores)
+		}
+	}
+	if icon := l.buttons[len(metas)].icon.(*testPart); icon.texture != "options" {
+		t.Errorf("Expected the options button last, got %s", icon.texture)
+	}
+	if l.onLevel == nil {
+		t.Fatalf("Expected the level damage preview to be wired")
+	}
+	l.onLevel(2, levelDamage(2))
+	if banner, ok := l.buttons[2].banner.(*testPart); !ok || banner.banner != strconv.Itoa(levelDamage(2)) {
+		t.Errorf("Expected level 2 labelled with damage %d", levelDamage(2))
+	}
+}
+
+func TestResizeDuringButtons(t *testing.T) {
+	newLaunch := func() *launch {
+		l := testLaunch()
+		l.scene = &testScene{}
+		l.anim = &startAnimation{hilite: &testPart{}}
+		return l
+	}
+	l := newLaunch()
+	buttons := l.newButtonAnimation()
+	buttons.Animate(0)
+	buttons.Animate(0.02)
+	l.handleResize(1000, 700) // still growing, the buttons haven't spread out.
+	for cnt, btn := range l.buttons[:5] {
+		if btn.cx != l.cx {
+			t.Errorf("Button %d expected to stay at %f, got %f", cnt, l.cx, btn.cx)
+		}
+	}
+	for step := 0; buttons.Animate(0.02); step++ {
+		if step%5 == 0 {
+			l.handleResize(900+step, 650)
+		}
+	}
+	expected := newLaunch()
+	expected.handleResize(l.w, l.h)
+	for cnt, btn := range l.buttons {
+		want := expected.buttons[cnt]
+		if math.Abs(btn.cx-want.cx) > 1e-9 || math.Abs(btn.cy-want.cy) > 1e-9 {
+			t.Errorf("Button %d expected at %f,%f, got %f,%f", cnt, want.cx, want.cy, btn.cx, btn.cy)
+		}
+		if sx, sy, _ := btn.icon.Scale(); sx != 32 || sy != 32 {
+			t.Errorf("Button %d expected full scale, got %f %f", cnt, sx, sy)
+		}
+	}
+}
+
+func TestOptionsButtonAnchor(t *testing.T) {
+	l := testLaunch()
+	l.layout(1)
+	options := l.buttons[len(l.buttons)-1]
+	below := options.cx
+	l.setOptionsButtonAnchor(anchorBottomRight)
+	if math.Abs(options.cx-800) > 64 || math.Abs(options.cy) > 64 {
+		t.Errorf("Expected the options button near 800,0, got %f,%f", options.cx, options.cy)
+	}
+	if options.x+options.w > l.w || options.y < 0 {
+		t.Errorf("Expected the options button on screen, got %d,%d", options.x, options.y)
+	}
+	l.setOptionsButtonAnchor(-1)
+	if l.optionsAnchor != anchorBottomRight {
+		t.Errorf("Expected an invalid anchor to be ignored")
+	}
+	l.setOptionsButtonAnchor(anchorBelow)
+	if options.cx != below {
+		t.Errorf("Expected the options button back at %f, got %f", below, options.cx)
+	}
+}
+
+func TestZLayers(t *testing.T) {
+	l := testLaunch()
+	l.mp, l.scene, l.bg1, l.bg2 = &bampf{launchLevel: 1}, &testScene{}, &testPart{}, &testPart{}
+	l.anim = newStartAnimation(l.mp, &testPart{}, 800, 600)
+	l.handleResize(800, 600)
+	names := []string{}
+	for _, layer := range l.zLayers() {
+		names = append(names, layer.name)
+	}
+	expect := "backdrop1 backdrop2 player hilite"
+	for cnt := range l.buttons {
+		expect += fmt.Sprintf(" button%d", cnt)
+	}
+	if got := strings.Join(names, " "); got != expect {
+		t.Fatalf("Expected layers %s, got %s", expect, got)
+	}
+	z := map[string]float64{}
+	for _, layer := range l.zLayers() {
+		z[layer.name] = layer.z
+	}
+	for cnt := range l.buttons {
+		button := fmt.Sprintf("button%d", cnt)
+		if z["backdrop1"] <= z[button] || z["backdrop2"] <= z[button] {
+			t.Errorf("Expected the backdrops behind %s, got %v", button, z)
+		}
+	}
+	if z["hilite"] != z["player"] {
+		t.Errorf("Expected the hilite to share the player depth, got %v", z)
+	}
+	if parts := l.anim.parent.(*testPart).parts; parts[0] != l.anim.hilite {
+		t.Errorf("Expected the hilite to be drawn before the player")
+	}
+}
@@ -124,7 +124,9 @@ func (lvl *level) update() {
 	lvl.collideSentinels()
 	lvl.createCore()
 	lvl.hd.update(lvl.scene, lvl.sentries)
-	lvl.player.updateEnergy()
+	lvl.player.advance()
+	lvl.player.updateAudio(lvl.body.Location())
+	lvl.player.markVisited(lvl.cc.playerToGrid(lvl.body.Location()))
 	lvl.hd.cloakingActive(lvl.player.cloaked)
 }
 
@@ -271,9 +273,12 @@ func (lvl *level) buildFloorPlan(scene vu.Scene, hd *hud, plan grid.Grid) {
 // to show player status and as such this trooper is part of the hud scene.
 func (lvl *level) makePlayer(eng vu.Engine, scene vu.Scene, levelNum int) *trooper {
 	player := newTrooper(eng, scene.AddPart(), levelNum)
-	player.part.Spin(15, 0, 0)
-	player.part.Spin(0, 15, 0)
+	player.setOrientation(15, 15, 0)
 	player.setScale(100)
+	player.prewarm()
+	player.ani = lvl.mp.ani
+	player.animateCells = true
+	player.scatterCells = true
 	player.noises["teleport"] = eng.UseSound("bampf")
 	player.noises["fetch"] = eng.UseSound("fetch")
 	player.noises["cloak"] = eng.UseSound("cloak")
@@ -282,6 +287,15 @@ func (lvl *level) makePlayer(eng vu.Engine, scene vu.Scene, levelNum int) *troop
 	return player
 }
 
+// retirePlayer disposes the player when a game is abandoned so that the
+// next game on this level starts with a new player, see game.setLevel.
+func (lvl *level) retirePlayer() {
+	if lvl.player != nil {
+		lvl.player.dispose()
+		lvl.player = nil
+	}
+}
+
 // makeSentries creates some AI sentinels.
 func (lvl *level) makeSentries(eng vu.Engine, scene vu.Scene, levelNum int) {
 	sentinels := []*sentinel{}
@@ -311,10 +325,7 @@ func (lvl *level) collideSentinels() {
 	for _, sentry := range lvl.sentries {
 		sgx, sgy := lvl.cc.playerToGrid(sentry.location())
 		if pgx == sgx && pgy == sgy {
-			lvl.eng.PlaceSoundListener(lvl.player.loc())
-			noise := lvl.player.noises["collide"]
-			noise.SetLocation(lvl.player.loc())
-			noise.Play()
+			lvl.player.playNoise("collide")
 
 			// teleport the sentinel to the outside of the maze so that the
 			// collision doesn't happen again. Use the corner opposite the
@@ -322,7 +333,7 @@ func (lvl *level) collideSentinels() {
 			sentry.setGridLocation(lvl.plan.Size())
 
 			// remove health from the player and show the energy loss animation.
-			lvl.player.detachCores(gameCellLoss[lvl.num])
+			lvl.player.detachCores(levelDamage(lvl.num))
 			lvl.mp.ani.addAnimation(lvl.newEnergyLossAnimation())
 		}
 	}
@@ -337,15 +348,10 @@ func (lvl *level) fetchCores() {
 	// attach the core to the player.
 	health, _, max := lvl.player.health()
 	if coreIndex >= 0 && health != max && !lvl.player.cloaked {
-		lvl.eng.PlaceSoundListener(lvl.player.loc())
-		fetchNoise := lvl.player.noises["fetch"]
-		fetchNoise.SetLocation(lvl.player.loc())
-		fetchNoise.Play()
+		lvl.player.playNoise("fetch")
 		gamex, gamez := lvl.cc.remCore(lvl.scene, coreIndex)
 		lvl.hd.remCore(gamex, gamez)
-		for cnt := 0; cnt < gameCellGain[lvl.num]; cnt++ {
-			lvl.player.attach()
-		}
+		lvl.player.attachCores(gameCellGain[lvl.num])
 
 		// add more cloaking energy each time a core is picked up.
 		lvl.player.addCloakEnergy()
@@ -380,6 +386,7 @@ func (lvl *level) teleport() {
 		lvl.scene.SetViewRotation(0, 0, 0, 1)
 		lvl.scene.SetViewTilt(0)
 		lvl.body.SetBody(vu.Sphere(0.25), 1, 0)
+		lvl.player.placeListener(lvl.body.Location())
 		lvl.mp.ani.addAnimation(lvl.newTeleportAnimation())
 	}
 }
@@ -389,7 +396,13 @@ func (lvl *level) teleport() {
 func (lvl *level) cloak() { lvl.player.cloak(!lvl.player.cloaked) }
 
 // increaseCloak is a debug only method that greatly expands the cloaking time.
-func (lvl *level) increaseCloak() { lvl.player.cloakEnergy += lvl.player.cemax * 10 }
+// The cloak maximum is raised as well so the extra energy isn't clamped away.
+func (lvl *level) increaseCloak() {
+	tr := lvl.player
+	extra := tr.cemax * 10
+	tr.cemax += extra
+	tr.setEnergy(tr.teleportEnergy, tr.cloakEnergy+extra)
+}
 
 // level
 // ===========================================================================
@@ -87,6 +87,34 @@ func (s *Saver) restore() *Saver {
 	return s
 }
 
+// optionsFile is where the launch screen options are saved. It is kept
+// beside the save file.
+func (s *Saver) optionsFile() string { return path.Join(path.Dir(s.File), "bampf.options") }
+
+// persistOptions saves the launch screen options.
+func (s *Saver) persistOptions(lo *launchOptions) {
+	file, err := os.Create(s.optionsFile())
+	if err != nil {
+		log.Printf("Failed to save options: %s", err)
+		return
+	}
+	defer file.Close()
+	if err := lo.saveOptions(file); err != nil {
+		log.Printf("Failed to encode options: %s", err)
+	}
+}
+
+// restoreOptions reads the launch screen options. Defaults are returned
+// when there are no saved options.
+func (s *Saver) restoreOptions() *launchOptions {
+	file, err := os.Open(s.optionsFile())
+	if err != nil {
+		return defaultOptions()
+	}
+	defer file.Close()
+	return loadOptions(file)
+}
+
 // reset clears the saved file.
 func (s *Saver) reset() {
 	os.Remove(s.File)
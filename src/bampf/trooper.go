@@ -4,8 +4,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 	"sort"
+	"sync"
 	"vu"
 	"vu/audio"
 	"vu/math/lin"
@@ -19,160 +28,889 @@ import (
 //
 // trooper works with single cubes (cells) of size 2 centered at the origin.
 type trooper struct {
-	part                  vu.Part   // Graphics container.
-	lvl                   int       // Current game level of trooper.
-	eng                   vu.Engine // Games engine.
-	neo                   vu.Part   // Un-injured trooper
-	bits                  []box     // Injured troopers have panels and edge cubes.
-	ipos                  []int     // Remember the initial positions for resets.
-	center                vu.Part   // Center always represented as one piece
-	mid                   int       // Level entry number of cells.
-	cloaked               bool      // Is cloaking turned on.
-	cloakEnergy, cemax    int       // Energy available for cloaking.
-	teleportEnergy, temax int       // Energy available for teleporting.
-
-	// monitors and sounds.
+	part                  vu.Part    // Graphics container.
+	parent                partParent // Optional owner of part, used by dispose.
+	lvl                   int        // Current game level of trooper.
+	maxLvl                int        // Highest level returned by nextLevel.
+	shape                 levelShape // Trooper geometry.
+	eng                   vu.Engine  // Games engine.
+	neo                   vu.Part    // Un-injured trooper
+	bits                  []box      // Injured troopers have panels and edge cubes.
+	ipos                  []int      // Remember the initial positions for resets.
+	center                vu.Part    // Center always represented as one piece
+	mid                   int        // Level entry number of cells.
+	cloaked               bool       // Is cloaking turned on.
+	cloakLevel            int        // One of cloakOff, cloakPartial, cloakFull.
+	cloakEnergy, cemax    int        // Energy available for cloaking.
+	teleportEnergy, temax int        // Energy available for teleporting.
+	ready                 bool       // Teleport ready has been announced.
+	complete              bool       // Has the win condition been met.
+	dead                  bool       // Has the trooper lost all its cells.
+	animateCells          bool       // Grow newly attached cells.
+	scatterCells          bool       // Scatter cells lost to collisions.
+	scattering            bool       // True while collision cells are detached.
+	attaching             bool       // True while a single cell is attached.
+	ani                   *animator  // Runs the cell animations.
+	invulnerable          bool       // Practice mode: cells are never lost.
+	teleCooldownTicks     int        // Minimum ticks between teleports. 0 for none.
+	lastTeleportTick      int        // Tick of the last teleport.
+	teleported            bool       // True once a teleport has happened.
+	energySteps           float64    // Fractional energy updates, see timeScale.
+	teleportRate          float64    // Teleport energy gained each update.
+	teleportGain          float64    // Fractional teleport energy gained so far.
+	energyPaused          bool       // Energy is frozen, see setEnergyPaused.
+	cloakInverted         bool       // Cloaking charges energy, see setCloakInverted.
+	regenDelayTicks       int        // Updates without regeneration after damage.
+	damageCooldown        int        // Updates left before regeneration resumes.
+	mergeDisabled         bool       // Full troopers, panels, and cubes keep their cells.
+	panelsQuiet           bool       // Panel state changes are held, see quietPanels.
+	shellOnly             bool       // Only draw the outside, see setShellOnly.
+	opacity               float64    // Last alpha given to setAlpha.
+	wireframe             bool       // Draw cells as wireframes.
+	mirrored              bool       // Negative x scale, see setMirror.
+	faceColors            [6]string  // Panel slab materials, see setFaceColors.
+	healthTint            bool       // Cell color follows health, see setHealthTint.
+	mergeScale            float64    // Merged cube and slab size, see setMergeScale.
+	coreCap               int        // Most cells allowed, 0 for no cap.
+	centerHidden          bool       // Center is not drawn, see showCenter.
+	exploded              float64    // Spacing between the pieces, see setExploded.
+	ox, oy, oz            float64    // Orientation set by setOrientation.
+	ax, ay, az            float64    // Last sound listener location.
+	heard                 bool       // The listener has been placed by updateAudio.
+
+	// profile optionally sets the per level maximums, see newTrooperProfile.
+	profile *difficultyProfile
+
+	// visited holds the grid locations occupied this level.
+	visited map[gridSpot]bool
+
+	// shield cells are extra cells beyond full health, see addShield.
+	shieldMax int       // Extra cells allowed by the shield.
+	shields   []vu.Part // One rendered part for each shield cell.
+
+	// critical is the running low health warning, see setCritical.
+	critical *criticalAnimation
+
+	// shaking is the running damage shake, see newShakeAnimation.
+	shaking *shakeAnimation
+
+	// winWhen decides if the level has been won. Defaults to full health.
+	winWhen func(health, mid, max int) bool
+
+	// cellPoints gives the score for each cell gained at the given level.
+	// Defaults to level+1 points per cell.
+	cellPoints func(level int) int
+
+	// detachOrder optionally returns the bits in the order that cells are
+	// removed. Nil keeps the bits order, which is panels then edges.
+	detachOrder func(bits []box) []box
+
+	// optional recording of health changes.
+	rec  io.Writer // Recorded events are written here. Nil for no recording.
+	tel  io.Writer // Telemetry rows are written here. Nil for no telemetry.
+	tick int       // Caller supplied time stamp for events and cooldowns.
+
+	// monitors and sounds. The monitor maps are guarded by mlock so that
+	// monitors can be changed while notifications are being sent. Monitors
+	// are notified in the order that they were added, see withoutId.
+	mlock  sync.RWMutex                // Guards the monitor maps.
 	hms    map[string]healthMonitor    // Health event monitors.
 	ems    map[string]energyMonitor    // Energy event monitors.
+	lms    map[string]levelMonitor     // Level completion monitors.
+	dms    map[string]deathMonitor     // Death monitors.
+	hids   []string                    // Health monitor ids in the order added.
+	eids   []string                    // Energy monitor ids in the order added.
+	lids   []string                    // Level monitor ids in the order added.
+	dids   []string                    // Death monitor ids in the order added.
 	noises map[string]audio.SoundMaker // Various sounds.
+	quiet  map[string]bool             // Missing sounds that have been logged.
+
+	// playing holds the recently played sounds and the number of updates
+	// each is expected to keep playing, see noiseTicks.
+	playing map[string]int
 }
 
-// newTrooper creates a trooper for the given level.
+// newTrooper creates a cubic trooper for the given level. A nil engine
+// gives a silent trooper, but a nil part or negative level panic, see
+// newTrooperSafe.
 //    level 0: 1x1x1 :  0 edge cubes 0 panels, (only 1 cube)
 //    level 1: 2x2x2 :  8 edge cubes + 6 panels of 0x0 cubes + 0x0x0 center.
 //    level 2: 3x3x3 : 20 edge cubes + 6 panels of 1x1 cubes + 1x1x1 center.
 //    level 3: 4x4x4 : 32 edge cubes + 6 panels of 2x2 cubes + 2x2x2 center.
 //    ...
 func newTrooper(eng vu.Engine, part vu.Part, level int) *trooper {
+	tr, err := checkedTrooper(eng, part, level)
+	if err != nil {
+		panic(err)
+	}
+	return tr
+}
+
+// newTrooperSafe is newTrooper for tools that embed a trooper. The inputs
+// are checked and an error is returned for a nil engine, a nil part, or
+// a negative level instead of failing later on.
+func newTrooperSafe(eng vu.Engine, part vu.Part, level int) (*trooper, error) {
+	if eng == nil {
+		return nil, errors.New("trooper: nil engine")
+	}
+	return checkedTrooper(eng, part, level)
+}
+
+// checkedTrooper creates a cubic trooper once the part and level are known
+// to be usable.
+func checkedTrooper(eng vu.Engine, part vu.Part, level int) (*trooper, error) {
+	switch {
+	case part == nil:
+		return nil, errors.New("trooper: nil part")
+	case level < 0:
+		return nil, fmt.Errorf("trooper: invalid level %d", level)
+	}
+	return newTrooperShape(eng, part, cubicShape(level)), nil
+}
+
+// maxEnergy is the default maximum teleport and cloak energy.
+const maxEnergy = 1000
+
+// newTrooperAt creates a trooper for the given level that starts with the
+// given number of cells instead of the level minimum. The start health is
+// kept between 0 and full health.
+func newTrooperAt(eng vu.Engine, part vu.Part, level, startHealth int) *trooper {
+	tr := newTrooper(eng, part, level)
+	tr.setHealth(startHealth)
+	return tr
+}
+
+// difficultyProfile bundles the per level balance settings so they can be
+// tuned together. Each list is indexed by level, where levels past the end
+// of a list use its last value and empty lists keep the defaults.
+type difficultyProfile struct {
+	cores    []int     // Most cells a trooper can hold. 0 for the full cube.
+	teleport []int     // Maximum teleport energy.
+	cloak    []int     // Maximum cloak energy.
+	regen    []float64 // Teleport energy gained each update.
+}
+
+// defaultProfile matches the troopers created by newTrooper.
+var defaultProfile = difficultyProfile{
+	cores:    []int{0},
+	teleport: []int{maxEnergy},
+	cloak:    []int{maxEnergy},
+	regen:    []float64{1},
+}
+
+// count returns the level value from the given list, or def if the
+// list is empty.
+func (dp *difficultyProfile) count(values []int, level, def int) int {
+	switch {
+	case len(values) == 0:
+		return def
+	case level >= len(values):
+		return values[len(values)-1]
+	case level < 0:
+		return values[0]
+	}
+	return values[level]
+}
+
+// newTrooperProfile creates a trooper for the given level using the
+// maximums from the given profile. The profile is kept and applied again
+// when the trooper changes level.
+func newTrooperProfile(eng vu.Engine, part vu.Part, level int, profile difficultyProfile) *trooper {
+	tr := newTrooper(eng, part, level)
+	tr.profile = &profile
+	tr.applyProfile()
+	return tr
+}
+
+// applyProfile sets the trooper maximums for its level from its
+// difficulty profile, if any.
+func (tr *trooper) applyProfile() {
+	dp := tr.profile
+	if dp == nil {
+		return
+	}
+	tr.coreCap = dp.count(dp.cores, tr.lvl, 0)
+	tr.temax = dp.count(dp.teleport, tr.lvl, maxEnergy)
+	tr.cemax = dp.count(dp.cloak, tr.lvl, maxEnergy)
+	switch {
+	case len(dp.regen) == 0:
+	case tr.lvl >= len(dp.regen):
+		tr.setTeleportRate(dp.regen[len(dp.regen)-1])
+	default:
+		tr.setTeleportRate(dp.regen[tr.lvl])
+	}
+	tr.clampEnergy()
+}
+
+// newTrooperShape creates a trooper with the given geometry. This allows
+// troopers that are not cubes.
+func newTrooperShape(eng vu.Engine, part vu.Part, shape levelShape) *trooper {
 	tr := &trooper{}
-	tr.lvl = level
+	tr.maxLvl = gameMaxLevel()
 	tr.eng = eng
 	tr.part = part
-	tr.bits = []box{}
-	tr.ipos = []int{}
-	tr.mid = tr.lvl*tr.lvl*tr.lvl*8 - (tr.lvl-1)*(tr.lvl-1)*(tr.lvl-1)*8
 	tr.noises = make(map[string]audio.SoundMaker)
+	tr.winWhen = func(health, mid, max int) bool { return health == max }
+	tr.cellPoints = func(level int) int { return level + 1 }
 
 	// set max energies.
-	tr.cemax, tr.temax = 1000, 1000
+	tr.cemax, tr.temax = maxEnergy, maxEnergy
+	tr.teleportRate = 1
+	tr.opacity = 1
+	tr.faceColors = [6]string{"tblue", "tblue", "tblue", "tblue", "tblue", "tblue"}
+	tr.mergeScale = 1
+	tr.build(shape)
+	return tr
+}
+
+// build creates the troopers cubes and panels for the given geometry
+// and sets the level minimum health. Any previous bits are replaced.
+func (tr *trooper) build(shape levelShape) {
+	eng := tr.eng
+	tr.lvl = shape.lvl
+	tr.shape = shape
+	tr.bits = make([]box, 0, 6+shape.edgeCubes()) // panels and edge cubes.
 
 	// special case for a level 0 (start screen) trooper.
-	if tr.lvl == 0 {
+	if shape.single() {
 		cube := newCube(eng, tr.part, 0, 0, 0, 1)
 		cube.edgeSort(1)
+		cube.grow = tr.growCell
+		cube.shed = tr.scatterCell
 		tr.bits = append(tr.bits, cube)
-		return tr
+		tr.ipos = []int{cube.ccnt}
+		tr.mid = cube.ccnt
+		tr.scaleMerged()
+		return
 	}
 
 	// create the panels. These are used in each level after level 1.
-	cubeSize := 1.0 / float64(tr.lvl+1)
-	centerOffset := cubeSize * 0.5
-	panelCenter := float64(tr.lvl) * centerOffset
-	tr.bits = append(tr.bits, newPanel(eng, tr.part, panelCenter, 0.0, 0.0, tr.lvl))
-	tr.bits = append(tr.bits, newPanel(eng, tr.part, -panelCenter, 0.0, 0.0, tr.lvl))
-	tr.bits = append(tr.bits, newPanel(eng, tr.part, 0.0, panelCenter, 0.0, tr.lvl))
-	tr.bits = append(tr.bits, newPanel(eng, tr.part, 0.0, -panelCenter, 0.0, tr.lvl))
-	tr.bits = append(tr.bits, newPanel(eng, tr.part, 0.0, 0.0, panelCenter, tr.lvl))
-	tr.bits = append(tr.bits, newPanel(eng, tr.part, 0.0, 0.0, -panelCenter, tr.lvl))
+	cubeSize := shape.cubeSize()
+	for face, c := range shape.panelCenters() {
+		du, dv := shape.panelSize(face)
+		p := newPanel(eng, tr.part, c[0], c[1], c[2], du, dv)
+		p.color = tr.faceColors[face]
+		p.face = face
+		p.slabbed = tr.panelChanged
+		tr.bits = append(tr.bits, p)
+	}
 
 	// troopers are made out of cubes and panels.
-	mx := float64(-tr.lvl)
-	for cx := 0; cx <= tr.lvl; cx++ {
-		my := float64(-tr.lvl)
-		for cy := 0; cy <= tr.lvl; cy++ {
-			mz := float64(-tr.lvl)
-			for cz := 0; cz <= tr.lvl; cz++ {
-
-				// create the outer edges.
-				newCells := 0
-				if (cx == 0 || cx == tr.lvl) && (cy == 0 || cy == tr.lvl) && (cz == 0 || cz == tr.lvl) {
-
-					// corner cube
-					newCells = 1
-				} else if (cx == 0 || cx == tr.lvl) && (cy == 0 || cy == tr.lvl) ||
-					(cx == 0 || cx == tr.lvl) && (cz == 0 || cz == tr.lvl) ||
-					(cy == 0 || cy == tr.lvl) && (cz == 0 || cz == tr.lvl) {
-
-					// edge cube
-					newCells = 2
-				} else if cx == 0 || cx == tr.lvl || cy == 0 || cy == tr.lvl || cz == 0 || cz == tr.lvl {
-
-					// side cubes are added to a panel.
-					x, y, z := mx*centerOffset, my*centerOffset, mz*centerOffset
-					if cx == tr.lvl && x > y && x > z {
-						tr.bits[0].(*panel).addCube(x, y, z, float64(cubeSize))
-					} else if cx == 0 && x < y && x < z {
-						tr.bits[1].(*panel).addCube(x, y, z, float64(cubeSize))
-					} else if cy == tr.lvl && y > x && y > z {
-						tr.bits[2].(*panel).addCube(x, y, z, float64(cubeSize))
-					} else if cy == 0 && y < x && y < z {
-						tr.bits[3].(*panel).addCube(x, y, z, float64(cubeSize))
-					} else if cz == tr.lvl && z > x && z > y {
-						tr.bits[4].(*panel).addCube(x, y, z, float64(cubeSize))
-					} else if cz == 0 && z < x && z < y {
-						tr.bits[5].(*panel).addCube(x, y, z, float64(cubeSize))
-					}
-				}
-				if newCells > 0 {
-					x, y, z := mx*centerOffset, my*centerOffset, mz*centerOffset
-					cube := newCube(eng, tr.part, x, y, z, float64(cubeSize))
-					cube.edgeSort(newCells)
-					tr.bits = append(tr.bits, cube)
-				}
-				mz += 2
-			}
-			my += 2
+	shape.eachCube(func(x, y, z float64, face, newCells int) {
+		if face >= 0 {
+			tr.bits[face].(*panel).addCube(x, y, z, cubeSize)
+			return
 		}
-		mx += 2
-	}
+		cube := newCube(eng, tr.part, x, y, z, cubeSize)
+		cube.edgeSort(newCells)
+		tr.bits = append(tr.bits, cube)
+	})
 	tr.addCenter()
+	for _, c := range tr.cubes() {
+		c.grow = tr.growCell
+		c.shed = tr.scatterCell
+	}
+	tr.scaleMerged()
+	tr.explode()
+	tr.applyProfile()
 
 	// its easier to remember the initial positions than recalculate them.
 	tr.ipos = make([]int, len(tr.bits))
+	tr.mid = 0
 	for cnt, b := range tr.bits {
 		tr.ipos[cnt] = b.box().ccnt
+		tr.mid += b.box().ccnt
+	}
+}
+
+// promote advances the trooper to the next level in place. The cells
+// gained beyond the old level minimum, including any shield cells, are
+// carried over on top of the new level minimum, up to the new maximum.
+// Energy is kept. Returns false if the trooper is at the maximum level.
+func (tr *trooper) promote() bool {
+	next := tr.nextLevel()
+	if next == tr.lvl {
+		return false
+	}
+	health, mid, _ := tr.health()
+	carry := health - mid + len(tr.shields)
+	if carry < 0 {
+		carry = 0
+	}
+	defer tr.quietPanels()()
+	tr.complete = false
+	tr.dead = false
+	tr.trashOrdered()
+	tr.removeShield(len(tr.shields))
+	for _, b := range tr.bits {
+		switch bit := b.(type) {
+		case *cube:
+			tr.part.RemPart(bit.part)
+		case *panel:
+			tr.part.RemPart(bit.part)
+		}
+	}
+	tr.build(cubicShape(next))
+	if tr.wireframe {
+		tr.setWireframe(true)
+	}
+	if tr.shellOnly {
+		tr.setShellOnly(true)
+	}
+	if tr.opacity < 1 {
+		tr.setAlpha(tr.opacity)
+	}
+	if tr.mergeDisabled {
+		tr.setMergeDisabled(true)
+	}
+	for ; carry > 0 && tr.attachCell(); carry-- {
+	}
+	tr.record("promote")
+	tr.healthChanged(tr.health())
+	return true
+}
+
+// isComplete returns true if the trooper meets the win condition for
+// the level.
+func (tr *trooper) isComplete() bool { return tr.wins(tr.health()) }
+
+// wins checks the given health against the win condition.
+func (tr *trooper) wins(health, mid, max int) bool {
+	if tr.winWhen == nil {
+		return health == max
+	}
+	return tr.winWhen(health, mid, max)
+}
+
+// cubes returns all the troopers cubes, both the edge cubes and the
+// cubes belonging to panels.
+func (tr *trooper) cubes() []*cube {
+	cubes := []*cube{}
+	for _, b := range tr.bits {
+		switch bit := b.(type) {
+		case *cube:
+			cubes = append(cubes, bit)
+		case *panel:
+			cubes = append(cubes, bit.cubes...)
+		}
+	}
+	return cubes
+}
+
+// setWireframe switches between drawing solid or wireframe cells. The
+// change applies to the current cells and to any cells added later.
+func (tr *trooper) setWireframe(on bool) {
+	tr.wireframe = on
+	shader := tr.cellShader()
+	for _, b := range tr.bits {
+		switch bit := b.(type) {
+		case *cube:
+			bit.setShader(shader)
+		case *panel:
+			bit.setShader(shader)
+		}
+	}
+	if tr.neo != nil {
+		tr.neo.SetFacade("cube", shader)
+	}
+	if tr.center != nil {
+		tr.center.SetFacade("cube", shader)
+	}
+	for _, cell := range tr.shields {
+		cell.SetFacade("cube", shader)
+	}
+}
+
+// knownMeshes and knownMaterials are the model and material files in the
+// models directory. They are used to catch missing assets, see safeFacade.
+var knownMeshes = map[string]bool{
+	"0wall": true, "1wall": true, "2wall": true, "3wall": true, "4wall": true, "5wall": true,
+	"billboard": true, "core": true, "cube": true, "icon": true, "icon_xz": true,
+	"square": true, "square_xz": true, "tile": true, "tri_xz": true,
+}
+var knownMaterials = map[string]bool{
+	"alpha": true, "blue": true, "fade": true, "gray": true, "green": true, "half": true,
+	"red": true, "solid": true, "tblack": true, "tblue": true, "tgold": true, "tgreen": true,
+	"tred": true, "white": true,
+}
+
+// fallbackMesh and fallbackMaterial replace unknown mesh and material names.
+const (
+	fallbackMesh     = "cube"
+	fallbackMaterial = "tgreen"
+)
+
+// missingAssets remembers the unknown names that have been logged.
+var missingAssets = map[string]bool{}
+
+// safeFacade sets the parts mesh, shader, and material. Unknown meshes
+// and materials, which would otherwise draw nothing, are logged the first
+// time they are seen and replaced with a fallback that is known to work.
+func safeFacade(part vu.Part, mesh, shader, material string) vu.Part {
+	if !knownMeshes[mesh] {
+		if !missingAssets[mesh] {
+			missingAssets[mesh] = true
+			log.Printf("trooper.safeFacade: unknown mesh %s", mesh)
+		}
+		mesh = fallbackMesh
+	}
+	if !knownMaterials[material] {
+		if !missingAssets[material] {
+			missingAssets[material] = true
+			log.Printf("trooper.safeFacade: unknown material %s", material)
+		}
+		material = fallbackMaterial
+	}
+	return part.SetFacade(mesh, shader).SetMaterial(material)
+}
+
+// fadePart gives a newly created part the given alpha, see trooper.setAlpha.
+// Parts start out opaque so nothing is done for an alpha of 1.
+func fadePart(part vu.Part, alpha float64) {
+	if alpha < 1 {
+		part.SetAlpha(alpha)
+	}
+}
+
+// cellShader returns the shader for the current drawing mode.
+func (tr *trooper) cellShader() string {
+	if tr.wireframe {
+		return "wire"
+	}
+	return "flata"
+}
+
+// growCell sizes a newly attached cell. The cell grows into place
+// when cell animations are enabled. Only cells added by attach are
+// animated, not the cells recreated by resets.
+func (tr *trooper) growCell(cell vu.Part, scale float64) {
+	if tr.animateCells && tr.attaching && tr.ani != nil {
+		tr.ani.addAnimation(&cellSpawnAnimation{cell: cell, scale: scale, ticks: 10})
+		return
+	}
+	cell.SetScale(scale, scale, scale)
+}
+
+// scatterCell sends a copy of a lost cell flying away from the trooper.
+// Only cells lost by detachCores are scattered. The actual cell has already
+// been removed, so the copy is purely visual.
+func (tr *trooper) scatterCell(center *lin.V3, scale float64) {
+	if !tr.scatterCells || !tr.scattering || tr.ani == nil {
+		return
+	}
+	cell := tr.part.AddPart()
+	cell.SetCullable(false)
+	safeFacade(cell, "cube", tr.cellShader(), "tgreen")
+	cell.SetLocation(center.X, center.Y, center.Z)
+	cell.SetScale(scale, scale, scale)
+	tr.ani.addAnimation(&scatterAnimation{parent: tr.part, cell: cell, dir: *center, ticks: 15})
+}
+
+// nextAttachPoint returns the trooper local location of the cell that will
+// be added by the next attach. False is returned if the trooper is full.
+func (tr *trooper) nextAttachPoint() (*lin.V3, bool) {
+	if tr.neo != nil {
+		return nil, false
+	}
+	for _, b := range tr.bits {
+		if center, ok := nextBitCenter(b); ok {
+			return center, true
+		}
+	}
+	return nil, false
+}
+
+// nextBitCenter returns the trooper local center of the next cell that
+// would be attached to the given bit, or false if the bit is full.
+func nextBitCenter(b box) (*lin.V3, bool) {
+	switch bit := b.(type) {
+	case *cube:
+		return bit.nextCellCenter()
+	case *panel:
+		if bit.ccnt < bit.cmax {
+			if c := bit.nextCube(); c != nil {
+				return c.nextCellCenter()
+			}
+		}
+	}
+	return nil, false
+}
+
+// previewReattach returns the trooper local locations of the next count
+// cells that attach would add, in the order they would be added. This
+// allows ghost cells to be shown. Fewer locations are returned if the
+// trooper fills up first. The trooper is not changed.
+func (tr *trooper) previewReattach(count int) []*lin.V3 {
+	points := []*lin.V3{}
+	if tr.neo != nil {
+		return points
+	}
+	added := map[*cube]int{}
+	cells := func(c *cube) int { return c.ccnt + added[c] }
+	preview := func(c *cube) {
+		center := c.centers[cells(c)]
+		points = append(points, &lin.V3{center.X, center.Y, center.Z})
+		added[c]++
+	}
+	for _, b := range tr.bits {
+		switch bit := b.(type) {
+		case *cube:
+			for len(points) < count && cells(bit) < bit.cmax {
+				preview(bit)
+			}
+		case *panel:
+			for pcnt := bit.ccnt; len(points) < count && pcnt < bit.cmax; pcnt++ {
+				if c := bit.nextCubeAfter(cells); c != nil {
+					preview(c)
+				}
+			}
+		}
+	}
+	return points
+}
+
+// fullHealth returns true if the player is at full health. A trooper that
+// has reached its core cap is at full health even though it isn't merged.
+func (tr *trooper) fullHealth() bool {
+	health, _, max := tr.health()
+	return health == max
+}
+
+// setScale changes the troopers size. A mirrored trooper keeps its
+// negative x scale, see setMirror.
+func (tr *trooper) setScale(scale float64) {
+	scale = math.Abs(scale)
+	if tr.mirrored {
+		tr.part.SetScale(-scale, scale, scale)
+		return
+	}
+	tr.part.SetScale(scale, scale, scale)
+}
+
+// setFaceColors gives each of the six panel slabs its own material, in
+// panel face order, see panel. This helps players tell the faces apart.
+// Panels that are already merged change color right away.
+func (tr *trooper) setFaceColors(mats [6]string) {
+	tr.faceColors = mats
+	for face := range mats {
+		if p, ok := tr.panel(face); ok {
+			p.color = mats[face]
+			if p.slab != nil {
+				safeFacade(p.slab, "cube", p.shader, p.color)
+			}
+		}
+	}
+}
+
+// healthTints are the cell materials used by setHealthTint, from empty
+// to full health.
+var healthTints = []string{"tred", "tgold", "tgreen"}
+
+// setHealthTint turns on cell coloring by health. The cells shift from the
+// first to the last of the healthTints as the trooper fills up. Cells go
+// back to their normal color when the tint is turned off.
+func (tr *trooper) setHealthTint(on bool) {
+	tr.healthTint = on
+	health, _, max := tr.health()
+	tr.tint(health, max)
+}
+
+// tint colors the cube cells to match the given health.
+func (tr *trooper) tint(health, max int) {
+	material := "tgreen"
+	if tr.healthTint && max > 0 {
+		index := int(float64(health)/float64(max)*float64(len(healthTints)-1) + 0.5)
+		material = healthTints[index]
+	}
+	for _, c := range tr.cubes() {
+		c.setColor(material)
+	}
+}
+
+// materialColors are the diffuse colors of the trooper materials as given
+// in the models directory material files.
+var materialColors = map[string][3]float64{
+	"tblue":  {0.15, 0.55, 0.82},
+	"tgold":  {0.62, 0.52, 0.18},
+	"tgreen": {0.35, 0.43, 0.46},
+	"tred":   {0.86, 0.20, 0.18},
+}
+
+// dominantColor blends the colors of the trooper cells, panel slabs, and
+// center into one color that can be used to light the scene. Colors are
+// weighted by their cell count where the center counts as one cell. A
+// merged trooper is its merged color and a trooper with no visible cells
+// is a neutral gray. The trooper is not changed.
+func (tr *trooper) dominantColor() (r, g, b float64) {
+	if tr.neo != nil {
+		rgb := materialColors["tblue"]
+		return rgb[0], rgb[1], rgb[2]
+	}
+	weight := 0
+	add := func(material string, cells int) {
+		if rgb, ok := materialColors[material]; ok && cells > 0 {
+			r, g, b = r+rgb[0]*float64(cells), g+rgb[1]*float64(cells), b+rgb[2]*float64(cells)
+			weight += cells
+		}
+	}
+	for _, bit := range tr.bits {
+		switch bit := bit.(type) {
+		case *cube:
+			add(bit.color, bit.ccnt)
+		case *panel:
+			if bit.slab != nil {
+				add(bit.color, bit.ccnt)
+				continue
+			}
+			for _, c := range bit.cubes {
+				add(c.color, c.ccnt)
+			}
+		}
+	}
+	if tr.center != nil && tr.center.Visible() {
+		add("tred", 1)
+	}
+	if weight == 0 {
+		return 0.5, 0.5, 0.5
+	}
+	return r / float64(weight), g / float64(weight), b / float64(weight)
+}
+
+// setMergeScale changes the size of merged cubes and panel slabs. The
+// default of 1 keeps the normal gap, while larger values, up to 1.2, let
+// a merged cube match the space taken up by its separate cells.
+func (tr *trooper) setMergeScale(factor float64) {
+	switch {
+	case factor < 0.5:
+		factor = 0.5
+	case factor > 1.2:
+		factor = 1.2
+	}
+	tr.mergeScale = factor
+	tr.scaleMerged()
+}
+
+// scaleMerged gives the cubes and panels the trooper merge scale. Already
+// merged cubes and panels are redrawn at the new size.
+func (tr *trooper) scaleMerged() {
+	for _, b := range tr.bits {
+		switch bit := b.(type) {
+		case *cube:
+			bit.setMergeScale(tr.mergeScale)
+		case *panel:
+			bit.mscale = tr.mergeScale
+			for _, c := range bit.cubes {
+				c.setMergeScale(tr.mergeScale)
+			}
+			if bit.slab != nil {
+				bit.merge()
+			}
+		}
+	}
+}
+
+// setExploded spreads the cubes and panels apart so that the inside of
+// the trooper can be inspected. Each piece is moved away from the trooper
+// center by factor times its own offset from the center. A factor of 0
+// puts the pieces back together. Negative factors are ignored.
+func (tr *trooper) setExploded(factor float64) {
+	if factor >= 0 {
+		tr.exploded = factor
+		tr.explode()
 	}
-	return tr
 }
 
-// fullHealth returns true if the player is at full health.
-func (tr *trooper) fullHealth() bool { return tr.neo != nil }
+// explode moves the cubes and panels to the trooper exploded spacing.
+func (tr *trooper) explode() {
+	f := tr.exploded
+	for _, b := range tr.bits {
+		switch bit := b.(type) {
+		case *cube:
+			bit.part.SetLocation(bit.cx*f, bit.cy*f, bit.cz*f)
+		case *panel:
+			bit.part.SetLocation(bit.cx*f, bit.cy*f, bit.cz*f)
+		}
+	}
+}
 
-// setScale changes the troopers size.
-func (tr *trooper) setScale(scale float64) { tr.part.SetScale(scale, scale, scale) }
+// setMirror flips the trooper along its x axis so that a second player
+// faces the opposite way. The cells are unchanged, only the trooper
+// scale is negated, so the cube stays consistent when mirrored.
+func (tr *trooper) setMirror(on bool) {
+	tr.mirrored = on
+	_, scale, _ := tr.part.Scale()
+	tr.setScale(scale)
+}
 
 // loc gets the troopers current location.
 func (tr *trooper) loc() (x, y, z float64) { return tr.part.Location() }
 func (tr *trooper) setLoc(x, y, z float64) { tr.part.SetLocation(x, y, z) }
 
+// setOrientation rotates the trooper by the given degrees around the x, y,
+// and z axes, in that order. Any previous rotation is replaced.
+func (tr *trooper) setOrientation(x, y, z float64) {
+	tr.ox, tr.oy, tr.oz = x, y, z
+	tr.part.SetRotation(0, 0, 0, 1)
+	tr.part.Spin(x, 0, 0)
+	tr.part.Spin(0, y, 0)
+	tr.part.Spin(0, 0, z)
+}
+
 // addCenter creates the interior center of the trooper which is a single cube
 // the size of the previous level. This will be nothing on the first level.
 func (tr *trooper) addCenter() {
-	if tr.lvl > 0 {
-		cubeSize := 1.0 / float64(tr.lvl+1)
+	if !tr.shape.single() && !tr.shellOnly {
+		half := tr.shape.cubeSize() * 0.5
 		tr.center = tr.part.AddPart()
 		tr.center.SetCullable(false)
-		tr.center.SetFacade("cube", "flata").SetMaterial("tred")
-		scale := float64(tr.lvl-1) * cubeSize * 0.45 // leave a gap.
-		tr.center.SetScale(scale, scale, scale)
+		safeFacade(tr.center, "cube", tr.cellShader(), "tred")
+		fadePart(tr.center, tr.opacity)
+		sx := gapped(float64(tr.shape.nx-2)*half, 0.1) // leave a gap.
+		sy := gapped(float64(tr.shape.ny-2)*half, 0.1)
+		sz := gapped(float64(tr.shape.nz-2)*half, 0.1)
+		tr.center.SetScale(sx, sy, sz)
+		tr.center.SetVisible(!tr.centerHidden)
+	}
+}
+
+// showCenter shows or hides the center cube without removing it. The choice
+// is kept and applied whenever the center is recreated.
+func (tr *trooper) showCenter(on bool) {
+	tr.centerHidden = !on
+	if tr.center != nil {
+		tr.center.SetVisible(on)
+	}
+}
+
+// markVisited remembers that the trooper has been at the given grid
+// location. Visited locations are cleared when the trooper is reset.
+func (tr *trooper) markVisited(gx, gy int) {
+	if tr.visited == nil {
+		tr.visited = map[gridSpot]bool{}
+	}
+	tr.visited[gridSpot{gx, gy}] = true
+}
+
+// isVisited returns true if the trooper has been at the given grid location.
+func (tr *trooper) isVisited(gx, gy int) bool { return tr.visited[gridSpot{gx, gy}] }
+
+// visitedCells returns the visited grid locations in no particular order.
+// This is used to reveal the minimap as the player explores.
+func (tr *trooper) visitedCells() []gridSpot {
+	spots := make([]gridSpot, 0, len(tr.visited))
+	for spot := range tr.visited {
+		spots = append(spots, spot)
+	}
+	return spots
+}
+
+// level returns the troopers game level.
+func (tr *trooper) level() int { return tr.lvl }
+
+// canLevelUp returns true if the trooper is full and can move on to
+// the next level.
+func (tr *trooper) canLevelUp() bool {
+	health, _, max := tr.health()
+	return health == max
+}
+
+// nextLevel returns the level after the troopers level. The level
+// is capped at the maximum level, see setMaxLevel.
+func (tr *trooper) nextLevel() int {
+	if tr.lvl >= tr.maxLvl {
+		return tr.maxLvl
 	}
+	return tr.lvl + 1
 }
 
+// setMaxLevel changes the highest level returned by nextLevel.
+func (tr *trooper) setMaxLevel(level int) { tr.maxLvl = level }
+
 // health returns the current cell count, the mid-point cell count
 // (the starting number of cells for the level), and the maximum
 // possible cell count for this level.
 func (tr *trooper) health() (health, mid, max int) {
+	cubic := tr.shape == cubicShape(tr.lvl) && tr.lvl <= coreTotalsCap
 	for _, b := range tr.bits {
 		health += b.box().ccnt
+		if !cubic {
+			max += b.box().cmax
+		}
+	}
+	if cubic {
+		_, _, max = coreTotals(tr.lvl)
+	}
+	if tr.coreCap > 0 && max > tr.coreCap {
+		max = tr.coreCap
+	}
+	return health, tr.mid, max
+}
+
+// filled returns true when every cell of every cube and panel is present.
+// Only filled troopers are merged. This differs from full health when the
+// health is capped, see difficultyProfile.
+func (tr *trooper) filled() bool {
+	for _, b := range tr.bits {
+		if b.box().ccnt < b.box().cmax {
+			return false
+		}
+	}
+	return true
+}
+
+// healthSegments returns the number of cells in each panel and edge cube,
+// in bits order. Used to draw a health bar with one segment per box.
+func (tr *trooper) healthSegments() []int {
+	segments := make([]int, len(tr.bits))
+	for cnt, b := range tr.bits {
+		segments[cnt] = b.box().ccnt
+	}
+	return segments
+}
+
+// maxSegments returns the maximum number of cells for each of the
+// healthSegments.
+func (tr *trooper) maxSegments() []int {
+	segments := make([]int, len(tr.bits))
+	for cnt, b := range tr.bits {
+		segments[cnt] = b.box().cmax
+	}
+	return segments
+}
+
+// minimapColor gives a colour for the troopers health. The colour goes from
+// red when empty, through yellow at the level entry health, to green when
+// full. The colour values are normalized between 0 and 1.
+func (tr *trooper) minimapColor() (r, g, b float32) {
+	health, mid, max := tr.health()
+	switch {
+	case health >= max:
+		return 0, 1, 0
+	case health >= mid:
+		return 1 - float32(health-mid)/float32(max-mid), 1, 0
+	case health > 0:
+		return 1, float32(health) / float32(mid), 0
 	}
-	l0, l1, l2 := (tr.lvl-1)*2, tr.lvl*2, (tr.lvl+1)*2
-	min, mid, max := l0*l0*l0, l1*l1*l1, l2*l2*l2
-	return health, mid - min, max - min
+	return 1, 0, 0
 }
 
-// reset the troopers health to the level's minimum.
+// reset the troopers health to the level's minimum and forget the grid
+// locations visited. Energy is not changed, see resetEnergy.
 func (tr *trooper) reset() {
-	tr.trash()
+	tr.visited = nil
+	tr.resetHealthOnly()
+}
+
+// resetHealthOnly resets the troopers health to the level's minimum.
+// Unlike reset, everything else, like the energy and visited grid
+// locations, is carried over.
+func (tr *trooper) resetHealthOnly() {
+	defer tr.quietPanels()()
+	tr.complete = false
+	tr.dead = false
+	tr.damageCooldown = 0
+	tr.trashOrdered()
+	tr.removeShield(len(tr.shields))
 	tr.addCenter()
 	for cnt, b := range tr.bits {
 		b.reset(tr.ipos[cnt])
@@ -183,175 +921,1580 @@ func (tr *trooper) reset() {
 // attach currently tries to attach new cells to the panels first.
 // Otherwise add to an edge.
 func (tr *trooper) attach() {
-	for _, b := range tr.bits {
-		if b.attach() {
-			health, mid, max := tr.health()
-			if health == max && tr.neo == nil {
-				tr.merge()
-			}
-			tr.healthChanged(health, mid, max)
-			return
-		}
+	if tr.attachCell() {
+		tr.record("attach")
+		tr.healthChanged(tr.health())
+		tr.scored(1)
 	}
 }
 
-// detach currently tries to remove cells from edges first.
-// Otherwise remove from a panel.
-func (tr *trooper) detach() {
-	if tr.neo != nil {
-		tr.demerge()
+// attachCores adds up to the indicated number of cells. The number of cells
+// actually added is returned, which is less than gain if the trooper fills up.
+// Cells beyond full health go to the shield, if there is one.
+func (tr *trooper) attachCores(gain int) (added int) {
+	for added < gain && tr.attachCell() {
+		added++
+	}
+	cells := added
+	for added < gain && tr.attachShield() {
+		added++
+	}
+	if added > 0 {
+		tr.record("attachCores")
 		tr.healthChanged(tr.health())
-		return
+		tr.scored(cells)
+	}
+	return added
+}
+
+// regenCores is attachCores for passive regeneration. Nothing is added
+// while the trooper is recovering from damage, see setRegenDelay. Pickups
+// call attachCores directly so they always add cells.
+func (tr *trooper) regenCores(gain int) (added int) {
+	if tr.damageCooldown > 0 {
+		return 0
+	}
+	return tr.attachCores(gain)
+}
+
+// coolDown counts down the damage cooldown by the given number of updates.
+// Called by updateEnergy and by the start screen, whose player isn't
+// advanced.
+func (tr *trooper) coolDown(steps int) {
+	if tr.damageCooldown -= steps; tr.damageCooldown < 0 {
+		tr.damageCooldown = 0
+	}
+}
+
+// setRegenDelay sets the number of energy updates, after losing cells,
+// before passive regeneration resumes. The default is 0 for no delay.
+// Negative delays are ignored.
+func (tr *trooper) setRegenDelay(ticks int) {
+	if ticks >= 0 {
+		tr.regenDelayTicks = ticks
 	}
+}
+
+// attachCell adds a single cell and merges the trooper when it reaches
+// full health. Monitors are not notified. Returns false if the trooper
+// is already full.
+func (tr *trooper) attachCell() bool {
 	for _, b := range tr.bits {
-		if b.detach() {
-			tr.healthChanged(tr.health())
-			return
+		if tr.attachBit(b) {
+			return true
 		}
 	}
+	return false
 }
 
-// detachCores removes the indicated number of cells.
-func (tr *trooper) detachCores(loss int) {
-	if loss <= 0 {
-		return
+// attachBit adds a single cell to the given bit and merges the trooper
+// when it reaches full health. Returns false if the bit is full or the
+// trooper has reached its core cap, see difficultyProfile.
+func (tr *trooper) attachBit(b box) bool {
+	if tr.coreCap > 0 {
+		if health, _, _ := tr.health(); health >= tr.coreCap {
+			return false
+		}
 	}
-	h, _, _ := tr.health()
+	tr.attaching = true
+	attached := b.attach()
+	tr.attaching = false
+	if attached {
+		tr.syncCenter()
+		if tr.filled() && tr.neo == nil && !tr.mergeDisabled {
+			tr.merge()
+		}
+	}
+	return attached
+}
+
+// attachNearest adds a single cell to the bit whose next cell is closest
+// to the given world point. This fills the side of the trooper facing a
+// pickup first. Returns false if the trooper is already full.
+func (tr *trooper) attachNearest(p *lin.V3) bool {
+	if tr.neo != nil {
+		return false
+	}
+	px, py, pz := tr.part.Location()
+	sx, sy, sz := tr.part.Scale()
+	var nearest box
+	distance := 0.0
+	for _, b := range tr.bits {
+		if center, ok := nextBitCenter(b); ok {
+			dx, dy, dz := px+center.X*sx-p.X, py+center.Y*sy-p.Y, pz+center.Z*sz-p.Z
+			if dist := dx*dx + dy*dy + dz*dz; nearest == nil || dist < distance {
+				nearest, distance = b, dist
+			}
+		}
+	}
+	if nearest == nil || !tr.attachBit(nearest) {
+		return false
+	}
+	tr.record("attachNearest")
+	tr.healthChanged(tr.health())
+	tr.scored(1)
+	return true
+}
+
+// addShield temporarily allows extra cells beyond full health. The extra
+// shield cells are filled by attachCores once the trooper is full and are
+// the first cells lost to detach and detachCores. Shield cells are not
+// part of the troopers health, see shield.
+func (tr *trooper) addShield(extra int) {
+	if extra > 0 {
+		tr.shieldMax += extra
+	}
+}
+
+// dropShield removes the shield and any shield cells.
+func (tr *trooper) dropShield() {
+	tr.removeShield(len(tr.shields))
+	tr.shieldMax = 0
+}
+
+// shield returns the current and maximum number of shield cells.
+func (tr *trooper) shield() (cells, max int) { return len(tr.shields), tr.shieldMax }
+
+// attachShield adds a single shield cell. Returns false if the trooper
+// is not yet at full health or the shield is full.
+func (tr *trooper) attachShield() bool {
+	if health, _, max := tr.health(); health < max || len(tr.shields) >= tr.shieldMax {
+		return false
+	}
+	cell := tr.part.AddPart()
+	cell.SetCullable(false)
+	safeFacade(cell, "cube", tr.cellShader(), "tgold")
+	fadePart(cell, tr.opacity)
+	cell.SetLocation(shieldSpot(len(tr.shields)))
+	cell.SetScale(0.08, 0.08, 0.08)
+	tr.shields = append(tr.shields, cell)
+	return true
+}
+
+// removeShield takes away up to loss shield cells, newest first.
+// The number of removed shield cells is returned.
+func (tr *trooper) removeShield(loss int) (removed int) {
+	for ; removed < loss && len(tr.shields) > 0; removed++ {
+		last := len(tr.shields) - 1
+		tr.part.RemPart(tr.shields[last])
+		tr.shields = tr.shields[:last]
+	}
+	return removed
+}
+
+// shieldSpot is where the indexed shield cell is drawn. Shield cells
+// circle the trooper, eight to a ring, with later rings stacked upwards.
+func shieldSpot(index int) (x, y, z float64) {
+	angle := float64(index%8) * math.Pi / 4
+	return 0.8 * math.Cos(angle), float64(index/8) * 0.2, 0.8 * math.Sin(angle)
+}
+
+// criticalHealth is the fraction of full health below which the trooper
+// warns the player by pulsing its cells. Use 0 to turn off the warning.
+var criticalHealth = 0.1
+
+// criticalRecovery is the fraction of full health above which a running
+// low health warning stops. Keeping it above criticalHealth stops the
+// warning flickering when the health hovers around criticalHealth.
+var criticalRecovery = 0.15
+
+// setCriticalThresholds changes the fractions of full health where the low
+// health warning starts and stops, see criticalHealth and criticalRecovery.
+// The fractions are kept between 0 and 1 and the stop fraction is raised to
+// the start fraction if needed.
+func setCriticalThresholds(enter, exit float64) {
+	enter = math.Max(0, math.Min(enter, 1))
+	exit = math.Max(enter, math.Min(exit, 1))
+	criticalHealth, criticalRecovery = enter, exit
+}
+
+// setCritical starts, or stops, the low health warning where the remaining
+// cells pulse. The health is not changed. The warning is turned on and off
+// automatically as the health crosses criticalHealth and criticalRecovery.
+// Troopers without an animator never warn.
+func (tr *trooper) setCritical(on bool) {
+	switch {
+	case on && tr.critical == nil && tr.ani != nil:
+		tr.critical = &criticalAnimation{tr: tr, ticks: 40}
+		tr.ani.addAnimation(tr.critical)
+	case !on && tr.critical != nil:
+		tr.critical.Wrap()
+	}
+}
+
+// isCritical returns true while the low health warning is running.
+func (tr *trooper) isCritical() bool { return tr.critical != nil }
+
+// checkCritical turns the low health warning on or off for the given health.
+// A running warning continues until the health is above criticalRecovery.
+func (tr *trooper) checkCritical(health, max int) {
+	if criticalHealth > 0 && max > 0 {
+		threshold := criticalHealth
+		if tr.isCritical() {
+			threshold = criticalRecovery
+		}
+		tr.setCritical(health > 0 && float64(health) < threshold*float64(max))
+	}
+}
+
+// setMergeDisabled stops, or restarts, the merging of full cubes, panels,
+// and the trooper into single parts. Some graphics drivers handle many
+// static parts better than the changing parts caused by merging. The current
+// cells are redrawn to match without changing the troopers health.
+func (tr *trooper) setMergeDisabled(disabled bool) {
+	defer tr.quietPanels()()
+	tr.mergeDisabled = disabled
+	for _, b := range tr.bits {
+		b.box().nomerge = disabled
+		if p, ok := b.(*panel); ok {
+			for _, c := range p.cubes {
+				c.nomerge = disabled
+			}
+		}
+	}
+	if tr.neo != nil {
+		tr.split()
+	} else {
+		for _, b := range tr.bits {
+			b.reset(b.box().ccnt)
+		}
+	}
+	if tr.filled() && !disabled {
+		tr.merge()
+	}
+}
+
+// setShellOnly draws, or stops drawing, only the outer shell of the trooper
+// for better performance on large levels. Each panel and cube with cells is
+// drawn as a single part and the center is hidden. The health is unchanged
+// and turning the shell off redraws the detailed cells.
+func (tr *trooper) setShellOnly(on bool) {
+	defer tr.quietPanels()()
+	tr.shellOnly = on
+	for _, b := range tr.bits {
+		b.box().shell = on
+		if p, ok := b.(*panel); ok {
+			for _, c := range p.cubes {
+				c.shell = on
+			}
+		}
+	}
+	if tr.neo != nil {
+		tr.split()
+	} else {
+		tr.trashOrdered()
+		tr.addCenter()
+		for _, b := range tr.bits {
+			b.reset(b.box().ccnt)
+		}
+	}
+	if tr.filled() && !tr.mergeDisabled {
+		tr.merge()
+	}
+}
+
+// setInvulnerable turns practice mode on or off. An invulnerable trooper
+// still gains cells and uses energy, but never loses cells. The setting
+// is kept across resets since it is a player choice rather than level state.
+func (tr *trooper) setInvulnerable(on bool) { tr.invulnerable = on }
+
+// faceToward returns the face, 0-5 for +x, -x, +y, -y, +z, -z, whose
+// outward direction best matches the given world direction. The trooper
+// rotation is taken into account.
+func (tr *trooper) faceToward(dir *lin.V3) int {
+	qx, qy, qz, qw := tr.part.Rotation()
+
+	// rotate the direction by the inverse rotation to get local coordinates.
+	qx, qy, qz = -qx, -qy, -qz
+	tx := 2 * (qy*dir.Z - qz*dir.Y)
+	ty := 2 * (qz*dir.X - qx*dir.Z)
+	tz := 2 * (qx*dir.Y - qy*dir.X)
+	x := dir.X + qw*tx + (qy*tz - qz*ty)
+	y := dir.Y + qw*ty + (qz*tx - qx*tz)
+	z := dir.Z + qw*tz + (qx*ty - qy*tx)
+
+	// the largest component decides the face.
+	ax, ay, az := math.Abs(x), math.Abs(y), math.Abs(z)
+	switch {
+	case ax >= ay && ax >= az:
+		if x < 0 {
+			return 1
+		}
+		return 0
+	case ay >= az:
+		if y < 0 {
+			return 3
+		}
+		return 2
+	}
+	if z < 0 {
+		return 5
+	}
+	return 4
+}
+
+// worldAABB returns the world space axis aligned box that contains the
+// trooper body. The trooper location, scale, and rotation are applied, where
+// a rotated trooper gets the larger box that holds all of its corners.
+// Shield cells circle outside the body and are not included.
+func (tr *trooper) worldAABB() (min, max *lin.V3) {
+	px, py, pz := tr.part.Location()
+	sx, sy, sz := tr.part.Scale()
+	size := tr.shape.cubeSize() * 0.5
+	hx := math.Abs(float64(tr.shape.nx) * size * sx) // sx is negative when mirrored.
+	hy := math.Abs(float64(tr.shape.ny) * size * sy)
+	hz := math.Abs(float64(tr.shape.nz) * size * sz)
+
+	// each world axis extent is the local extents projected by the
+	// absolute values of the rotation matrix row.
+	qx, qy, qz, qw := tr.part.Rotation()
+	ex := math.Abs(1-2*(qy*qy+qz*qz))*hx + math.Abs(2*(qx*qy-qz*qw))*hy + math.Abs(2*(qx*qz+qy*qw))*hz
+	ey := math.Abs(2*(qx*qy+qz*qw))*hx + math.Abs(1-2*(qx*qx+qz*qz))*hy + math.Abs(2*(qy*qz-qx*qw))*hz
+	ez := math.Abs(2*(qx*qz-qy*qw))*hx + math.Abs(2*(qy*qz+qx*qw))*hy + math.Abs(1-2*(qx*qx+qy*qy))*hz
+	return &lin.V3{px - ex, py - ey, pz - ez}, &lin.V3{px + ex, py + ey, pz + ez}
+}
+
+// cellBound is the world space location and size of a single cell.
+type cellBound struct {
+	center lin.V3  // World space center of the cell.
+	half   float64 // Half the width of the cell.
+}
+
+// cellBounds returns the world space bounds for each trooper cell so that
+// collisions can be checked against individual cells. Full cubes, panels,
+// and a merged trooper are reported as larger cells. The trooper location
+// and scale are applied, but not its rotation. Troopers are expected to be
+// scaled evenly along each axis.
+func (tr *trooper) cellBounds() []cellBound {
+	px, py, pz := tr.part.Location()
+	sx, sy, sz := tr.part.Scale()
+	bounds := []cellBound{}
+	add := func(x, y, z, half float64) {
+		center := lin.V3{px + x*sx, py + y*sy, pz + z*sz}
+		bounds = append(bounds, cellBound{center, half * sy}) // sx is negative when mirrored.
+	}
+	if tr.neo != nil {
+		add(0, 0, 0, 0.5)
+		return bounds
+	}
+	for _, b := range tr.bits {
+		cubes := []*cube{}
+		switch bit := b.(type) {
+		case *cube:
+			cubes = append(cubes, bit)
+		case *panel:
+			if bit.cmax > 0 && (bit.ccnt == bit.cmax || bit.slab != nil) {
+				for _, c := range bit.cubes {
+					add(c.cx, c.cy, c.cz, c.csize*0.5)
+				}
+				continue
+			}
+			cubes = bit.cubes
+		}
+		for _, c := range cubes {
+			if c.ccnt == c.cmax || c.merged(c.ccnt) {
+				add(c.cx, c.cy, c.cz, c.csize*0.5)
+				continue
+			}
+			for _, v := range c.centers[:c.ccnt] {
+				add(v.X, v.Y, v.Z, c.cellHalf())
+			}
+		}
+	}
+	return bounds
+}
+
+// closestCell returns the world space center of the trooper cell nearest
+// to the given world point, and the distance to it. Merged cells are
+// treated as larger cells, see cellBounds. A nil center and a distance
+// of -1 are returned when the trooper has no cells.
+func (tr *trooper) closestCell(p *lin.V3) (center *lin.V3, distance float64) {
+	distance = -1
+	for _, bound := range tr.cellBounds() {
+		dx, dy, dz := bound.center.X-p.X, bound.center.Y-p.Y, bound.center.Z-p.Z
+		if dist := math.Sqrt(dx*dx + dy*dy + dz*dz); center == nil || dist < distance {
+			center = &lin.V3{bound.center.X, bound.center.Y, bound.center.Z}
+			distance = dist
+		}
+	}
+	return center, distance
+}
+
+// prewarm attaches and then removes a cell on each cube that has room for
+// one. This gets the engine to allocate cell resources before they are needed
+// in game. The trooper looks the same before and after. Going directly to
+// the cubes leaves the panel cell counts untouched.
+func (tr *trooper) prewarm() {
+	if tr.neo != nil {
+		return // a merged trooper has nothing to warm up.
+	}
+	for _, c := range tr.cubes() {
+		if c.attach() {
+			c.detach()
+		}
+	}
+}
+
+// detach currently tries to remove cells from edges first.
+// Otherwise remove from a panel.
+func (tr *trooper) detach() {
+	if tr.invulnerable {
+		return
+	}
+	if tr.removeShield(1) > 0 {
+		tr.record("detach")
+		return
+	}
+	if tr.neo != nil {
+		h, _, _ := tr.health()
+		tr.demergeTo(h - 1)
+		tr.record("detach")
+		tr.healthChanged(tr.health())
+		return
+	}
+	for _, b := range tr.detachBits() {
+		if b.detach() {
+			tr.syncCenter()
+			tr.record("detach")
+			tr.healthChanged(tr.health())
+			return
+		}
+	}
+}
+
+// detachCores removes the indicated number of cells. Shield cells are
+// lost first. The lost cells are scattered when cell scattering is enabled.
+// Damage monitors are told how many cells were lost.
+func (tr *trooper) detachCores(loss int) {
+	if loss <= 0 || tr.invulnerable {
+		return
+	}
+	shielded := tr.removeShield(loss)
+	if loss -= shielded; loss == 0 {
+		tr.record("detachCores")
+		tr.damageTaken(shielded)
+		return
+	}
+	health, _, _ := tr.health()
+	if tr.scatterCells && tr.ani != nil {
+		if tr.neo != nil {
+			tr.split() // so each lost cell is detached and scattered.
+		}
+		tr.scattering = true
+		tr.removeCells(loss)
+		tr.scattering = false
+	} else {
+		tr.removeCells(loss)
+	}
+	tr.damageCooldown = tr.regenDelayTicks
+	tr.record("detachCores")
+	tr.healthChanged(tr.health())
+	remaining, _, _ := tr.health()
+	tr.damageTaken(shielded + health - remaining)
+}
+
+// removeCells takes away up to loss cells without notifying monitors.
+func (tr *trooper) removeCells(loss int) {
+	h, _, _ := tr.health()
 	if loss > h {
 		loss = h
 	}
+	if tr.neo != nil {
+		tr.demergeTo(h - loss)
+		loss = 0
+	}
+	bits := tr.detachBits()
 	for cnt := loss; cnt > 0; cnt-- {
-		if tr.neo != nil {
-			tr.demerge()
+		for _, b := range bits {
+			if b.detach() {
+				break
+			}
+		}
+	}
+	tr.syncCenter()
+}
+
+// syncCenter removes the center once the trooper has lost all its cells,
+// since a center with nothing around it looks odd. The center is put back
+// when cells are attached again.
+func (tr *trooper) syncCenter() {
+	switch health, _, _ := tr.health(); {
+	case health == 0 && tr.center != nil:
+		tr.part.RemPart(tr.center)
+		tr.center = nil
+	case health > 0 && tr.center == nil:
+		tr.addCenter()
+	}
+}
+
+// detachBits returns the bits in the order that cells are removed.
+// The strategy gets a copy so that the troopers bits are never reordered.
+func (tr *trooper) detachBits() []box {
+	if tr.detachOrder == nil {
+		return tr.bits
+	}
+	return tr.detachOrder(append([]box{}, tr.bits...))
+}
+
+// setHealth changes the number of cells to the given target, which is
+// kept between 0 and full health. Monitors are notified once. Expected to
+// be used by tests and debugging hooks.
+func (tr *trooper) setHealth(target int) {
+	health, _, max := tr.health()
+	switch {
+	case target < 0:
+		target = 0
+	case target > max:
+		target = max
+	}
+	switch {
+	case target > health:
+		for ; health < target && tr.attachCell(); health++ {
+		}
+	case target < health:
+		tr.removeCells(health - target)
+	default:
+		return
+	}
+	tr.record("setHealth")
+	tr.healthChanged(tr.health())
+}
+
+// detachFace removes up to loss cells from one of the six trooper faces,
+// where faces 0-5 match the six panels. Cells are removed from the panel
+// first and then from the edge cubes on the same side once the panel is
+// empty. Invalid faces are ignored. The number of removed cells is returned.
+func (tr *trooper) detachFace(face int, loss int) (removed int) {
+	p, ok := tr.panel(face)
+	if !ok || tr.invulnerable || loss <= 0 {
+		return 0
+	}
+	if tr.neo != nil {
+		tr.split()
+	}
+	for removed < loss && (p.detach() || tr.detachEdge(p)) {
+		removed++
+	}
+	tr.record("detachFace")
+	tr.healthChanged(tr.health())
+	return removed
+}
+
+// clearCube empties the edge cube at the given index in the troopers bits
+// and returns the number of cells removed. The other cubes and panels are
+// not changed. Invalid indexes and panels are ignored and remove nothing.
+func (tr *trooper) clearCube(index int) (removed int) {
+	if index < 0 || index >= len(tr.bits) || tr.invulnerable {
+		return 0
+	}
+	c, ok := tr.bits[index].(*cube)
+	if !ok || c.ccnt == 0 {
+		return 0
+	}
+	if tr.neo != nil {
+		tr.split()
+	}
+	removed = c.ccnt
+	c.reset(0)
+	tr.syncCenter()
+	tr.record("clearCube")
+	tr.healthChanged(tr.health())
+	return removed
+}
+
+// panel returns the panel for the given face, 0-5 for +x, -x, +y, -y, +z, -z.
+// False is returned for invalid faces and for troopers without panels.
+func (tr *trooper) panel(face int) (*panel, bool) {
+	if face < 0 || face > 5 || face >= len(tr.bits) {
+		return nil, false
+	}
+	p, ok := tr.bits[face].(*panel)
+	return p, ok
+}
+
+// panelCapacities returns the number of cells each panel holds at full
+// health, in panel face order. Troopers without panels, and level 1
+// troopers whose panels have no cubes, return all zeros.
+func (tr *trooper) panelCapacities() (capacities [6]int) {
+	for face := range capacities {
+		if p, ok := tr.panel(face); ok {
+			capacities[face] = p.cmax
+		}
+	}
+	return capacities
+}
+
+// edgeCapacity returns the number of cells held by the edge cubes at full
+// health. Together with panelCapacities this makes up the maximum health.
+func (tr *trooper) edgeCapacity() (capacity int) {
+	for _, b := range tr.bits {
+		if c, ok := b.(*cube); ok {
+			capacity += c.cmax
+		}
+	}
+	return capacity
+}
+
+// detachEdge removes a cell from one of the edge cubes bordering the given
+// panel. Returns false if there were no cells left to remove.
+func (tr *trooper) detachEdge(p *panel) bool {
+	for _, b := range tr.bits {
+		if c, ok := b.(*cube); ok && p.borders(c) && c.detach() {
+			return true
+		}
+	}
+	return false
+}
+
+// merge collapses all the troopers cubes into a single cube with an
+// optional center cube.  Called when the trooper reaches full health.
+func (tr *trooper) merge() {
+	defer tr.quietPanels()()
+	tr.trashOrdered()
+	tr.neo = tr.part.AddPart()
+	tr.neo.SetCullable(false)
+	safeFacade(tr.neo, "cube", tr.cellShader(), "tblue")
+	fadePart(tr.neo, tr.opacity)
+	tr.neo.SetScale(0.5, 0.5, 0.5)
+	tr.addCenter()
+	tr.record("merge")
+}
+
+// mergeCompleted merges each full panel and cube while leaving the partial
+// ones detailed. Attach already merges a panel or cube as it fills, so this
+// only changes bits that were filled some other way. Bits that are already
+// merged are left alone and a later detach undoes the merge as usual.
+func (tr *trooper) mergeCompleted() {
+	if tr.neo != nil || tr.mergeDisabled {
+		return
+	}
+	for _, b := range tr.bits {
+		cb := b.box()
+		if cb.cmax == 0 || !cb.merged(cb.ccnt) {
 			continue
 		}
+		switch bit := b.(type) {
+		case *cube:
+			if len(bit.cells) != 1 {
+				bit.merge()
+			}
+		case *panel:
+			if bit.slab == nil {
+				bit.merge()
+			}
+		}
+	}
+}
+
+// demergeTo breaks the troopers single cube into smaller blocks holding
+// exactly the given number of cells. Expected to be called when a trooper
+// at full health loses health. The missing cells are the ones that detach
+// would have removed, so losing several cells from full looks the same as
+// losing them one at a time.
+func (tr *trooper) demergeTo(targetHealth int) {
+	_, _, max := tr.health()
+	if tr.neo == nil || targetHealth >= max {
+		return
+	}
+	if targetHealth < 0 {
+		targetHealth = 0
+	}
+	defer tr.quietPanels()()
+	tr.trashOrdered()
+	tr.addCenter()
+	loss := max - targetHealth
+	for _, b := range tr.detachBits() {
+		cmax := b.box().cmax
+		removed := loss
+		if removed > cmax {
+			removed = cmax
+		}
+		b.reset(cmax - removed)
+		loss -= removed
+	}
+	tr.record("demerge")
+}
+
+// split replaces the troopers single cube with full panels and cubes
+// without changing the troopers health.
+func (tr *trooper) split() {
+	defer tr.quietPanels()()
+	tr.trash()
+	tr.addCenter()
+	for _, b := range tr.bits {
+		b.reset(b.box().cmax)
+	}
+}
+
+// cubesNearMerge returns the number of cubes that are not yet full but
+// are within threshold cells of merging.
+func (tr *trooper) cubesNearMerge(threshold int) (count int) {
+	for _, c := range tr.cubes() {
+		if left := c.toMerge(); left > 0 && left <= threshold {
+			count++
+		}
+	}
+	return count
+}
+
+// setAlpha sets the transparency of each of the troopers rendered parts.
+// The alpha is kept between 0 and 1. Fading the parts this way doesn't
+// depend on the part materials.
+func (tr *trooper) setAlpha(alpha float64) {
+	alpha = math.Max(0, math.Min(1, alpha))
+	tr.opacity = alpha
+	for _, b := range tr.bits {
+		b.box().alpha = alpha // for cells and slabs created later.
+		if p, ok := b.(*panel); ok {
+			for _, c := range p.cubes {
+				c.alpha = alpha
+			}
+		}
+	}
+	if tr.neo != nil {
+		tr.neo.SetAlpha(alpha)
+	}
+	if tr.center != nil {
+		tr.center.SetAlpha(alpha)
+	}
+	for _, b := range tr.bits {
+		if p, ok := b.(*panel); ok && p.slab != nil {
+			p.slab.SetAlpha(alpha)
+		}
+	}
+	for _, c := range tr.cubes() {
+		for _, cell := range c.cells {
+			cell.SetAlpha(alpha)
+		}
+		for _, cell := range c.pool {
+			cell.SetAlpha(alpha)
+		}
+	}
+	for _, cell := range tr.shields {
+		cell.SetAlpha(alpha)
+	}
+}
+
+// alpha returns the transparency last given to setAlpha. The default is 1.
+func (tr *trooper) alpha() float64 { return tr.opacity }
+
+// renderedPartCount returns the number of rendered parts currently held by
+// the trooper. This includes cells, merged cubes, slabs, the center, and
+// any shield cells. It shows how well merging is keeping down the number
+// of draw objects.
+func (tr *trooper) renderedPartCount() (count int) {
+	count = len(tr.shields)
+	if tr.neo != nil {
+		count++
+	}
+	if tr.center != nil {
+		count++
+	}
+	for _, b := range tr.bits {
+		if p, ok := b.(*panel); ok && p.slab != nil {
+			count++
+		}
+	}
+	for _, c := range tr.cubes() {
+		count += len(c.cells)
+	}
+	return count
+}
+
+// verifyIntegrity checks that the rendered parts match the troopers health
+// and structure. An error describing the mismatch is returned for orphaned
+// or missing parts.
+func (tr *trooper) verifyIntegrity() error {
+	expected := len(tr.shields)
+	if health, _, _ := tr.health(); health > 0 && !tr.shape.single() && !tr.shellOnly {
+		expected++ // the center.
+	}
+	if tr.neo != nil {
+		expected++
+	} else {
 		for _, b := range tr.bits {
-			if b.detach() {
-				break
+			switch bit := b.(type) {
+			case *cube:
+				expected += bit.partCount()
+			case *panel:
+				if bit.cmax > 0 && bit.merged(bit.ccnt) {
+					expected++ // the slab.
+					continue
+				}
+				for _, c := range bit.cubes {
+					expected += c.partCount()
+				}
 			}
 		}
 	}
-	tr.healthChanged(tr.health())
+	if count := tr.renderedPartCount(); count != expected {
+		return fmt.Errorf("trooper: level %d has %d parts, expected %d", tr.lvl, count, expected)
+	}
+	return nil
+}
+
+// auditPanelOwnership checks that each side cube position of the troopers
+// shape is owned by exactly one panel, that the owning panel is on the
+// same side as the cube, and that the panel cell counts match its cubes.
+// An error describing the first problem found is returned.
+func (tr *trooper) auditPanelOwnership() error {
+	if tr.shape.single() {
+		return nil
+	}
+	nx, ny, nz := tr.shape.nx-1, tr.shape.ny-1, tr.shape.nz-1
+	offset := tr.shape.cubeSize() * 0.5
+	owned := 0
+	for cx := 0; cx <= nx; cx++ {
+		for cy := 0; cy <= ny; cy++ {
+			for cz := 0; cz <= nz; cz++ {
+				ex, ey, ez := cx == 0 || cx == nx, cy == 0 || cy == ny, cz == 0 || cz == nz
+				if ex && ey || ex && ez || ey && ez || !(ex || ey || ez) {
+					continue // not a side cube.
+				}
+				x := float64(2*cx-nx) * offset
+				y := float64(2*cy-ny) * offset
+				z := float64(2*cz-nz) * offset
+				owners := 0
+				for face, b := range tr.bits {
+					p, ok := b.(*panel)
+					if !ok {
+						continue
+					}
+					for _, c := range p.cubes {
+						if c.cx == x && c.cy == y && c.cz == z {
+							owners++
+							if !p.borders(c) {
+								return fmt.Errorf("trooper: side cube %f %f %f misassigned to panel %d", x, y, z, face)
+							}
+						}
+					}
+				}
+				if owners != 1 {
+					return fmt.Errorf("trooper: side cube %f %f %f has %d panels", x, y, z, owners)
+				}
+				owned++
+			}
+		}
+	}
+	cubes := 0
+	for face, b := range tr.bits {
+		p, ok := b.(*panel)
+		if !ok {
+			continue
+		}
+		cubes += len(p.cubes)
+		cells, cmax := 0, 0
+		for _, c := range p.cubes {
+			cells += c.ccnt
+			cmax += c.cmax
+		}
+		merged := p.slab != nil && p.merged(p.ccnt)
+		if p.cmax != cmax || (!merged && cells != p.ccnt) {
+			return fmt.Errorf("trooper: panel %d has %d of %d cells, cubes have %d", face, p.ccnt, p.cmax, cells)
+		}
+	}
+	if cubes != owned {
+		return fmt.Errorf("trooper: panels have %d cubes, expected %d", cubes, owned)
+	}
+	return nil
+}
+
+// describe returns an indented text tree of the troopers current
+// structure for debugging. Unlike telemetry it is a one time snapshot.
+func (tr *trooper) describe() string {
+	buf := &bytes.Buffer{}
+	health, _, max := tr.health()
+	fmt.Fprintf(buf, "trooper level %d health %d/%d\n", tr.lvl, health, max)
+	if tr.neo != nil {
+		fmt.Fprintf(buf, "  neo\n")
+	}
+	if tr.center != nil {
+		fmt.Fprintf(buf, "  center\n")
+	}
+	for _, b := range tr.bits {
+		switch bit := b.(type) {
+		case *panel:
+			fmt.Fprintf(buf, "  panel %d/%d cells %d cubes\n", bit.ccnt, bit.cmax, len(bit.cubes))
+			for _, c := range bit.cubes {
+				fmt.Fprintf(buf, "    cube %d/%d at %g %g %g\n", c.ccnt, c.cmax, c.cx, c.cy, c.cz)
+			}
+		case *cube:
+			fmt.Fprintf(buf, "  cube %d/%d at %g %g %g\n", bit.ccnt, bit.cmax, bit.cx, bit.cy, bit.cz)
+		}
+	}
+	return buf.String()
+}
+
+// recordTo starts recording health changes to the given writer.
+// Use nil to stop recording.
+func (tr *trooper) recordTo(w io.Writer) { tr.rec = w }
+
+// record writes a single line for a health changing event. Each line
+// has the tick, the event, and the resulting health.
+func (tr *trooper) record(event string) {
+	if tr.rec != nil {
+		health, _, max := tr.health()
+		fmt.Fprintf(tr.rec, "%d %s %d/%d\n", tr.tick, event, health, max)
+	}
+}
+
+// partParent is anything that holds parts, generally a scene or a part.
+type partParent interface {
+	RemPart(part vu.Part)
+}
+
+// dispose releases the trooper and its parts. The trooper part is removed
+// from its parent if the parent is known. The trooper can't be used after
+// dispose, but calling dispose more than once is safe.
+func (tr *trooper) dispose() {
+	if tr.part == nil {
+		return
+	}
+	if tr.critical != nil {
+		tr.critical.Wrap() // stop animations that move or fade the trooper.
+	}
+	if tr.shaking != nil {
+		tr.shaking.Wrap()
+	}
+	tr.trash()
+	tr.part.Dispose()
+	if tr.parent != nil {
+		tr.parent.RemPart(tr.part)
+	}
+	tr.part, tr.parent = nil, nil
+	tr.bits, tr.shields = nil, nil
+}
+
+// setTelemetry starts writing a CSV row of tick, health, mid, max,
+// teleport energy, and cloak energy each time the health or energy
+// changes. Use nil to stop.
+func (tr *trooper) setTelemetry(w io.Writer) { tr.tel = w }
+
+// telemetry writes a single telemetry row.
+func (tr *trooper) telemetry() {
+	if tr.tel != nil {
+		health, mid, max := tr.health()
+		teng, _, ceng, _ := tr.energy()
+		fmt.Fprintf(tr.tel, "%d,%d,%d,%d,%d,%d\n", tr.tick, health, mid, max, teng, ceng)
+	}
+}
+
+// trash destroys all the troopers cells. Parts are always removed
+// children first, see trashOrdered.
+func (tr *trooper) trash() { tr.trashOrdered() }
+
+// trashOrdered removes the troopers parts in a fixed order: the cube cells,
+// including the panel cubes cells, then the panel slabs, and finally the
+// center and the merged trooper. The cube and panel parts that hold the
+// cells are kept for reuse.
+func (tr *trooper) trashOrdered() {
+	for _, c := range tr.cubes() {
+		c.trash()
+	}
+	for _, b := range tr.bits {
+		if p, ok := b.(*panel); ok {
+			p.trash()
+		}
+	}
+	if tr.center != nil {
+		tr.part.RemPart(tr.center)
+		tr.center = nil
+	}
+	if tr.neo != nil {
+		tr.part.RemPart(tr.neo)
+		tr.neo = nil
+	}
+}
+
+// addCloakEnergy is called to increase the amount of cloaking energy.
+func (tr *trooper) addCloakEnergy() {
+	tr.cloakEnergy += 100
+	if tr.cloakEnergy > tr.cemax {
+		tr.cloakEnergy = tr.cemax
+	}
+	tr.clampEnergy()
+	tr.energyChanged()
+}
+
+// isCloaked returns true if the trooper is currently cloaked.
+func (tr *trooper) isCloaked() bool { return tr.cloaked }
+
+// cloak toggles the players cloak ability. Cloaking is only enabled if
+// there is sufficient energy. Cloaking an already cloaked trooper does nothing.
+// Cloaking is always full cloaking, see setCloakLevel.
+func (tr *trooper) cloak(useCloak bool) {
+	if useCloak {
+		tr.setCloakLevel(cloakFull)
+	} else {
+		tr.setCloakLevel(cloakOff)
+	}
+}
+
+// Cloak levels. Partial cloaking uses less energy but conceals less.
+const (
+	cloakOff     = iota // Not cloaked.
+	cloakPartial        // Partially cloaked.
+	cloakFull           // Fully cloaked.
+)
+
+// cloakDrain is the cloak energy used per energy update for each cloak level.
+var cloakDrain = []int{0, 2, 4}
+
+// cloakConcealment is how well the trooper is hidden for each cloak level.
+var cloakConcealment = []float64{0, 0.5, 1}
+
+// setCloakLevel changes the cloak level to one of cloakOff, cloakPartial,
+// or cloakFull. Cloaking is only enabled if there is sufficient energy.
+// The cloak sound is only played when cloaking starts.
+func (tr *trooper) setCloakLevel(level int) {
+	switch {
+	case level < cloakOff:
+		level = cloakOff
+	case level > cloakFull:
+		level = cloakFull
+	}
+	switch {
+	case level == cloakOff:
+		tr.cloaked, tr.cloakLevel = false, cloakOff
+		tr.playNoise("decloak")
+	case tr.cloaked:
+		tr.cloakLevel = level
+	case tr.cloakEnergy > 0:
+		tr.cloaked, tr.cloakLevel = true, level
+		tr.playNoise("cloak")
+	}
+}
+
+// concealment returns how well the trooper is hidden, from 0 when not
+// cloaked to 1 when fully cloaked.
+func (tr *trooper) concealment() float64 { return cloakConcealment[tr.cloakLevel] }
+
+// playNoise plays the named sound where the sound listener was last placed,
+// see updateAudio, or at the troopers location if the listener hasn't been
+// placed. Missing sounds are logged the first time they are needed and are
+// otherwise ignored.
+func (tr *trooper) playNoise(name string) {
+	noise, ok := tr.noises[name]
+	if !ok || noise == nil {
+		if tr.quiet == nil {
+			tr.quiet = map[string]bool{}
+		}
+		if !tr.quiet[name] {
+			tr.quiet[name] = true
+			log.Printf("trooper.playNoise: missing sound %s", name)
+		}
+		return
+	}
+	if testMode {
+		return
+	}
+	if tr.heard {
+		noise.SetLocation(tr.ax, tr.ay, tr.az)
+	} else {
+		noise.SetLocation(tr.loc())
+	}
+	noise.Play()
+	if tr.playing == nil {
+		tr.playing = map[string]int{}
+	}
+	tr.playing[name] = noiseTicks
+}
+
+// noiseTicks is the number of updates that a trooper sound is expected
+// to play for. Sounds don't report when they finish so the trooper assumes
+// they are done after this many updates, see activeNoises.
+var noiseTicks = 60
+
+// activeNoises returns the sorted names of the trooper sounds that are
+// still playing, or at least were played less than noiseTicks updates ago.
+func (tr *trooper) activeNoises() []string {
+	names := []string{}
+	for name := range tr.playing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// noiseStopper is implemented by sounds that can be stopped.
+type noiseStopper interface {
+	Stop()
+}
+
+// stopAll halts any playing trooper sounds that can be stopped and
+// forgets about the rest.
+func (tr *trooper) stopAll() {
+	for name := range tr.playing {
+		if stopper, ok := tr.noises[name].(noiseStopper); ok {
+			stopper.Stop()
+		}
+	}
+	tr.playing = nil
+}
+
+// updateAudio is called each update to keep the sound listener, and any
+// playing trooper sounds, at the given world location. The location is
+// where the player is in the level, not the trooper part, which may only
+// be drawn on the HUD. Sounds that have had time to finish are no longer
+// considered to be playing.
+func (tr *trooper) updateAudio(x, y, z float64) {
+	for name, ticks := range tr.playing {
+		if ticks <= 1 {
+			delete(tr.playing, name)
+		} else {
+			tr.playing[name] = ticks - 1
+		}
+	}
+	tr.placeListener(x, y, z)
+}
+
+// placeListener moves the sound listener, and any playing trooper sounds,
+// to the given location. Nothing is moved unless the location has changed.
+func (tr *trooper) placeListener(x, y, z float64) {
+	if tr.heard && x == tr.ax && y == tr.ay && z == tr.az {
+		return
+	}
+	tr.heard = true
+	tr.ax, tr.ay, tr.az = x, y, z
+	tr.eng.PlaceSoundListener(x, y, z)
+	for _, noise := range tr.noises {
+		if noise != nil {
+			noise.SetLocation(x, y, z)
+		}
+	}
+}
+
+// teleport uses all of the teleport energy in one shot. Teleport only
+// works if the full amount of teleport energy is available and the
+// teleport cooldown, if any, has passed. The trooper stays where it is.
+func (tr *trooper) teleport() bool { return tr.teleportTo(tr.loc()) }
+
+// canTeleport returns true if teleport would succeed right now. There must
+// be a full amount of teleport energy and the cooldown, if any, must be over.
+func (tr *trooper) canTeleport() bool {
+	if tr.teleported && tr.tick-tr.lastTeleportTick < tr.teleCooldownTicks {
+		return false
+	}
+	return tr.teleportEnergy >= tr.temax
+}
+
+// teleportTo is teleport, except that on success the trooper is moved to
+// the given location. The teleport sound is played where the trooper
+// left from and the sound listener follows the trooper to its destination.
+func (tr *trooper) teleportTo(x, y, z float64) bool {
+	if tr.canTeleport() {
+		tr.lastTeleportTick = tr.tick
+		tr.teleported = true
+		tr.playNoise("teleport")
+		tr.teleportEnergy = 0
+		tr.clampEnergy()
+		tr.ready = false
+		tr.part.SetLocation(x, y, z)
+		tr.placeListener(x, y, z)
+		tr.energyChanged()
+		return true
+	}
+	return false
+}
+
+// energy returns the amount of energy available for cloaking and teleporting.
+func (tr *trooper) energy() (teng, tmax, ceng, cmax int) {
+	ce := tr.cloakEnergy
+	switch {
+	case ce > tr.cemax: // can only happens with debugging hooks.
+		ce = tr.cemax
+	case ce < 0:
+		ce = 0
+	}
+	return tr.teleportEnergy, tr.temax, ce, tr.cemax
+}
+
+// setEnergy sets the raw teleport and cloak energy without any checks.
+// Used by debugging hooks. Bad values are fixed by the next clampEnergy.
+func (tr *trooper) setEnergy(teleport, cloak int) {
+	tr.teleportEnergy, tr.cloakEnergy = teleport, cloak
+}
+
+// clampEnergy keeps the teleport and cloak energy between 0 and their
+// maximums.
+func (tr *trooper) clampEnergy() {
+	switch {
+	case tr.teleportEnergy < 0:
+		tr.teleportEnergy = 0
+	case tr.teleportEnergy > tr.temax:
+		tr.teleportEnergy = tr.temax
+	}
+	switch {
+	case tr.cloakEnergy < 0:
+		tr.cloakEnergy = 0
+	case tr.cloakEnergy > tr.cemax:
+		tr.cloakEnergy = tr.cemax
+	}
+}
+
+// energyNormalized returns the teleport and cloak energy as fractions
+// of their maximums between 0 and 1. Used to drive energy based effects.
+func (tr *trooper) energyNormalized() (teleport, cloak float64) {
+	return fraction(tr.teleportEnergy, tr.temax), fraction(tr.cloakEnergy, tr.cemax)
+}
+
+// combinedEnergy returns the teleport and cloak energy together as a
+// single fraction between 0 and 1 for a combined HUD gauge. Each
+// normalized energy is weighted by its maximum, so the larger energy pool
+// has more effect on the gauge. This is the same as the total energy over
+// the total maximum when both energies are in range.
+func (tr *trooper) combinedEnergy() float64 {
+	total := tr.temax + tr.cemax
+	if tr.temax < 0 || tr.cemax < 0 || total <= 0 {
+		return 0
+	}
+	teleport, cloak := tr.energyNormalized()
+	return (teleport*float64(tr.temax) + cloak*float64(tr.cemax)) / float64(total)
+}
+
+// fraction returns amount/max clamped to 0 and 1. A zero max returns 0.
+func fraction(amount, max int) float64 {
+	if max <= 0 {
+		return 0
+	}
+	return math.Max(0, math.Min(1, float64(amount)/float64(max)))
+}
+
+// healthString returns the health as text, eg. "128 / 216", for a text HUD.
+func (tr *trooper) healthString() string {
+	health, _, max := tr.health()
+	return fmt.Sprintf("%d / %d", health, max)
+}
+
+// energyString returns the cloak and teleport energy as text, eg.
+// "Cloak 80% • Teleport Ready", for a text HUD.
+func (tr *trooper) energyString() string {
+	teng, tmax, ceng, cmax := tr.energy()
+	cloak := "Cloak Empty"
+	if ceng > 0 && cmax > 0 {
+		cloak = fmt.Sprintf("Cloak %d%%", ceng*100/cmax)
+	}
+	teleport := "Teleport Ready"
+	if teng < tmax {
+		teleport = fmt.Sprintf("Teleport %d%%", teng*100/tmax)
+	}
+	return cloak + " • " + teleport
+}
+
+// advance is called once each game update. It moves the trooper tick on,
+// which times the teleport cooldown, updates the energy and the regeneration
+// delay, and refreshes the low health warning and health tint.
+func (tr *trooper) advance() {
+	tr.tick++
+	tr.updateEnergy()
+	health, _, max := tr.health()
+	tr.checkCritical(health, max)
+	if tr.healthTint {
+		tr.tint(health, max)
+	}
+}
+
+// updateEnergy refreshes the players available teleport and cloaking
+// energy. It is part of advance and is only called directly by tests.
+func (tr *trooper) updateEnergy() {
+	if tr.energyPaused {
+		return
+	}
+	steps := scaledSteps(&tr.energySteps)
+	if steps <= 0 {
+		return
+	}
+	change := false
+	tr.coolDown(steps)
+
+	// teleport energy increases to max. Fractional gains are kept until
+	// they add up to whole energy units.
+	if tr.teleportEnergy < tr.temax {
+		tr.teleportGain += float64(steps) * tr.teleportRate
+		if gain := int(tr.teleportGain); gain > 0 {
+			tr.teleportGain -= float64(gain)
+			tr.teleportEnergy += gain
+			if tr.teleportEnergy > tr.temax {
+				tr.teleportEnergy = tr.temax
+			}
+			change = true
+		}
+	}
+	if tr.teleportEnergy >= tr.temax && !tr.ready {
+		tr.ready = true
+		tr.teleportReadied()
+	}
+
+	// cloak energy is used until gone, or gained up to max when inverted.
+	switch {
+	case tr.cloaked && tr.cloakInverted:
+		change = true
+		if tr.cloakEnergy += cloakDrain[tr.cloakLevel] * steps; tr.cloakEnergy > tr.cemax {
+			tr.cloakEnergy = tr.cemax
+		}
+	case tr.cloaked:
+		change = true
+		tr.cloakEnergy -= cloakDrain[tr.cloakLevel] * steps
+		if tr.cloakEnergy <= 0 {
+			tr.cloakEnergy = 0
+			tr.cloak(false)
+		}
+	}
+	tr.clampEnergy()
+	if change {
+		tr.energyChanged()
+	}
+}
+
+// setCloakInverted turns on, or off, the powerup where cloaking gains
+// energy at the rate it would normally use it. An inverted cloak stays on
+// until it is turned off.
+func (tr *trooper) setCloakInverted(on bool) { tr.cloakInverted = on }
+
+// setEnergyPaused freezes, or unfreezes, the teleport and cloak energy
+// for cutscenes and pauses. A cloaked trooper stays cloaked while paused.
+func (tr *trooper) setEnergyPaused(paused bool) { tr.energyPaused = paused }
+
+// setTeleportRate changes the teleport energy gained each update. The
+// default is 1. Fractional rates are allowed, for example 0.5 gains one
+// unit of energy every second update. Negative rates are ignored.
+func (tr *trooper) setTeleportRate(rate float64) {
+	if rate >= 0 {
+		tr.teleportRate = rate
+	}
+}
+
+// resetEnergy is called at the start of a level.
+func (tr *trooper) resetEnergy() {
+	tr.teleportEnergy = tr.temax
+	tr.teleportGain = 0
+	tr.ready = true
+	tr.cloakEnergy = 1000
+}
+
+// cellGap controls the space left between rendered cells. The default of 1
+// gives the detailed look and 0 gives a solid looking trooper.
+var cellGap = 1.0
+
+// setCellGap changes the space between rendered cells, see cellGap.
+// Only cells created after the change are affected.
+func setCellGap(gap float64) {
+	switch {
+	case gap < 0:
+		gap = 0
+	case gap > 1:
+		gap = 1
+	}
+	cellGap = gap
+}
+
+// gapped reduces a full size by the given fraction scaled by cellGap.
+func gapped(size, fraction float64) float64 { return size * (1 - fraction*cellGap) }
+
+// trooper
+// ===========================================================================
+// levelShape
+
+// levelShape describes the trooper geometry for a level as the number of
+// cubes along each axis. Each axis needs at least 2 cubes unless the trooper
+// is a single cube.
+type levelShape struct {
+	lvl        int // Game level.
+	nx, ny, nz int // Number of cubes along each axis.
+}
+
+// cubicShape is the default trooper geometry for a given level.
+func cubicShape(level int) levelShape {
+	return levelShape{level, level + 1, level + 1, level + 1}
+}
+
+// single is true for a trooper made of one cube.
+func (ls levelShape) single() bool { return ls.nx <= 1 || ls.ny <= 1 || ls.nz <= 1 }
+
+// cubeSize is the size of one cube where the longest trooper side is 1.
+func (ls levelShape) cubeSize() float64 {
+	n := ls.nx
+	if ls.ny > n {
+		n = ls.ny
+	}
+	if ls.nz > n {
+		n = ls.nz
+	}
+	return 1.0 / float64(n)
 }
 
-// merge collapses all the troopers cubes into a single cube with an
-// optional center cube.  Called when the trooper reaches full health.
-func (tr *trooper) merge() {
-	tr.trash()
-	tr.neo = tr.part.AddPart()
-	tr.neo.SetCullable(false)
-	tr.neo.SetFacade("cube", "flata").SetMaterial("tblue")
-	tr.neo.SetScale(0.5, 0.5, 0.5)
-	tr.addCenter()
+// panelCenters gives the center of each panel in face order, see panelSize.
+func (ls levelShape) panelCenters() [6][3]float64 {
+	centerOffset := ls.cubeSize() * 0.5
+	px, py, pz := float64(ls.nx-1)*centerOffset, float64(ls.ny-1)*centerOffset, float64(ls.nz-1)*centerOffset
+	return [6][3]float64{{px, 0, 0}, {-px, 0, 0}, {0, py, 0}, {0, -py, 0}, {0, 0, pz}, {0, 0, -pz}}
 }
 
-// demerge breaks the troopers single cube into smaller blocks. Expected to
-// be called when a trooper at full health loses health.
-func (tr *trooper) demerge() {
-	tr.trash()
-	tr.addCenter()
-	for _, b := range tr.bits {
-		b.reset(b.box().cmax)
+// eachCube visits the outer cubes of a shape that isn't single in the order
+// they are added to a trooper. Side cubes are given the panel face they
+// belong to. Corner and edge cubes are given a face of -1 and the number of
+// cells they start with. Values that only depend on the outer loops are
+// calculated once per outer loop.
+func (ls levelShape) eachCube(visit func(x, y, z float64, face, newCells int)) {
+	nx, ny, nz := ls.nx-1, ls.ny-1, ls.nz-1 // last cube index.
+	centerOffset := ls.cubeSize() * 0.5
+	mx := float64(-nx)
+	for cx := 0; cx <= nx; cx++ {
+		x, ex := mx*centerOffset, cx == 0 || cx == nx
+		my := float64(-ny)
+		for cy := 0; cy <= ny; cy++ {
+			y, ey := my*centerOffset, cy == 0 || cy == ny
+			mz := float64(-nz)
+			for cz := 0; cz <= nz; cz++ {
+				z, ez := mz*centerOffset, cz == 0 || cz == nz
+				switch {
+				case ex && ey && ez:
+					visit(x, y, z, -1, 1) // corner cube
+				case ex && ey || ex && ez || ey && ez:
+					visit(x, y, z, -1, 2) // edge cube
+				case ex || ey || ez:
+
+					// side cubes are added to a panel.
+					face := 0
+					switch {
+					case cx == nx:
+						face = 0
+					case cx == 0:
+						face = 1
+					case cy == ny:
+						face = 2
+					case cy == 0:
+						face = 3
+					case cz == nz:
+						face = 4
+					case cz == 0:
+						face = 5
+					}
+					visit(x, y, z, face, 0)
+				}
+				mz += 2
+			}
+			my += 2
+		}
+		mx += 2
 	}
-	tr.bits[0].detach()
 }
 
-// trash destroys all the troopers cells.
-func (tr *trooper) trash() {
-	for _, b := range tr.bits {
-		b.trash()
-	}
-	if tr.center != nil {
-		tr.part.RemPart(tr.center)
-		tr.center = nil
+// edgeCubes returns the number of corner and edge cubes.
+func (ls levelShape) edgeCubes() int {
+	if ls.single() {
+		return 1
 	}
-	tr.part.RemPart(tr.neo)
-	tr.neo = nil
+	return 8 + 4*(ls.nx-2) + 4*(ls.ny-2) + 4*(ls.nz-2)
 }
 
-// addCloakEnergy is called to increase the amount of cloaking energy.
-func (tr *trooper) addCloakEnergy() {
-	tr.cloakEnergy += 100
-	if tr.cloakEnergy > tr.cemax {
-		tr.cloakEnergy = tr.cemax
+// panelSize gives the number of cubes along the two panel axes, in x, y, z
+// order, for the given face. Faces 0-5 are +x, -x, +y, -y, +z, -z.
+func (ls levelShape) panelSize(face int) (du, dv int) {
+	if ls.single() {
+		return 0, 0
 	}
-	tr.energyChanged()
+	switch face / 2 {
+	case 0:
+		return ls.ny - 2, ls.nz - 2
+	case 1:
+		return ls.nx - 2, ls.nz - 2
+	}
+	return ls.nx - 2, ls.ny - 2
 }
 
-// cloak toggles the players cloak ability. Cloaking is only enabled if
-// there is sufficient energy.
-func (tr *trooper) cloak(useCloak bool) {
-	if useCloak && tr.cloakEnergy > 0 {
-		tr.cloaked = true
-		tr.eng.PlaceSoundListener(tr.loc())
-		noise := tr.noises["cloak"]
-		noise.SetLocation(tr.loc())
-		noise.Play()
-	} else if !useCloak {
-		tr.cloaked = false
-		tr.eng.PlaceSoundListener(tr.loc())
-		noise := tr.noises["decloak"]
-		noise.SetLocation(tr.loc())
-		noise.Play()
+// levelStats gives the geometry of a cubic trooper for the given level
+// without creating one. Sizes are the number of cubes along one side and
+// maxCores is the number of cells in a full trooper. The single level 0
+// cube is counted as an edge cube.
+func levelStats(level int) (edgeCubes, panels, panelCubeSize, centerSize, maxCores int) {
+	shape := cubicShape(level)
+	if shape.single() {
+		return 1, 0, 0, 0, 8
 	}
+	n := level + 1
+	panelCubeSize, _ = shape.panelSize(0)
+	maxCores = n*n*n*8 - (n-2)*(n-2)*(n-2)*8
+	return shape.edgeCubes(), 6, panelCubeSize, n - 2, maxCores
 }
 
-// teleport uses all of the teleport energy in one shot. Teleport only
-// works if the full amount of teleport energy is available.
-func (tr *trooper) teleport() bool {
-	if tr.teleportEnergy >= tr.temax {
-		tr.eng.PlaceSoundListener(tr.loc())
-		teleportNoise := tr.noises["teleport"]
-		teleportNoise.SetLocation(tr.loc())
-		teleportNoise.Play()
-		tr.teleportEnergy = 0
-		tr.energyChanged()
-		return true
+// coreTotalsCap is the last level kept in the core totals table.
+const coreTotalsCap = 16
+
+// coreTable holds the core totals for levels 0 to coreTotalsCap. It is
+// filled the first time it is needed, see coreTotals.
+var coreTable [coreTotalsCap + 1][3]int
+var coreTableOnce sync.Once
+
+// coreTotals gives the cell counts for a cubic trooper of the given level
+// without creating one. The min is always 0 since all cells can be lost,
+// mid is the level entry health, and max is a full trooper. Levels up to
+// coreTotalsCap are looked up, higher levels are calculated each time.
+func coreTotals(level int) (min, mid, max int) {
+	if level < 0 || level > coreTotalsCap {
+		return countCores(level)
 	}
-	return false
+	coreTableOnce.Do(func() {
+		for lvl := range coreTable {
+			coreTable[lvl][0], coreTable[lvl][1], coreTable[lvl][2] = countCores(lvl)
+		}
+	})
+	totals := coreTable[level]
+	return totals[0], totals[1], totals[2]
 }
 
-// energy returns the amount of energy available for cloaking and teleporting.
-func (tr *trooper) energy() (teng, tmax, ceng, cmax int) {
-	ce := tr.cloakEnergy
-	if ce > tr.cemax { // can only happens with debugging hooks.
-		ce = tr.cemax
+// countCores calculates the coreTotals. At level entry the corner cubes
+// have 1 cell, the other edge cubes 2 cells, and the panel cubes 4 cells.
+func countCores(level int) (min, mid, max int) {
+	if level < 0 {
+		return 0, 0, 0
 	}
-	return tr.teleportEnergy, tr.temax, ce, tr.cemax
+	edgeCubes, _, panelSize, _, max := levelStats(level)
+	if edgeCubes == 1 {
+		return 0, 1, max // the single level 0 cube.
+	}
+	mid = 8 + (edgeCubes-8)*2 + 6*panelSize*panelSize*4
+	return 0, mid, max
 }
 
-// updateEnergy is called on a regular basis to refresh the players available
-// teleport and cloaking energy.
-func (tr *trooper) updateEnergy() {
-	change := false
-
-	// teleport energy increases to max.
-	if tr.teleportEnergy < tr.temax {
-		tr.teleportEnergy += 1
-		change = true
+// levelForCores returns the first level where a full trooper has at least
+// the given number of cells, see levelStats. Levels past the last game
+// level are returned for large counts.
+func levelForCores(cores int) int {
+	if cores <= 8 {
+		return 0 // the single level 0 cube.
 	}
 
-	// cloak energy is used until gone.
-	if tr.cloaked {
-		change = true
-		tr.cloakEnergy -= 4
-		if tr.cloakEnergy <= 0 {
-			tr.cloakEnergy = 0
-			tr.cloak(false)
-		}
+	// A full trooper with n cubes a side has 48(n-1)²+16 cells. Solve for n
+	// and then correct for any rounding. Floats avoid overflow.
+	full := func(n int) float64 { return 48*float64(n-1)*float64(n-1) + 16 }
+	n := int(math.Ceil(1 + math.Sqrt((float64(cores)-16)/48)))
+	for n > 2 && full(n-1) >= float64(cores) {
+		n--
 	}
-	if change {
-		tr.energyChanged()
+	for full(n) < float64(cores) {
+		n++
 	}
+	return n - 1
 }
 
-// resetEnergy is called at the start of a level.
-func (tr *trooper) resetEnergy() {
-	tr.teleportEnergy = tr.temax
-	tr.cloakEnergy = 1000
+// maxReachableLevel returns the highest level whose entry health, the mid
+// value from coreTotals, is covered by the given number of cells. Unlike
+// levelForCores, which needs a full trooper, this is the least needed to
+// start a level. Level 0 is always reachable and the result is capped at
+// coreTotalsCap.
+func maxReachableLevel(totalCores int) int {
+	level := 0
+	for level < coreTotalsCap {
+		if _, mid, _ := coreTotals(level + 1); mid > totalCores {
+			break
+		}
+		level++
+	}
+	return level
 }
 
-// trooper
+// levelShape
 // ===========================================================================
 // box & cbox
 
@@ -370,8 +2513,46 @@ type cbox struct {
 	ccnt, cmax     int     // Number of cells.
 	cx, cy, cz     float64 // Center of the box.
 	csize          float64 // Cell size where each side is the same dimension.
+	shader         string  // Cell shader, either "flata" or "wire".
 	trashc, mergec func()  // Set by super class.
 	addc, remc     func()  // Set by super class.
+	mscale         float64 // Merged size factor, see setMergeScale.
+	shedc          func()  // Optional. Set by super class.
+	nomerge        bool    // Full boxes keep their cells when true.
+	early          bool    // Box can merge before it is full, see panelMerge.
+	shell          bool    // Box is drawn as one part whenever it has cells.
+	alpha          float64 // Transparency of new cells, see trooper.setAlpha.
+}
+
+// panelMerge is the fraction of a panels cells needed before the panel is
+// merged into a single slab. The default of 1 merges full panels. Lower
+// values trade some accuracy for fewer parts.
+var panelMerge = 1.0
+
+// setPanelMerge changes when panels merge, see panelMerge. The fraction is
+// kept between 0.5 and 1. Expected to be set before troopers are created.
+func setPanelMerge(fraction float64) {
+	switch {
+	case fraction < 0.5:
+		fraction = 0.5
+	case fraction > 1:
+		fraction = 1
+	}
+	panelMerge = fraction
+}
+
+// mergeCount returns the number of cells at which the box merges.
+func (c *cbox) mergeCount() int {
+	if c.early && panelMerge < 1 {
+		return int(math.Ceil(panelMerge * float64(c.cmax)))
+	}
+	return c.cmax
+}
+
+// merged returns true if a box with the given number of cells is drawn as
+// a single merged part.
+func (c *cbox) merged(cells int) bool {
+	return cells > 0 && (c.shell || (!c.nomerge && cells >= c.mergeCount()))
 }
 
 // attach adds a cell to the cube, merging the cube when the cube is full.
@@ -380,9 +2561,12 @@ type cbox struct {
 func (c *cbox) attach() bool {
 	if c.ccnt >= 0 && c.ccnt < c.cmax {
 		c.ccnt++ // only spot where this is incremented.
-		if c.ccnt == c.cmax {
+		switch {
+		case c.merged(c.ccnt - 1):
+			// already merged so there is no cell to add.
+		case c.merged(c.ccnt):
 			c.mergec() // c.merge()
-		} else {
+		default:
 			c.addc() // c.addCell()
 		}
 		return true
@@ -395,12 +2579,19 @@ func (c *cbox) attach() bool {
 // an empty cube.
 func (c *cbox) detach() bool {
 	if c.ccnt > 0 && c.ccnt <= c.cmax {
-		if c.ccnt == c.cmax {
-			c.reset(c.cmax - 1)
-		} else {
+		if c.shedc != nil {
+			c.shedc() // c.shedCell()
+		}
+		switch {
+		case c.merged(c.ccnt - 1):
+			// still merged so there is no cell to remove.
+		case c.merged(c.ccnt):
+			c.reset(c.ccnt - 1)
+			return true
+		default:
 			c.remc() // c.removeCell()
-			c.ccnt-- // only spot where this is decremented.
 		}
+		c.ccnt-- // only spot where this is decremented.
 		return true
 	}
 	return false
@@ -428,29 +2619,41 @@ func (c *cbox) box() *cbox { return c }
 // panel groups 0 or more cubes into the center of one of the troopers
 // six sides.
 type panel struct {
-	eng   vu.Engine // Needed to create new cells.
-	part  vu.Part   // Each panel needs its own part.
-	lvl   int       // Used to scale slab.
-	slab  vu.Part   // Un-injured panel is a single piece.
-	cubes []*cube   // An injured panel is made of cubes.
+	eng    vu.Engine // Needed to create new cells.
+	part   vu.Part   // Each panel needs its own part.
+	du, dv int       // Panel size in cubes. Used to scale slab.
+	slab   vu.Part   // Un-injured panel is a single piece.
+	color  string    // Slab material, see setFaceColors.
+	cubes  []*cube   // An injured panel is made of cubes.
+	face   int       // Trooper face, see trooper.panel.
 	cbox
+
+	// slabbed is optionally told when the panel merges into a slab and
+	// when the slab is removed. Set by the trooper.
+	slabbed func(face int, merged bool)
 }
 
 // newPanel creates a panel with no cubes. The cubes are added later using
-// panel.addCube().
-func newPanel(eng vu.Engine, part vu.Part, x, y, z float64, level int) *panel {
+// panel.addCube(). The panel size is given in cubes along the two panel
+// axes in x, y, z order.
+func newPanel(eng vu.Engine, part vu.Part, x, y, z float64, du, dv int) *panel {
 	p := &panel{}
 	p.eng = eng
 	p.part = part.AddPart()
 	p.part.SetCullable(false)
-	p.lvl = level
-	p.cubes = []*cube{}
+	p.du, p.dv = du, dv
+	p.cubes = make([]*cube, 0, du*dv)
 	p.cx, p.cy, p.cz = x, y, z
-	p.ccnt, p.cmax = 0, (level-1)*(level-1)*8
+	p.ccnt, p.cmax = 0, du*dv*8
+	p.shader = "flata"
+	p.mscale = 1
+	p.alpha = 1
+	p.color = "tblue"
 	p.mergec = func() { p.merge() }
 	p.trashc = func() { p.trash() }
 	p.addc = func() { p.addCell() }
 	p.remc = func() { p.removeCell() }
+	p.early = true
 	return p
 }
 
@@ -459,12 +2662,8 @@ func newPanel(eng vu.Engine, part vu.Part, x, y, z float64, level int) *panel {
 func (p *panel) addCube(x, y, z, cubeSize float64) {
 	p.csize = cubeSize
 	c := newCube(p.eng, p.part, x, y, z, p.csize)
-	if (p.cx > p.cy && p.cx > p.cz) || (p.cx < p.cy && p.cx < p.cz) {
-		c.panelSort(1, 0, 0, 4)
-	} else if (p.cy > p.cx && p.cy > p.cz) || (p.cy < p.cx && p.cy < p.cz) {
-		c.panelSort(0, 1, 0, 4)
-	} else if (p.cz > p.cx && p.cz > p.cy) || (p.cz < p.cx && p.cz < p.cy) {
-		c.panelSort(0, 0, 1, 4)
+	if rx, ry, rz, ok := panelAxis(p.cx, p.cy, p.cz); ok {
+		c.panelSort(rx, ry, rz, 4)
 	}
 	if c != nil {
 		p.ccnt += 4
@@ -472,17 +2671,47 @@ func (p *panel) addCube(x, y, z, cubeSize float64) {
 	}
 }
 
+// panelAxis returns the axis that points out of the panel with the given
+// center. Panel cube cells are sorted along this axis. False is returned
+// for a center that isn't on a single axis.
+func panelAxis(x, y, z float64) (rx, ry, rz float64, ok bool) {
+	switch {
+	case (x > y && x > z) || (x < y && x < z):
+		return 1, 0, 0, true
+	case (y > x && y > z) || (y < x && y < z):
+		return 0, 1, 0, true
+	case (z > x && z > y) || (z < x && z < y):
+		return 0, 0, 1, true
+	}
+	return 0, 0, 0, false
+}
+
 // addCell adds cells so that the new cells are spread amongst the panels cubes.
 func (p *panel) addCell() {
+	if c := p.nextCube(); c != nil {
+		c.attach()
+		return
+	}
+	log.Printf("pc:panel addCell should never reach here. %d %d", p.ccnt, p.cmax)
+}
+
+// nextCube returns the cube that gets the next added cell. Cells are spread
+// evenly amongst the panels cubes. Nil is returned if all cubes are full.
+func (p *panel) nextCube() *cube {
+	return p.nextCubeAfter(func(c *cube) int { return c.ccnt })
+}
+
+// nextCubeAfter is nextCube where the cube cell counts are given by cells.
+// This allows cells to be added without changing the cubes.
+func (p *panel) nextCubeAfter(cells func(c *cube) int) *cube {
 	for addeven := 0; addeven < p.cubes[0].cmax; addeven++ {
 		for _, c := range p.cubes {
-			if c.ccnt <= addeven {
-				c.attach()
-				return
+			if cells(c) <= addeven {
+				return c
 			}
 		}
 	}
-	log.Printf("pc:panel addCell should never reach here. %d %d", p.ccnt, p.cmax)
+	return nil
 }
 
 // removeCell takes a piece out of a panel.
@@ -495,34 +2724,75 @@ func (p *panel) removeCell() {
 	log.Printf("pc:panel removeCell should never reach here.")
 }
 
-// merge turns all the cubes into a single panel.
+// merge turns all the cubes into a single panel. Slabs are not gapped
+// since they cover the whole panel in both the detailed and solid looks.
 func (p *panel) merge() {
-	p.trash()
-	size := p.csize * 0.5
+	hadSlab := p.clear()
+	size := p.csize * 0.5 * p.mscale
 	p.slab = p.part.AddPart()
 	p.slab.SetCullable(false)
-	p.slab.SetFacade("cube", "flata").SetMaterial("tblue")
-	scale := float64(p.lvl-1) * size
+	safeFacade(p.slab, "cube", p.shader, p.color)
+	fadePart(p.slab, p.alpha)
+	su, sv := float64(p.du)*size, float64(p.dv)*size
 	p.slab.SetLocation(p.cx, p.cy, p.cz)
 	if (p.cx > p.cy && p.cx > p.cz) || (p.cx < p.cy && p.cx < p.cz) {
-		p.slab.SetScale(size, scale, scale)
+		p.slab.SetScale(size, su, sv)
 	} else if (p.cy > p.cx && p.cy > p.cz) || (p.cy < p.cx && p.cy < p.cz) {
-		p.slab.SetScale(scale, size, scale)
+		p.slab.SetScale(su, size, sv)
 	} else if (p.cz > p.cx && p.cz > p.cy) || (p.cz < p.cx && p.cz < p.cy) {
-		p.slab.SetScale(scale, scale, size)
+		p.slab.SetScale(su, sv, size)
+	}
+	if !hadSlab && p.slabbed != nil {
+		p.slabbed(p.face, true) // a remerge to redraw the slab isn't news.
+	}
+}
+
+// setShader changes the shader for the panel and its cubes.
+func (p *panel) setShader(shader string) {
+	p.shader = shader
+	if p.slab != nil {
+		p.slab.SetFacade("cube", shader)
+	}
+	for _, c := range p.cubes {
+		c.setShader(shader)
+	}
+}
+
+// borders returns true if the given edge cube is on the same side of the
+// trooper as the panel.
+func (p *panel) borders(c *cube) bool {
+	near := c.csize * 0.5
+	switch {
+	case p.cx != 0:
+		return c.cx*p.cx > 0 && math.Abs(c.cx-p.cx) < near
+	case p.cy != 0:
+		return c.cy*p.cy > 0 && math.Abs(c.cy-p.cy) < near
+	case p.cz != 0:
+		return c.cz*p.cz > 0 && math.Abs(c.cz-p.cz) < near
 	}
+	return false
 }
 
 // trash clears any visible parts from the panel. It is up to calling methods
 // to ensure the cell count is correct.
 func (p *panel) trash() {
+	if p.clear() && p.slabbed != nil {
+		p.slabbed(p.face, false)
+	}
+}
+
+// clear removes the slab and the cube cells. Returns true if there was
+// a slab.
+func (p *panel) clear() (hadSlab bool) {
 	if p.slab != nil {
 		p.part.RemPart(p.slab)
 		p.slab = nil
+		hadSlab = true
 	}
 	for _, cube := range p.cubes {
 		cube.reset(0)
 	}
+	return hadSlab
 }
 
 // panel
@@ -532,101 +2802,530 @@ func (p *panel) trash() {
 // cube is the building block for troopers and panels. Cube takes a size
 // and location and creates an 8 part cube out of it. Cubes can be queried
 // as to their current number of cells which is between 0 (nothing visible),
-// 1-7 (partial) and 8 (merged).
+// 1-7 (partial) and 8 (merged). Cubes can also be subdivided into more
+// cells, see newCubeN.
 type cube struct {
 	eng     vu.Engine // Needed to create new cells.
 	part    vu.Part   // For the merged cube.
-	cells   []vu.Part // Max 8 cells per cube.
+	cells   []vu.Part // Max subdiv^3 cells per cube.
+	pool    []vu.Part // Hidden cells kept for reuse.
 	centers csort     // Precalculated center location of each cell.
+	subdiv  int       // Number of cells along each side.
+	sorter  func()    // Last sort applied to the centers, if any.
+	color   string    // Cell material, see setColor.
 	cbox
+
+	// grow optionally sizes new cells. Set by the trooper.
+	grow func(cell vu.Part, scale float64)
+
+	// shed is optionally told about each detached cell. Set by the trooper.
+	shed func(center *lin.V3, scale float64)
+}
+
+// newCube's are often started with cube size of 1 corner, 2 edges,
+// or 4 bottom side pieces.
+func newCube(eng vu.Engine, part vu.Part, x, y, z, cubeSize float64) *cube {
+	return newCubeN(eng, part, x, y, z, cubeSize, 2)
+}
+
+// newCubeN creates a cube that is split into subdiv cells along each side
+// for a total of subdiv^3 cells. A subdiv of 2 gives the normal 8 cell cube.
+func newCubeN(eng vu.Engine, part vu.Part, x, y, z, cubeSize float64, subdiv int) *cube {
+	if subdiv < 1 {
+		subdiv = 1
+	}
+	c := &cube{}
+	c.eng = eng
+	c.part = part.AddPart()
+	c.part.SetCullable(false)
+	c.cells = make([]vu.Part, 0, subdiv*subdiv*subdiv)
+	c.cx, c.cy, c.cz, c.csize = x, y, z, cubeSize
+	c.subdiv = subdiv
+	c.ccnt, c.cmax = 0, subdiv*subdiv*subdiv
+	c.shader = "flata"
+	c.mscale = 1
+	c.alpha = 1
+	c.color = "tgreen"
+	c.mergec = func() { c.merge() }
+	c.trashc = func() { c.trash() }
+	c.addc = func() { c.addCell() }
+	c.remc = func() { c.removeCell() }
+	c.shedc = func() { c.shedCell() }
+	c.calcCenters()
+	return c
+}
+
+// calcCenters calculates the cell center locations (unsorted). The centers
+// share one backing array to keep the allocations down for large troopers.
+func (c *cube) calcCenters() {
+	points := make([]lin.V3, 0, c.subdiv*c.subdiv*c.subdiv)
+	c.centers = make(csort, 0, cap(points))
+	hs := c.cellHalf()
+	start := -c.csize*0.5 + hs
+	for ix := 0; ix < c.subdiv; ix++ {
+		for iy := 0; iy < c.subdiv; iy++ {
+			for iz := 0; iz < c.subdiv; iz++ {
+				dx, dy, dz := start+float64(ix)*2*hs, start+float64(iy)*2*hs, start+float64(iz)*2*hs
+				points = append(points, lin.V3{c.cx + dx, c.cy + dy, c.cz + dz})
+				c.centers = append(c.centers, &points[len(points)-1])
+			}
+		}
+	}
+}
+
+// resize changes the cube size. The cell centers are recalculated and
+// sorted as before, and the existing cells are moved to match.
+func (c *cube) resize(size float64) {
+	c.csize = size
+	c.calcCenters()
+	if c.sorter != nil {
+		c.sorter()
+	}
+	if c.merged(c.ccnt) {
+		scale := c.mergedScale()
+		c.cells[0].SetScale(scale, scale, scale)
+		return
+	}
+	scale := gapped(c.cellHalf(), 0.2)
+	for cnt, cell := range c.cells {
+		center := c.centers[cnt]
+		cell.SetLocation(center.X, center.Y, center.Z)
+		cell.SetScale(scale, scale, scale)
+	}
+}
+
+// cellHalf is half the width of a single cell.
+func (c *cube) cellHalf() float64 { return c.csize * 0.5 / float64(c.subdiv) }
+
+// edgeSort arranges the edge pieces so that cubes are added or removed in cube
+// like looking pieces.
+func (c *cube) edgeSort(startCount int) {
+	c.sorter = func() { sort.Sort(c.centers) }
+	c.sorter()
+	c.reset(startCount)
+}
+
+// panelSort sorts cubes based on which panel they are in. Needed for orderly
+// addition/removal of cubes.
+func (c *cube) panelSort(rx, ry, rz float64, startCount int) {
+	c.sorter = func() { sort.Sort(&ssort{c.centers, rx, ry, rz}) }
+	c.sorter()
+	c.reset(startCount)
+}
+
+// nextCellCenter returns the location where the next cell will be attached.
+// False is returned if the cube is full.
+func (c *cube) nextCellCenter() (*lin.V3, bool) {
+	if c.ccnt < 0 || c.ccnt >= c.cmax {
+		return nil, false
+	}
+	return c.centers[c.ccnt], true
+}
+
+// toMerge returns the number of cells needed to fill, and so merge, the
+// cube. Full cubes return 0.
+func (c *cube) toMerge() int { return c.cmax - c.ccnt }
+
+// shedCell passes the location and size of the cell about to be
+// detached to the shed hook, if any.
+func (c *cube) shedCell() {
+	if c.shed != nil && c.ccnt > 0 {
+		c.shed(c.centers[c.ccnt-1], gapped(c.cellHalf(), 0.2))
+	}
+}
+
+// cellPoolSize is the maximum number of hidden cells kept by each cube.
+const cellPoolSize = 4
+
+// addCell adds a new cell to the cube. A previously removed cell is
+// reused when available.
+func (c *cube) addCell() {
+	var cell vu.Part
+	if last := len(c.pool) - 1; last >= 0 {
+		cell = c.pool[last]
+		c.pool = c.pool[:last]
+		cell.SetVisible(true)
+	} else {
+		cell = c.part.AddPart()
+		cell.SetCullable(false)
+		safeFacade(cell, "cube", c.shader, c.color)
+		fadePart(cell, c.alpha)
+	}
+	center := c.centers[c.ccnt-1]
+	cell.SetLocation(center.X, center.Y, center.Z)
+	scale := gapped(c.cellHalf(), 0.2) // leave a gap.
+	if c.grow != nil {
+		c.grow(cell, scale)
+	} else {
+		cell.SetScale(scale, scale, scale)
+	}
+	c.cells = append(c.cells, cell)
+}
+
+// setShader changes the shader for the current and future cube cells.
+func (c *cube) setShader(shader string) {
+	c.shader = shader
+	for _, cell := range c.cells {
+		cell.SetFacade("cube", shader)
+	}
+	for _, cell := range c.pool {
+		cell.SetFacade("cube", shader)
+	}
+}
+
+// mergedScale is the size of the single merged cube cell.
+func (c *cube) mergedScale() float64 {
+	return gapped(c.csize*0.5, 0.15) * c.mscale // leave a gap.
+}
+
+// setMergeScale changes the merged cube size, see mergedScale. An already
+// merged cube is resized.
+func (c *cube) setMergeScale(factor float64) {
+	c.mscale = factor
+	if c.merged(c.ccnt) && len(c.cells) == 1 {
+		scale := c.mergedScale()
+		c.cells[0].SetScale(scale, scale, scale)
+	}
+}
+
+// setColor changes the material for the current and future cube cells.
+func (c *cube) setColor(material string) {
+	if c.color == material {
+		return
+	}
+	c.color = material
+	for _, cell := range c.cells {
+		safeFacade(cell, "cube", c.shader, material)
+	}
+	for _, cell := range c.pool {
+		safeFacade(cell, "cube", c.shader, material)
+	}
+}
+
+// consistent returns true if the number of cells matches the number of
+// rendered cells. A full cube is rendered as one merged cell unless
+// merging is disabled. A shell only cube with cells is always one cell.
+func (c *cube) consistent() bool {
+	switch {
+	case c.ccnt == 0:
+		return len(c.cells) == 0
+	case c.merged(c.ccnt):
+		return len(c.cells) == 1
+	case c.ccnt > 0 && c.ccnt <= c.cmax:
+		return len(c.cells) == c.ccnt
+	}
+	return false
+}
+
+// partCount returns the number of parts expected for the current number
+// of cells. A full cube is rendered as a single part unless merging is disabled.
+// A shell only cube with cells is always a single part.
+func (c *cube) partCount() int {
+	if c.merged(c.ccnt) {
+		return 1
+	}
+	return c.ccnt
+}
+
+// removeCell removes the last cell from the list of cube cells. The cell
+// is hidden and kept for reuse if there is room in the pool.
+func (c *cube) removeCell() {
+	last := len(c.cells)
+	cell := c.cells[last-1]
+	if len(c.pool) < cellPoolSize {
+		cell.SetVisible(false)
+		c.pool = append(c.pool, cell)
+	} else {
+		c.part.RemPart(cell)
+	}
+	c.cells = c.cells[:last-1]
+}
+
+// merge removes all cells and replaces them with a single cube. Expected
+// to only be called by attach. The c.ccnt should be c.cmax before and after
+// merge is called.
+func (c *cube) merge() {
+	c.trash()
+	cell := c.part.AddPart()
+	cell.SetCullable(false)
+	safeFacade(cell, "cube", c.shader, c.color)
+	fadePart(cell, c.alpha)
+	cell.SetLocation(c.cx, c.cy, c.cz)
+	scale := c.mergedScale()
+	cell.SetScale(scale, scale, scale)
+	c.cells = append(c.cells, cell)
+}
+
+// removes all visible cube parts.
+func (c *cube) trash() {
+	for len(c.cells) > 0 {
+		c.removeCell()
+	}
+}
+
+// cube
+// ===========================================================================
+// cellSpawnAnimation
+
+// cellSpawnAnimation grows a newly attached cell from a small size
+// to its final size.
+type cellSpawnAnimation struct {
+	cell  vu.Part // Newly attached cell.
+	scale float64 // Final cell scale.
+	ticks int     // Animation run rate - number of animation steps.
+	tkcnt int     // Current step.
+	state int     // Track progress 0:start, 1:run, 2:done.
+}
+
+// Animate is called each game loop while the animation is active.
+func (ca *cellSpawnAnimation) Animate(dt float64) bool {
+	switch ca.state {
+	case 0:
+		ca.resize(0.1)
+		ca.state = 1
+		return true
+	case 1:
+		if ca.tkcnt >= ca.ticks {
+			ca.Wrap()
+			return false // animation done.
+		}
+		ca.tkcnt += 1
+		ca.resize(0.1 + 0.9*float64(ca.tkcnt)/float64(ca.ticks))
+		return true
+	default:
+		return false // animation done.
+	}
+}
+
+// Wrap ensures the cell ends up at its final size.
+func (ca *cellSpawnAnimation) Wrap() {
+	ca.cell.SetScale(ca.scale, ca.scale, ca.scale)
+	ca.state = 2
+}
+
+// resize sets the cell to the given fraction of its final size.
+func (ca *cellSpawnAnimation) resize(fraction float64) {
+	size := ca.scale * fraction
+	ca.cell.SetScale(size, size, size)
+}
+
+// cellSpawnAnimation
+// ===========================================================================
+// scatterAnimation
+
+// scatterAnimation moves a lost cell away from the trooper while fading
+// it out. The cell is removed when the animation finishes.
+type scatterAnimation struct {
+	parent vu.Part // Owner of the cell.
+	cell   vu.Part // Copy of the lost cell.
+	dir    lin.V3  // Outward direction, the cells trooper local location.
+	ticks  int     // Animation run rate - number of animation steps.
+	tkcnt  int     // Current step.
+	state  int     // Track progress 0:start, 1:run, 2:done.
+}
+
+// Animate is called each game loop while the animation is active.
+func (sa *scatterAnimation) Animate(dt float64) bool {
+	switch sa.state {
+	case 0:
+		sa.state = 1
+		return true
+	case 1:
+		if sa.tkcnt >= sa.ticks {
+			sa.Wrap()
+			return false // animation done.
+		}
+		sa.tkcnt += 1
+		x, y, z := sa.cell.Location()
+		step := 2 / float64(sa.ticks) // move twice the cells distance.
+		sa.cell.SetLocation(x+sa.dir.X*step, y+sa.dir.Y*step, z+sa.dir.Z*step)
+		sa.cell.SetAlpha(1 - float64(sa.tkcnt)/float64(sa.ticks))
+		return true
+	default:
+		return false // animation done.
+	}
+}
+
+// Wrap removes the scattered cell.
+func (sa *scatterAnimation) Wrap() {
+	if sa.state != 2 {
+		sa.state = 2
+		sa.parent.RemPart(sa.cell)
+	}
+}
+
+// scatterAnimation
+// ===========================================================================
+// scaleAnimation
+
+// newScaleAnimation creates an animation that eases the trooper from one
+// scale to another over the given number of ticks.
+func (tr *trooper) newScaleAnimation(from, to float64, ticks int) animation {
+	return &scaleAnimation{tr: tr, from: from, to: to, ticks: ticks}
+}
+
+// scaleAnimation smoothly changes the trooper size.
+type scaleAnimation struct {
+	tr       *trooper // Trooper being scaled.
+	from, to float64  // Start and end scale.
+	ticks    int      // Animation run rate - number of animation steps.
+	tkcnt    int      // Current step.
+	state    int      // Track progress 0:start, 1:run, 2:done.
+}
+
+// Animate is called each game loop while the animation is active.
+func (sa *scaleAnimation) Animate(dt float64) bool {
+	switch sa.state {
+	case 0:
+		sa.tr.setScale(sa.from)
+		sa.state = 1
+		return true
+	case 1:
+		if sa.tkcnt >= sa.ticks {
+			sa.Wrap()
+			return false // animation done.
+		}
+		sa.tkcnt += 1
+		t := float64(sa.tkcnt) / float64(sa.ticks)
+		ease := t * t * (3 - 2*t) // slow at both ends.
+		sa.tr.setScale(sa.from + (sa.to-sa.from)*ease)
+		return true
+	default:
+		return false // animation done.
+	}
 }
 
-// newCube's are often started with cube size of 1 corner, 2 edges,
-// or 4 bottom side pieces.
-func newCube(eng vu.Engine, part vu.Part, x, y, z, cubeSize float64) *cube {
-	c := &cube{}
-	c.eng = eng
-	c.part = part.AddPart()
-	c.part.SetCullable(false)
-	c.cells = []vu.Part{}
-	c.cx, c.cy, c.cz, c.csize = x, y, z, cubeSize
-	c.ccnt, c.cmax = 0, 8
-	c.mergec = func() { c.merge() }
-	c.trashc = func() { c.trash() }
-	c.addc = func() { c.addCell() }
-	c.remc = func() { c.removeCell() }
+// Wrap ensures the trooper ends up at its final scale.
+func (sa *scaleAnimation) Wrap() {
+	sa.tr.setScale(sa.to)
+	sa.state = 2
+}
+
+// scaleAnimation
+// ===========================================================================
+// criticalAnimation
+
+// criticalAnimation pulses the transparency of the troopers cells to warn
+// that the trooper is almost out of cells. It runs until it is wrapped.
+type criticalAnimation struct {
+	tr    *trooper // Trooper that is warning.
+	ticks int      // Animation run rate - number of steps for one pulse.
+	tkcnt int      // Current step.
+	state int      // Track progress 0:start, 1:run, 2:done.
+}
 
-	// calculate the cell center locations (unsorted)
-	qs := c.csize * 0.25
-	c.centers = csort{
-		&lin.V3{x - qs, y - qs, z - qs},
-		&lin.V3{x - qs, y - qs, z + qs},
-		&lin.V3{x - qs, y + qs, z - qs},
-		&lin.V3{x - qs, y + qs, z + qs},
-		&lin.V3{x + qs, y - qs, z - qs},
-		&lin.V3{x + qs, y - qs, z + qs},
-		&lin.V3{x + qs, y + qs, z - qs},
-		&lin.V3{x + qs, y + qs, z + qs},
+// Animate is called each game loop while the animation is active.
+func (ca *criticalAnimation) Animate(dt float64) bool {
+	switch ca.state {
+	case 0:
+		ca.state = 1
+		return true
+	case 1:
+		ca.tkcnt = (ca.tkcnt + 1) % ca.ticks
+		pulse := 0.5 - 0.5*math.Cos(2*math.Pi*float64(ca.tkcnt)/float64(ca.ticks))
+		ca.tr.setAlpha(1 - 0.6*pulse)
+		return true
+	default:
+		return false // animation done.
 	}
-	return c
 }
 
-// edgeSort arranges the edge pieces so that cubes are added or removed in cube
-// like looking pieces.
-func (c *cube) edgeSort(startCount int) {
-	sort.Sort(c.centers)
-	c.reset(startCount)
+// Wrap stops the warning and restores the cells.
+func (ca *criticalAnimation) Wrap() {
+	if ca.state != 2 {
+		ca.state = 2
+		ca.tr.setAlpha(1)
+	}
+	if ca.tr.critical == ca {
+		ca.tr.critical = nil
+	}
 }
 
-// panelSort sorts cubes based on which panel they are in. Needed for orderly
-// addition/removal of cubes.
-func (c *cube) panelSort(rx, ry, rz float64, startCount int) {
-	sorter := &ssort{c.centers, rx, ry, rz}
-	sort.Sort(sorter)
-	c.reset(startCount)
+// criticalAnimation
+// ===========================================================================
+// shakeAnimation
+
+// shakeIntensity scales how much the trooper shakes when it is damaged.
+// The default is 1 and 0 turns shaking off.
+var shakeIntensity = 1.0
+
+// setShake turns the damage shake on or off and sets its intensity, which
+// is kept between 0 and 2.
+func setShake(on bool, intensity float64) {
+	switch {
+	case !on || intensity < 0:
+		intensity = 0
+	case intensity > 2:
+		intensity = 2
+	}
+	shakeIntensity = intensity
 }
 
-// addCell creates and adds a new cell to the cube.
-func (c *cube) addCell() {
-	cell := c.part.AddPart()
-	cell.SetCullable(false)
-	cell.SetFacade("cube", "flata").SetMaterial("tgreen")
-	center := c.centers[c.ccnt-1]
-	cell.SetLocation(center.X, center.Y, center.Z)
-	scale := c.csize * 0.20 // leave a gap (0.25 for no gap).
-	cell.SetScale(scale, scale, scale)
-	c.cells = append(c.cells, cell)
+// newShakeAnimation shakes the trooper in proportion to the number of cells
+// lost. Nil is returned if shaking is turned off. Nil is also returned when
+// the trooper is already shaking, in which case the running shake is
+// restarted so that the trooper still returns to where it was.
+func (tr *trooper) newShakeAnimation(loss int) animation {
+	if shakeIntensity <= 0 || loss <= 0 {
+		return nil
+	}
+	_, size, _ := tr.part.Scale()
+	amount := size * 0.02 * shakeIntensity * math.Min(float64(loss), 10)
+	if sa := tr.shaking; sa != nil {
+		sa.amount = math.Max(sa.amount, amount)
+		sa.tkcnt = 0
+		return nil
+	}
+	tr.shaking = &shakeAnimation{tr: tr, amount: amount, ticks: 20}
+	return tr.shaking
 }
 
-// removeCell removes the last cell from the list of cube cells.
-func (c *cube) removeCell() {
-	last := len(c.cells)
-	c.part.RemPart(c.cells[last-1])
-	c.cells = c.cells[:last-1]
+// shakeAnimation jiggles the trooper by a decreasing random amount and
+// then puts it back exactly where it was.
+type shakeAnimation struct {
+	tr      *trooper // Trooper being shaken.
+	amount  float64  // Largest offset, reduced each step.
+	x, y, z float64  // Location before the shake.
+	ticks   int      // Animation run rate - number of animation steps.
+	tkcnt   int      // Current step.
+	state   int      // Track progress 0:start, 1:run, 2:done.
 }
 
-// merge removes all cells and replaces them with a single cube. Expected
-// to only be called by attach. The c.ccnt should be c.cmax before and after
-// merge is called.
-func (c *cube) merge() {
-	c.trash()
-	cell := c.part.AddPart()
-	cell.SetCullable(false)
-	cell.SetFacade("cube", "flata").SetMaterial("tgreen")
-	cell.SetLocation(c.cx, c.cy, c.cz)
-	scale := (c.csize - (c.csize * 0.15)) * 0.5 // leave a gap (just c.csize for no gap)
-	cell.SetScale(scale, scale, scale)
-	c.cells = append(c.cells, cell)
+// Animate is called each game loop while the animation is active.
+func (sa *shakeAnimation) Animate(dt float64) bool {
+	switch sa.state {
+	case 0:
+		sa.x, sa.y, sa.z = sa.tr.loc()
+		sa.state = 1
+		return true
+	case 1:
+		if sa.tkcnt >= sa.ticks {
+			sa.Wrap()
+			return false // animation done.
+		}
+		sa.tkcnt += 1
+		offset := sa.amount * (1 - float64(sa.tkcnt)/float64(sa.ticks))
+		dx := offset * (rand.Float64()*2 - 1)
+		dy := offset * (rand.Float64()*2 - 1)
+		sa.tr.setLoc(sa.x+dx, sa.y+dy, sa.z)
+		return true
+	default:
+		return false // animation done.
+	}
 }
 
-// removes all visible cube parts.
-func (c *cube) trash() {
-	for len(c.cells) > 0 {
-		c.removeCell()
+// Wrap returns the trooper to where it was before the shake.
+func (sa *shakeAnimation) Wrap() {
+	if sa.state == 1 {
+		sa.tr.setLoc(sa.x, sa.y, sa.z)
+	}
+	sa.state = 2
+	if sa.tr.shaking == sa {
+		sa.tr.shaking = nil
 	}
 }
 
-// cube
+// shakeAnimation
 // ===========================================================================
 // csort
 
@@ -635,26 +3334,39 @@ func (c *cube) trash() {
 // removed last are those closest to the center.
 //
 // A reference point is necessary since the origin gets too far away for
-// a flat panel to orient the quads properly.
+// a flat panel to orient the quads properly. Quadrants that are the same
+// distance away are ordered by their coordinates so that the order is
+// always the same.
 type csort []*lin.V3 // list of quadrant centers.
 
 func (c csort) Len() int               { return len(c) }
 func (c csort) Swap(i, j int)          { c[i], c[j] = c[j], c[i] }
-func (c csort) Less(i, j int) bool     { return c.Dtoc(c[i]) < c.Dtoc(c[j]) }
 func (c csort) Dtoc(v *lin.V3) float64 { return v.X*v.X + v.Y*v.Y + v.Z*v.Z }
+func (c csort) Less(i, j int) bool {
+	if di, dj := c.Dtoc(c[i]), c.Dtoc(c[j]); di != dj {
+		return di < dj
+	}
+	return coordsLess(c[i], c[j])
+}
 
 // ssort is used to sort the panel cube quadrants so that the quadrants
 // to the inside origin plane are first in the list. A reference normal is
 // necessary since the panels get large enough that the points on the
-// "outside" get picked up due to the angle.
+// "outside" get picked up due to the angle. Ties are broken by coordinates
+// as with csort.
 type ssort struct {
 	c       []*lin.V3 // list of quadrant centers.
 	x, y, z float64   // reference plane.
 }
 
-func (s ssort) Len() int           { return len(s.c) }
-func (s ssort) Swap(i, j int)      { s.c[i], s.c[j] = s.c[j], s.c[i] }
-func (s ssort) Less(i, j int) bool { return s.Dtoc(s.c[i]) < s.Dtoc(s.c[j]) }
+func (s ssort) Len() int      { return len(s.c) }
+func (s ssort) Swap(i, j int) { s.c[i], s.c[j] = s.c[j], s.c[i] }
+func (s ssort) Less(i, j int) bool {
+	if di, dj := s.Dtoc(s.c[i]), s.Dtoc(s.c[j]); di != dj {
+		return di < dj
+	}
+	return coordsLess(s.c[i], s.c[j])
+}
 func (s ssort) Dtoc(v *lin.V3) float64 {
 	normal := &lin.V3{s.x, s.y, s.z}
 	dot := v.Dot(normal)
@@ -664,37 +3376,221 @@ func (s ssort) Dtoc(v *lin.V3) float64 {
 	return dx*dx + dy*dy + dz*dz
 }
 
+// coordsLess orders points by x, then y, then z. Used to break sort ties.
+func coordsLess(a, b *lin.V3) bool {
+	switch {
+	case a.X != b.X:
+		return a.X < b.X
+	case a.Y != b.Y:
+		return a.Y < b.Y
+	}
+	return a.Z < b.Z
+}
+
 // csort
 // ===========================================================================
 // healthMonitor
 
+// withoutId returns the monitor ids with the given id removed. Monitor ids
+// are kept alongside the monitor maps so that monitors are notified in the
+// order they were added.
+func withoutId(ids []string, id string) []string {
+	for cnt, existing := range ids {
+		if existing == id {
+			return append(ids[:cnt], ids[cnt+1:]...)
+		}
+	}
+	return ids
+}
+
 // healthMonitor is used to monitor troopers cell count changes.
 type healthMonitor interface {
 	healthUpdated(health, high, warn int) // called when cells are added or lost.
 }
 
-// monitorHealth adds a monitor for trooper health changes.
-func (tr *trooper) monitorHealth(id string, mon healthMonitor) {
+// monitorHealth adds a monitor for trooper health changes. True is returned
+// if the monitor replaced an existing monitor with the same id.
+func (tr *trooper) monitorHealth(id string, mon healthMonitor) (replaced bool) {
+	tr.mlock.Lock()
+	defer tr.mlock.Unlock()
 	if tr.hms == nil {
 		tr.hms = make(map[string]healthMonitor)
 	}
+	if _, replaced = tr.hms[id]; !replaced {
+		tr.hids = append(tr.hids, id)
+	}
 	tr.hms[id] = mon
+	return replaced
+}
+
+// hasHealthMonitor returns true if there is a health monitor with the
+// given id. Used to check that an id is free before monitoring.
+func (tr *trooper) hasHealthMonitor(id string) bool {
+	tr.mlock.RLock()
+	defer tr.mlock.RUnlock()
+	_, ok := tr.hms[id]
+	return ok
 }
 
 // ignoreHealth removes a monitor.
 func (tr *trooper) ignoreHealth(id string) {
+	tr.mlock.Lock()
+	defer tr.mlock.Unlock()
 	if tr.hms != nil {
 		delete(tr.hms, id)
+		tr.hids = withoutId(tr.hids, id)
 	}
 }
 
-// healthChanged is called to notify all monitors.
+// healthChanged is called to notify all monitors. Level monitors are
+// notified the first time the win condition is met. Death monitors are
+// notified the first time all the cells are lost.
 func (tr *trooper) healthChanged(health, mid, max int) {
-	if tr.hms != nil {
-		for _, monitor := range tr.hms {
-			monitor.healthUpdated(health, mid, max)
+	tr.mlock.RLock()
+	hms := make([]healthMonitor, 0, len(tr.hms))
+	for _, id := range tr.hids {
+		hms = append(hms, tr.hms[id])
+	}
+	lms := make([]levelMonitor, 0, len(tr.lms))
+	for _, id := range tr.lids {
+		lms = append(lms, tr.lms[id])
+	}
+	dms := make([]deathMonitor, 0, len(tr.dms))
+	for _, id := range tr.dids {
+		dms = append(dms, tr.dms[id])
+	}
+	tr.mlock.RUnlock()
+	tr.telemetry()
+	tr.checkCritical(health, max)
+	if tr.healthTint {
+		tr.tint(health, max)
+	}
+	for _, monitor := range hms {
+		monitor.healthUpdated(health, mid, max)
+	}
+	if !tr.complete && tr.wins(health, mid, max) {
+		tr.complete = true
+		for _, monitor := range lms {
+			monitor.levelCompleted()
+		}
+	}
+	if !tr.dead && health == 0 {
+		tr.dead = true
+		for _, monitor := range dms {
+			monitor.died()
+		}
+	}
+}
+
+// damageMonitor can optionally be implemented by health monitors that
+// want to know about cells lost to damage.
+type damageMonitor interface {
+	tookDamage(loss int) // called with the number of cells lost, including shield cells.
+}
+
+// damageTaken notifies the health monitors that are also damage monitors.
+func (tr *trooper) damageTaken(loss int) {
+	if loss <= 0 {
+		return
+	}
+	tr.mlock.RLock()
+	dms := []damageMonitor{}
+	for _, id := range tr.hids {
+		if dm, ok := tr.hms[id].(damageMonitor); ok {
+			dms = append(dms, dm)
+		}
+	}
+	tr.mlock.RUnlock()
+	for _, monitor := range dms {
+		monitor.tookDamage(loss)
+	}
+}
+
+// panelStateMonitor can optionally be implemented by health monitors that
+// want to know when a trooper face turns solid or breaks up again.
+type panelStateMonitor interface {
+	panelMerged(face int)   // called when the panel becomes a single slab.
+	panelDemerged(face int) // called when the panel slab is removed.
+}
+
+// panelChanged notifies the health monitors that are also panel state
+// monitors. Faces are numbered as in trooper.panel.
+func (tr *trooper) panelChanged(face int, merged bool) {
+	if tr.panelsQuiet {
+		return
+	}
+	tr.mlock.RLock()
+	pms := []panelStateMonitor{}
+	for _, id := range tr.hids {
+		if pm, ok := tr.hms[id].(panelStateMonitor); ok {
+			pms = append(pms, pm)
+		}
+	}
+	tr.mlock.RUnlock()
+	for _, monitor := range pms {
+		if merged {
+			monitor.panelMerged(face)
+		} else {
+			monitor.panelDemerged(face)
+		}
+	}
+}
+
+// quietPanels holds panel state notifications while the trooper cells are
+// redrawn. Redrawing trashes and remerges the panels, which isn't news.
+// The returned function ends the redraw and reports only the faces whose
+// slab came or went. Expected to be deferred right away.
+func (tr *trooper) quietPanels() (done func()) {
+	if tr.panelsQuiet {
+		return func() {} // already held by an outer redraw.
+	}
+	before := tr.slabbedFaces()
+	tr.panelsQuiet = true
+	return func() {
+		tr.panelsQuiet = false
+		for face, merged := range tr.slabbedFaces() {
+			if merged != before[face] {
+				tr.panelChanged(face, merged)
+			}
+		}
+	}
+}
+
+// slabbedFaces returns true for each face whose panel is drawn solid,
+// either as a slab or as part of the merged trooper.
+func (tr *trooper) slabbedFaces() (slabbed [6]bool) {
+	for face := range slabbed {
+		if p, ok := tr.panel(face); ok {
+			slabbed[face] = p.slab != nil || (tr.neo != nil && p.cmax > 0)
+		}
+	}
+	return slabbed
+}
+
+// scoreMonitor can optionally be implemented by health monitors that
+// keep score.
+type scoreMonitor interface {
+	scored(delta int) // called with the points for cells gained by attach.
+}
+
+// scored notifies the health monitors that are also score monitors about
+// the points for the given number of gained cells, see cellPoints.
+func (tr *trooper) scored(cells int) {
+	if cells <= 0 || tr.cellPoints == nil {
+		return
+	}
+	points := cells * tr.cellPoints(tr.lvl)
+	tr.mlock.RLock()
+	sms := []scoreMonitor{}
+	for _, id := range tr.hids {
+		if sm, ok := tr.hms[id].(scoreMonitor); ok {
+			sms = append(sms, sm)
 		}
 	}
+	tr.mlock.RUnlock()
+	for _, monitor := range sms {
+		monitor.scored(points)
+	}
 }
 
 // healthMonitor
@@ -706,26 +3602,458 @@ type energyMonitor interface {
 	energyUpdated(teleportEnergy, tmax, cloakEnergy, cmax int) // called when cells are added or lost.
 }
 
-// monitorEnergy adds a monitor for trooper energy changes.
-func (tr *trooper) monitorEnergy(id string, mon energyMonitor) {
+// monitorEnergy adds a monitor for trooper energy changes. True is returned
+// if the monitor replaced an existing monitor with the same id.
+func (tr *trooper) monitorEnergy(id string, mon energyMonitor) (replaced bool) {
+	tr.mlock.Lock()
+	defer tr.mlock.Unlock()
 	if tr.ems == nil {
 		tr.ems = make(map[string]energyMonitor)
 	}
+	if _, replaced = tr.ems[id]; !replaced {
+		tr.eids = append(tr.eids, id)
+	}
 	tr.ems[id] = mon
+	return replaced
 }
 
 // ignoreEnergy removes a monitor.
 func (tr *trooper) ignoreEnergy(id string) {
+	tr.mlock.Lock()
+	defer tr.mlock.Unlock()
 	if tr.ems != nil {
 		delete(tr.ems, id)
+		tr.eids = withoutId(tr.eids, id)
 	}
 }
 
 // energyChanged is called to notify all monitors.
 func (tr *trooper) energyChanged() {
-	if tr.ems != nil {
-		for _, monitor := range tr.ems {
-			monitor.energyUpdated(tr.energy())
+	tr.telemetry()
+	for _, monitor := range tr.energyMonitors() {
+		monitor.energyUpdated(tr.energy())
+	}
+}
+
+// energyMonitors returns a copy of the current energy monitors so that
+// they can be notified without holding the lock.
+func (tr *trooper) energyMonitors() []energyMonitor {
+	tr.mlock.RLock()
+	defer tr.mlock.RUnlock()
+	ems := make([]energyMonitor, 0, len(tr.ems))
+	for _, id := range tr.eids {
+		ems = append(ems, tr.ems[id])
+	}
+	return ems
+}
+
+// teleportMonitor can optionally be implemented by energy monitors that
+// want to know when teleporting becomes possible.
+type teleportMonitor interface {
+	teleportReady() // called once each time teleport energy refills.
+}
+
+// teleportReadied notifies the energy monitors that are also
+// teleport monitors.
+func (tr *trooper) teleportReadied() {
+	for _, monitor := range tr.energyMonitors() {
+		if tm, ok := monitor.(teleportMonitor); ok {
+			tm.teleportReady()
+		}
+	}
+}
+
+// energyMonitor
+// ===========================================================================
+// levelMonitor
+
+// levelMonitor is used to monitor when the trooper completes a level.
+type levelMonitor interface {
+	levelCompleted() // called once when the win condition is first met.
+}
+
+// monitorLevel adds a monitor for level completion.
+func (tr *trooper) monitorLevel(id string, mon levelMonitor) {
+	tr.mlock.Lock()
+	defer tr.mlock.Unlock()
+	if tr.lms == nil {
+		tr.lms = make(map[string]levelMonitor)
+	}
+	if _, ok := tr.lms[id]; !ok {
+		tr.lids = append(tr.lids, id)
+	}
+	tr.lms[id] = mon
+}
+
+// ignoreLevel removes a monitor.
+func (tr *trooper) ignoreLevel(id string) {
+	tr.mlock.Lock()
+	defer tr.mlock.Unlock()
+	if tr.lms != nil {
+		delete(tr.lms, id)
+		tr.lids = withoutId(tr.lids, id)
+	}
+}
+
+// levelMonitor
+// ===========================================================================
+// deathMonitor
+
+// deathMonitor is used to monitor when the trooper loses all its cells.
+type deathMonitor interface {
+	died() // called once when health reaches zero, until the next reset.
+}
+
+// monitorDeath adds a monitor for trooper death.
+func (tr *trooper) monitorDeath(id string, mon deathMonitor) {
+	tr.mlock.Lock()
+	defer tr.mlock.Unlock()
+	if tr.dms == nil {
+		tr.dms = make(map[string]deathMonitor)
+	}
+	if _, ok := tr.dms[id]; !ok {
+		tr.dids = append(tr.dids, id)
+	}
+	tr.dms[id] = mon
+}
+
+// ignoreDeath removes a monitor.
+func (tr *trooper) ignoreDeath(id string) {
+	tr.mlock.Lock()
+	defer tr.mlock.Unlock()
+	if tr.dms != nil {
+		delete(tr.dms, id)
+		tr.dids = withoutId(tr.dids, id)
+	}
+}
+
+// deathMonitor
+// ===========================================================================
+// trooperState
+
+// trooperState is a snapshot of a troopers health and energy. It can be used
+// to restore a trooper or to share the trooper over a network.
+type trooperState struct {
+	lvl            int   // Trooper level.
+	teleportEnergy int   // Teleport energy.
+	cloakEnergy    int   // Cloak energy.
+	ccnt           []int // Cell count for each of the trooper bits.
+}
+
+// snapshot captures the troopers current state.
+func (tr *trooper) snapshot() trooperState {
+	s := trooperState{lvl: tr.lvl, teleportEnergy: tr.teleportEnergy, cloakEnergy: tr.cloakEnergy}
+	s.ccnt = make([]int, len(tr.bits))
+	for cnt, b := range tr.bits {
+		s.ccnt[cnt] = b.box().ccnt
+	}
+	return s
+}
+
+// restore sets the trooper to a previously captured state. The state must
+// be from a trooper of the same level.
+func (tr *trooper) restore(s trooperState) error {
+	if s.lvl != tr.lvl || len(s.ccnt) != len(tr.bits) {
+		return fmt.Errorf("trooper.restore: level %d state for level %d trooper", s.lvl, tr.lvl)
+	}
+	defer tr.quietPanels()()
+	tr.trash()
+	tr.addCenter()
+	for cnt, b := range tr.bits {
+		b.reset(s.ccnt[cnt])
+	}
+	tr.syncCenter()
+	health, mid, max := tr.health()
+	if tr.filled() && !tr.mergeDisabled {
+		tr.merge()
+	}
+	tr.teleportEnergy, tr.cloakEnergy = s.teleportEnergy, s.cloakEnergy
+	tr.healthChanged(health, mid, max)
+	tr.energyChanged()
+	return nil
+}
+
+// MarshalBinary encodes the trooper state as a sequence of varints:
+// level, teleport energy, cloak energy, number of cell counts, cell counts.
+func (s trooperState) MarshalBinary() ([]byte, error) {
+	values := append([]int{s.lvl, s.teleportEnergy, s.cloakEnergy, len(s.ccnt)}, s.ccnt...)
+	data := make([]byte, len(values)*binary.MaxVarintLen64)
+	size := 0
+	for _, value := range values {
+		size += binary.PutVarint(data[size:], int64(value))
+	}
+	return data[:size], nil
+}
+
+// UnmarshalBinary decodes a trooper state created by MarshalBinary.
+// An error is returned for truncated or corrupt data.
+func (s *trooperState) UnmarshalBinary(data []byte) error {
+	next := func() (int, error) {
+		value, size := binary.Varint(data)
+		if size <= 0 {
+			return 0, errors.New("trooperState: truncated or corrupt data")
+		}
+		data = data[size:]
+		return int(value), nil
+	}
+	var err error
+	var count int
+	state := trooperState{}
+	for _, value := range []*int{&state.lvl, &state.teleportEnergy, &state.cloakEnergy, &count} {
+		if *value, err = next(); err != nil {
+			return err
+		}
+	}
+	if count < 0 || count > len(data) { // each cell count uses at least one byte.
+		return fmt.Errorf("trooperState: invalid cell count length %d", count)
+	}
+	state.ccnt = make([]int, count)
+	for cnt := range state.ccnt {
+		if state.ccnt[cnt], err = next(); err != nil {
+			return err
+		}
+	}
+	if len(data) > 0 {
+		return fmt.Errorf("trooperState: %d unexpected trailing bytes", len(data))
+	}
+	*s = state
+	return nil
+}
+
+// cellDelta is the change in cell count for one of the trooper bits.
+type cellDelta struct {
+	bit    int // Index of the trooper bit.
+	change int // Cells gained, or lost when negative.
+}
+
+// diffTrooper returns the cell count changes needed to go from state a to
+// state b. Nothing is returned if the states are for different levels.
+func diffTrooper(a, b trooperState) []cellDelta {
+	if a.lvl != b.lvl || len(a.ccnt) != len(b.ccnt) {
+		return nil
+	}
+	deltas := []cellDelta{}
+	for cnt := range a.ccnt {
+		if change := b.ccnt[cnt] - a.ccnt[cnt]; change != 0 {
+			deltas = append(deltas, cellDelta{cnt, change})
+		}
+	}
+	return deltas
+}
+
+// applyDeltas changes the troopers cell counts by the given deltas. A full
+// trooper is split before it loses cells and merged if it ends up full.
+// Monitors are notified once. Deltas for unknown bits are ignored.
+func applyDeltas(tr *trooper, deltas []cellDelta) {
+	if len(deltas) == 0 {
+		return
+	}
+	defer tr.quietPanels()()
+	if tr.neo != nil {
+		tr.split()
+	}
+	for _, delta := range deltas {
+		if delta.bit < 0 || delta.bit >= len(tr.bits) {
+			log.Printf("trooper.applyDeltas: invalid bit %d", delta.bit)
+			continue
+		}
+		b := tr.bits[delta.bit]
+		target := b.box().ccnt + delta.change
+		switch {
+		case target < 0:
+			target = 0
+		case target > b.box().cmax:
+			target = b.box().cmax
+		}
+		b.reset(target)
+	}
+	health, mid, max := tr.health()
+	if tr.filled() && !tr.mergeDisabled {
+		tr.merge()
+	}
+	tr.record("applyDeltas")
+	tr.healthChanged(health, mid, max)
+}
+
+// visualHash returns a hash of everything that changes how the trooper is
+// drawn: the cells in each bit, the merged trooper, the center, the shield,
+// and the trooper scale and rotation. Renderers can skip troopers whose hash
+// hasn't changed. The same trooper state always gives the same hash.
+func (tr *trooper) visualHash() uint64 {
+	h := fnv.New64a()
+	buf := make([]byte, 8)
+	add := func(value uint64) {
+		binary.LittleEndian.PutUint64(buf, value)
+		h.Write(buf)
+	}
+	flag := func(on bool) uint64 {
+		if on {
+			return 1
+		}
+		return 0
+	}
+	add(uint64(tr.lvl))
+	for _, b := range tr.bits {
+		add(uint64(b.box().ccnt))
+	}
+	add(flag(tr.neo != nil))
+	add(flag(tr.center != nil && tr.center.Visible()))
+	add(uint64(len(tr.shields)))
+	sx, sy, sz := tr.part.Scale()
+	qx, qy, qz, qw := tr.part.Rotation()
+	for _, value := range []float64{sx, sy, sz, qx, qy, qz, qw} {
+		add(math.Float64bits(value))
+	}
+	return h.Sum64()
+}
+
+// trooperState
+// ===========================================================================
+// trooperView
+
+// trooperView is a read only view of a trooper built from a trooperState.
+// It needs no engine, so UI and network code can look at a trooper, like
+// one being spectated, without any risk of changing it. The view assumes
+// a cubic trooper with the default merging and spacing.
+type trooperView struct {
+	state    trooperState // Copy of the viewed state.
+	maxes    []int        // Maximum cells for each trooper bit.
+	mid, max int          // Level entry and full health.
+}
+
+// newTrooperView creates a view of the given state. The state is copied
+// so later changes to it don't affect the view.
+func newTrooperView(state trooperState) *trooperView {
+	tv := &trooperView{state: state}
+	tv.state.ccnt = append([]int{}, state.ccnt...)
+	_, tv.mid, tv.max = coreTotals(state.lvl)
+	shape := cubicShape(state.lvl)
+	if shape.single() {
+		tv.maxes = []int{8}
+		return tv
+	}
+	for face := 0; face < 6; face++ {
+		du, dv := shape.panelSize(face)
+		tv.maxes = append(tv.maxes, du*dv*8)
+	}
+	for cnt := 0; cnt < shape.edgeCubes(); cnt++ {
+		tv.maxes = append(tv.maxes, 8)
+	}
+	return tv
+}
+
+// level returns the viewed troopers level.
+func (tv *trooperView) level() int { return tv.state.lvl }
+
+// health returns the cell count, the level entry cell count, and the
+// maximum cell count like trooper.health.
+func (tv *trooperView) health() (health, mid, max int) {
+	for _, cells := range tv.state.ccnt {
+		health += cells
+	}
+	return health, tv.mid, tv.max
+}
+
+// energy returns the teleport and cloak energy like trooper.energy.
+func (tv *trooperView) energy() (teng, tmax, ceng, cmax int) {
+	ceng = tv.state.cloakEnergy
+	switch {
+	case ceng > maxEnergy:
+		ceng = maxEnergy
+	case ceng < 0:
+		ceng = 0
+	}
+	return tv.state.teleportEnergy, maxEnergy, ceng, maxEnergy
+}
+
+// healthSegments returns the number of cells in each trooper bit, see
+// trooper.healthSegments.
+func (tv *trooperView) healthSegments() []int { return append([]int{}, tv.state.ccnt...) }
+
+// maxSegments returns the maximum cells for each of the healthSegments.
+func (tv *trooperView) maxSegments() []int { return append([]int{}, tv.maxes...) }
+
+// cellBounds returns the bounds of each cell like trooper.cellBounds does
+// for a trooper at the origin with a scale of 1. The cells are placed as
+// they would be for a trooper restored from the viewed state.
+func (tv *trooperView) cellBounds() []cellBound {
+	bounds := []cellBound{}
+	add := func(x, y, z, half float64) {
+		bounds = append(bounds, cellBound{lin.V3{x, y, z}, half})
+	}
+	addCube := func(c *cube, cells int) {
+		if cells >= c.cmax {
+			add(c.cx, c.cy, c.cz, c.csize*0.5)
+			return
+		}
+		for _, v := range c.centers[:cells] {
+			add(v.X, v.Y, v.Z, c.cellHalf())
+		}
+	}
+	if health, _, max := tv.health(); health >= max {
+		add(0, 0, 0, 0.5) // merged trooper.
+		return bounds
+	}
+	shape := cubicShape(tv.state.lvl)
+	if shape.single() {
+		c := viewCube(0, 0, 0, 1)
+		sort.Sort(c.centers)
+		addCube(c, tv.state.ccnt[0])
+		return bounds
+	}
+
+	// recreate the cube cell centers in trooper order.
+	panels := make([][]*cube, 6)
+	edges := []*cube{}
+	centers := shape.panelCenters()
+	shape.eachCube(func(x, y, z float64, face, newCells int) {
+		c := viewCube(x, y, z, shape.cubeSize())
+		if face < 0 {
+			sort.Sort(c.centers)
+			edges = append(edges, c)
+			return
+		}
+		if rx, ry, rz, ok := panelAxis(centers[face][0], centers[face][1], centers[face][2]); ok {
+			sort.Sort(&ssort{c.centers, rx, ry, rz})
+		}
+		panels[face] = append(panels[face], c)
+	})
+	for face, cubes := range panels {
+		cells := tv.state.ccnt[face]
+		if cells > 0 && cells >= tv.maxes[face] {
+			for _, c := range cubes {
+				add(c.cx, c.cy, c.cz, c.csize*0.5) // merged panel.
+			}
+			continue
+		}
+
+		// panel cells are spread evenly amongst the cubes, see panel.nextCube.
+		counts := make([]int, len(cubes))
+		for ; cells > 0; cells-- {
+			next := 0
+			for cnt := range counts {
+				if counts[cnt] < counts[next] {
+					next = cnt
+				}
+			}
+			counts[next]++
+		}
+		for cnt, c := range cubes {
+			addCube(c, counts[cnt])
 		}
 	}
+	for cnt, c := range edges {
+		addCube(c, tv.state.ccnt[6+cnt])
+	}
+	return bounds
+}
+
+// viewCube creates a cube that only has its cell centers. It can't be
+// drawn and is only used to find where cells would be, see cube.calcCenters.
+func viewCube(x, y, z, size float64) *cube {
+	c := &cube{subdiv: 2}
+	c.cx, c.cy, c.cz, c.csize = x, y, z, size
+	c.cmax = 8
+	c.calcCenters()
+	return c
 }
@@ -0,0 +1,2558 @@
+// Copyright © 2013 Galvanized Logic Inc.
+// Use is governed by a FreeBSD license found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"vu"
+	"vu/audio"
+	"vu/math/lin"
+)
+
+func TestDetachFace(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	before, _, _ := tr.health()
+	if removed := tr.detachFace(0, 2); removed != 2 {
+		t.Errorf("Expected 2 cells removed, got %d", removed)
+	}
+	if tr.bits[0].box().ccnt != 2 || tr.bits[1].box().ccnt != 4 {
+		t.Errorf("Expected 2 and 4 cells, got %d %d", tr.bits[0].box().ccnt, tr.bits[1].box().ccnt)
+	}
+
+	// an empty panel loses cells from its edges: 4 corners and 4 edges.
+	if removed := tr.detachFace(0, 100); removed != 14 {
+		t.Errorf("Expected 14 cells removed, got %d", removed)
+	}
+	if tr.bits[1].box().ccnt != 4 {
+		t.Errorf("Expected opposite panel unchanged, got %d", tr.bits[1].box().ccnt)
+	}
+	if after, _, _ := tr.health(); after != before-16 {
+		t.Errorf("Expected health %d, got %d", before-16, after)
+	}
+	if removed := tr.detachFace(6, 1); removed != 0 {
+		t.Errorf("Expected invalid face to be ignored, got %d", removed)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	for level := 0; level < 5; level++ {
+		tr := newTrooper(nil, &testPart{}, level)
+		tr.teleportEnergy, tr.cloakEnergy = 250*level, 1000-level
+		tr.detachFace(level%6, level)
+		s1 := tr.snapshot()
+		data, err := s1.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Level %d failed to marshal %s", level, err)
+		}
+		s2 := trooperState{}
+		if err = s2.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Level %d failed to unmarshal %s", level, err)
+		}
+		if !reflect.DeepEqual(s1, s2) {
+			t.Errorf("Level %d expected %v, got %v", level, s1, s2)
+		}
+		if err = s2.UnmarshalBinary(data[:len(data)-1]); err == nil {
+			t.Errorf("Level %d expected truncated data error", level)
+		}
+	}
+}
+
+func TestStateCorruptData(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for cnt := 0; cnt < 10000; cnt++ {
+		data := make([]byte, random.Intn(64))
+		random.Read(data)
+		s := trooperState{}
+		s.UnmarshalBinary(data) // must not panic.
+	}
+}
+
+func TestMinimapColor(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	if r, g, b := tr.minimapColor(); r != 1 || g != 1 || b != 0 {
+		t.Errorf("Expected yellow at mid health, got %f %f %f", r, g, b)
+	}
+	health, mid, max := tr.health()
+	for ; health < max; health++ {
+		tr.attach()
+	}
+	if r, g, b := tr.minimapColor(); r != 0 || g != 1 || b != 0 {
+		t.Errorf("Expected green at full health, got %f %f %f", r, g, b)
+	}
+	tr.detachCores(max - mid/2)
+	if r, g, b := tr.minimapColor(); r != 1 || g <= 0 || g >= 1 || b != 0 {
+		t.Errorf("Expected orange below mid health, got %f %f %f", r, g, b)
+	}
+	tr.detachCores(max)
+	if r, g, b := tr.minimapColor(); r != 1 || g != 0 || b != 0 {
+		t.Errorf("Expected red at no health, got %f %f %f", r, g, b)
+	}
+}
+
+func TestLevelComplete(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	_, mid, _ := tr.health()
+	tr.winWhen = func(health, mid, max int) bool { return health >= mid+2 }
+	lm := &testLevelMonitor{}
+	tr.monitorLevel("test", lm)
+	tr.attach()
+	if lm.completed != 0 || tr.isComplete() {
+		t.Errorf("Expected level not complete at %d", mid+1)
+	}
+	tr.attach()
+	if lm.completed != 1 || !tr.isComplete() {
+		t.Errorf("Expected level complete at %d", mid+2)
+	}
+	tr.detach()
+	tr.attach()
+	tr.attach()
+	if lm.completed != 1 {
+		t.Errorf("Expected one completion, got %d", lm.completed)
+	}
+	tr.reset()
+	tr.attach()
+	tr.attach()
+	if lm.completed != 2 {
+		t.Errorf("Expected completion after reset, got %d", lm.completed)
+	}
+}
+
+// testLevelMonitor counts level completions.
+type testLevelMonitor struct{ completed int }
+
+func (lm *testLevelMonitor) levelCompleted() { lm.completed++ }
+
+func TestHealthLevels(t *testing.T) {
+	for level := 0; level < 5; level++ {
+		tr := newTrooper(nil, &testPart{}, level)
+		health, mid, max := tr.health()
+		if mid <= 0 || max <= 0 || mid > max || health != mid {
+			t.Errorf("Level %d unexpected health %d mid %d max %d", level, health, mid, max)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 0)
+	buf := &bytes.Buffer{}
+	tr.recordTo(buf)
+	for cnt := 1; cnt < 8; cnt++ {
+		tr.tick = cnt
+		tr.attach()
+	}
+	tr.tick = 8
+	tr.detach()
+	tr.tick = 9
+	tr.detachCores(2)
+	tr.recordTo(nil)
+	tr.attach()
+	expected := "1 attach 2/8\n2 attach 3/8\n3 attach 4/8\n4 attach 5/8\n5 attach 6/8\n" +
+		"6 attach 7/8\n7 merge 8/8\n7 attach 8/8\n8 demerge 7/8\n8 detach 7/8\n9 detachCores 5/8\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s got\n%s", expected, buf.String())
+	}
+}
+
+func TestCellSpawn(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 0)
+	tr.ani = &animator{}
+	tr.animateCells = true
+	tr.attach()
+	c := tr.bits[0].(*cube)
+	cell := c.cells[len(c.cells)-1]
+	target := c.csize * 0.20
+	last, _, _ := cell.Scale()
+	for len(tr.ani.animations) > 0 {
+		tr.ani.animate(0.02)
+		size, _, _ := cell.Scale()
+		if size < last {
+			t.Errorf("Expected cell to grow, got %f after %f", size, last)
+		}
+		last = size
+	}
+	if last != target {
+		t.Errorf("Expected final scale %f, got %f", target, last)
+	}
+}
+
+func TestNextAttachPoint(t *testing.T) {
+	c := newCube(nil, &testPart{}, 0, 0, 0, 1)
+	c.edgeSort(1)
+	center, ok := c.nextCellCenter()
+	c.attach()
+	x, y, z := c.cells[len(c.cells)-1].Location()
+	if !ok || center.X != x || center.Y != y || center.Z != z {
+		t.Errorf("Expected cell at %v, got %f %f %f", center, x, y, z)
+	}
+	c.reset(c.cmax)
+	if _, ok := c.nextCellCenter(); ok {
+		t.Errorf("Expected no room in a full cube")
+	}
+
+	// the trooper next attach point is where the next cell appears.
+	tr := newTrooper(nil, &testPart{}, 3)
+	for cnt := 0; cnt < 10; cnt++ {
+		center, ok := tr.nextAttachPoint()
+		if !ok {
+			t.Fatalf("Expected room in the trooper")
+		}
+		before := map[vu.Part]bool{}
+		for _, c := range tr.cubes() {
+			for _, cell := range c.cells {
+				before[cell] = true
+			}
+		}
+		tr.attach()
+		found := false
+		for _, c := range tr.cubes() {
+			for _, cell := range c.cells {
+				if x, y, z := cell.Location(); !before[cell] && x == center.X && y == center.Y && z == center.Z {
+					found = true
+				}
+			}
+		}
+		if !found {
+			t.Errorf("Expected new cell at %v", center)
+		}
+	}
+}
+
+func TestAttachCores(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	health, _, max := tr.health()
+	if added := tr.attachCores(max); added != max-health {
+		t.Errorf("Expected %d cells added, got %d", max-health, added)
+	}
+	if !tr.fullHealth() {
+		t.Errorf("Expected a full trooper to merge")
+	}
+	if added := tr.attachCores(1); added != 0 {
+		t.Errorf("Expected nothing added to a full trooper, got %d", added)
+	}
+}
+
+func TestCellGap(t *testing.T) {
+	defer setCellGap(1)
+	c := newCube(nil, &testPart{}, 0, 0, 0, 1)
+	c.edgeSort(1)
+	if size, _, _ := c.cells[0].Scale(); size != 0.20 {
+		t.Errorf("Expected detailed cell scale 0.20, got %f", size)
+	}
+	setCellGap(0)
+	c.reset(1)
+	if size, _, _ := c.cells[0].Scale(); size != 0.25 {
+		t.Errorf("Expected solid cell scale 0.25, got %f", size)
+	}
+	c.reset(c.cmax)
+	if size, _, _ := c.cells[0].Scale(); size != 0.5 {
+		t.Errorf("Expected solid cube scale 0.5, got %f", size)
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Errorf("Expected new trooper integrity, got %s", err)
+	}
+	tr.attachCores(20)
+	tr.detachFace(3, 5)
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Errorf("Expected damaged trooper integrity, got %s", err)
+	}
+	tr.attachCores(1000)
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Errorf("Expected merged trooper integrity, got %s", err)
+	}
+
+	// leak a cell into a trooper that should only have the merged cube.
+	c := tr.cubes()[0]
+	c.cells = append(c.cells, c.part.AddPart())
+	if err := tr.verifyIntegrity(); err == nil {
+		t.Errorf("Expected leaked part to be reported")
+	}
+}
+
+func TestTeleportReady(t *testing.T) {
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	tr.temax = 10
+	tr.noises["teleport"] = &testSound{}
+	em := &testEnergyMonitor{}
+	tr.monitorEnergy("test", em)
+	for cnt := 0; cnt < 20; cnt++ {
+		tr.updateEnergy()
+	}
+	if em.ready != 1 {
+		t.Errorf("Expected one teleport ready, got %d", em.ready)
+	}
+	if !tr.teleport() {
+		t.Errorf("Expected teleport with full energy")
+	}
+	for cnt := 0; cnt < 20; cnt++ {
+		tr.updateEnergy()
+	}
+	if em.ready != 2 {
+		t.Errorf("Expected teleport ready after teleport, got %d", em.ready)
+	}
+}
+
+// testEnergyMonitor counts teleport ready events.
+type testEnergyMonitor struct{ ready int }
+
+func (em *testEnergyMonitor) energyUpdated(teleportEnergy, tmax, cloakEnergy, cmax int) {}
+func (em *testEnergyMonitor) teleportReady()                                            { em.ready++ }
+
+// testEngine is a minimal stand in for the engine.
+type testEngine struct {
+	vu.Engine
+	places  int     // Number of PlaceSoundListener calls.
+	x, y, z float64 // Last sound listener location.
+}
+
+func (eng *testEngine) PlaceSoundListener(x, y, z float64) {
+	eng.places++
+	eng.x, eng.y, eng.z = x, y, z
+}
+
+// testSound is a minimal stand in for engine sounds.
+type testSound struct {
+	audio.SoundMaker
+	plays   int
+	stops   int
+	x, y, z float64
+}
+
+func (ts *testSound) SetLocation(x, y, z float64) { ts.x, ts.y, ts.z = x, y, z }
+func (ts *testSound) Play()                       { ts.plays++ }
+func (ts *testSound) Stop()                       { ts.stops++ }
+
+func TestTrooperShape(t *testing.T) {
+	shape := levelShape{lvl: 2, nx: 4, ny: 3, nz: 5}
+	tr := newTrooperShape(nil, &testPart{}, shape)
+	for face := 0; face < 6; face++ {
+		du, dv := shape.panelSize(face)
+		if tr.bits[face].box().cmax != du*dv*8 {
+			t.Errorf("Face %d expected %d cells, got %d", face, du*dv*8, tr.bits[face].box().cmax)
+		}
+	}
+	if edges := len(tr.bits) - 6; edges != shape.edgeCubes() {
+		t.Errorf("Expected %d edge cubes, got %d", shape.edgeCubes(), edges)
+	}
+	tr.attachCores(10000)
+	if _, _, max := tr.health(); max != 4*3*5*8-2*1*3*8 {
+		t.Errorf("Expected %d cells, got %d", 4*3*5*8-2*1*3*8, max)
+	}
+	if err := tr.verifyIntegrity(); err != nil || !tr.fullHealth() {
+		t.Errorf("Expected full trooper, got %v", err)
+	}
+}
+
+func TestInvulnerable(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.setInvulnerable(true)
+	before, _, _ := tr.health()
+	tr.detachCores(5)
+	tr.detach()
+	if after, _, _ := tr.health(); after != before {
+		t.Errorf("Expected health %d, got %d", before, after)
+	}
+	tr.attach()
+	if after, _, _ := tr.health(); after != before+1 {
+		t.Errorf("Expected health %d, got %d", before+1, after)
+	}
+	tr.reset()
+	if !tr.invulnerable {
+		t.Error("Expected invulnerable to survive reset")
+	}
+}
+
+func TestScaleAnimation(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	ani := tr.newScaleAnimation(200, 100, 8)
+	last := 201.0
+	for ani.Animate(0.02) {
+		scale, _, _ := tr.part.Scale()
+		if scale > last {
+			t.Errorf("Expected decreasing scale, got %f after %f", scale, last)
+		}
+		last = scale
+	}
+	if scale, _, _ := tr.part.Scale(); scale != 100 {
+		t.Errorf("Expected final scale 100, got %f", scale)
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	before, _, _ := tr.health()
+	cubes := tr.cubes()
+	added := make([]int, len(cubes))
+	for cnt, c := range cubes {
+		added[cnt] = c.part.(*testPart).added
+	}
+	tr.prewarm()
+	if after, _, _ := tr.health(); after != before {
+		t.Errorf("Expected health %d, got %d", before, after)
+	}
+	for cnt, c := range cubes {
+		if c.part.(*testPart).added == added[cnt] {
+			t.Errorf("Expected cube %d to add a part", cnt)
+		}
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCellBounds(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.setScale(10)
+	tr.setLoc(100, 5, -20)
+	c := tr.bits[6].(*cube)
+	local := c.centers[0]
+	found := false
+	for _, cb := range tr.cellBounds() {
+		if cb.center.X == 100+local.X*10 && cb.center.Y == 5+local.Y*10 && cb.center.Z == -20+local.Z*10 {
+			found = true
+			if cb.half != c.csize*0.25*10 {
+				t.Errorf("Expected half width %f, got %f", c.csize*0.25*10, cb.half)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected a cell at the cubes first cell center")
+	}
+	if health, _, _ := tr.health(); len(tr.cellBounds()) != health {
+		t.Errorf("Expected %d bounds, got %d", health, len(tr.cellBounds()))
+	}
+}
+
+func TestTeleportCooldown(t *testing.T) {
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	tr.noises["teleport"] = &testSound{}
+	tr.teleCooldownTicks = 10
+	tr.resetEnergy()
+	if !tr.teleport() {
+		t.Fatal("Expected first teleport to work")
+	}
+	tr.tick += 5
+	tr.resetEnergy()
+	if tr.teleport() {
+		t.Error("Expected teleport during cooldown to be refused")
+	}
+	tr.tick += 5
+	if !tr.teleport() {
+		t.Error("Expected teleport after cooldown to work")
+	}
+}
+
+func TestDemergeTo(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.attachCores(10000)
+	if tr.neo == nil {
+		t.Fatal("Expected a merged trooper")
+	}
+	_, _, max := tr.health()
+	tr.detachCores(1)
+	if health, _, _ := tr.health(); health != max-1 || tr.neo != nil {
+		t.Errorf("Expected detailed trooper with %d cells, got %d", max-1, health)
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+	tr.attach()
+	tr.detachCores(5)
+	if health, _, _ := tr.health(); health != max-5 {
+		t.Errorf("Expected %d cells, got %d", max-5, health)
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMonitorRace(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	done := make(chan bool)
+	go func() {
+		for cnt := 0; cnt < 100; cnt++ {
+			id := []string{"a", "b", "c"}[cnt%3]
+			tr.monitorHealth(id, &testHealthMonitor{})
+			tr.monitorEnergy(id, &testEnergyMonitor{})
+			tr.monitorLevel(id, &testLevelMonitor{})
+			tr.ignoreHealth(id)
+			tr.ignoreEnergy(id)
+			tr.ignoreLevel(id)
+		}
+		done <- true
+	}()
+	for cnt := 0; cnt < 100; cnt++ {
+		tr.healthChanged(tr.health())
+		tr.energyChanged()
+		tr.teleportReadied()
+	}
+	<-done
+}
+
+// testHealthMonitor counts health updates.
+type testHealthMonitor struct{ updates int }
+
+func (hm *testHealthMonitor) healthUpdated(health, high, warn int) { hm.updates++ }
+
+func TestMonitorCollision(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	first, second := &testHealthMonitor{}, &testHealthMonitor{}
+	if tr.hasHealthMonitor("hud") || tr.monitorHealth("hud", first) {
+		t.Errorf("Expected a new health monitor")
+	}
+	if !tr.hasHealthMonitor("hud") || !tr.monitorHealth("hud", second) {
+		t.Errorf("Expected the second health monitor to be reported as a replacement")
+	}
+	tr.attach()
+	if first.updates != 0 || second.updates != 1 || len(tr.hids) != 1 {
+		t.Errorf("Expected only the replacement to be told, got %d %d", first.updates, second.updates)
+	}
+	if tr.monitorEnergy("hud", &testEnergyMonitor{}) || !tr.monitorEnergy("hud", &testEnergyMonitor{}) {
+		t.Errorf("Expected the second energy monitor to be reported as a replacement")
+	}
+}
+
+func TestLevelStats(t *testing.T) {
+	for level := 0; level <= 4; level++ {
+		edges, panels, panelSize, centerSize, maxCores := levelStats(level)
+		tr := newTrooper(&testEngine{}, &testPart{}, level)
+		cubes, panelCubes := 0, 0
+		for _, b := range tr.bits {
+			switch bit := b.(type) {
+			case *cube:
+				cubes++
+			case *panel:
+				panelCubes += len(bit.cubes)
+			}
+		}
+		if cubes != edges || len(tr.bits)-cubes != panels {
+			t.Errorf("Level %d expected %d edges %d panels, got %d %d", level, edges, panels, cubes, len(tr.bits)-cubes)
+		}
+		if panelCubes != panels*panelSize*panelSize {
+			t.Errorf("Level %d expected %d panel cubes, got %d", level, panels*panelSize*panelSize, panelCubes)
+		}
+		if level > 0 {
+			sx, _, _ := tr.center.Scale()
+			if expected := gapped(float64(centerSize)*tr.shape.cubeSize()*0.5, 0.1); sx != expected {
+				t.Errorf("Level %d expected center scale %f, got %f", level, expected, sx)
+			}
+		}
+		if _, _, max := tr.health(); max != maxCores {
+			t.Errorf("Level %d expected %d cores, got %d", level, maxCores, max)
+		}
+	}
+}
+
+func TestTimeScale(t *testing.T) {
+	defer setTimeScale(1)
+	setTimeScale(0.5)
+	tr := newTrooper(nil, &testPart{}, 1)
+	for cnt := 0; cnt < 10; cnt++ {
+		tr.updateEnergy()
+	}
+	if teng, _, _, _ := tr.energy(); teng != 5 {
+		t.Errorf("Expected half rate energy 5, got %d", teng)
+	}
+	setTimeScale(0)
+	if timeScale != 0.1 {
+		t.Errorf("Expected clamped time scale 0.1, got %f", timeScale)
+	}
+}
+
+func TestWireframe(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.setWireframe(true)
+	for _, c := range tr.cubes() {
+		for _, cell := range c.cells {
+			if shader := cell.(*testPart).shader; shader != "wire" {
+				t.Fatalf("Expected wire shader, got %s", shader)
+			}
+		}
+	}
+	tr.attach()
+	c := tr.cubes()[0]
+	tr.attachCores(10000)
+	if shader := tr.neo.(*testPart).shader; shader != "wire" {
+		t.Errorf("Expected wire merged trooper, got %s", shader)
+	}
+	tr.setWireframe(false)
+	tr.detach()
+	for _, cell := range c.cells {
+		if shader := cell.(*testPart).shader; shader != "flata" {
+			t.Errorf("Expected flata shader, got %s", shader)
+		}
+	}
+}
+
+func TestMergeCompleted(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	for _, face := range []int{0, 3} {
+		p := tr.bits[face].(*panel)
+		for _, c := range p.cubes {
+			for c.attach() {
+			}
+			p.ccnt += 4 // filled directly, so the panel is not merged yet.
+		}
+	}
+	tr.mergeCompleted()
+	tr.mergeCompleted()
+	for face := 0; face < 6; face++ {
+		merged := tr.bits[face].(*panel).slab != nil
+		if merged != (face == 0 || face == 3) {
+			t.Errorf("Face %d unexpected merge state %t", face, merged)
+		}
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+	tr.bits[0].detach()
+	if tr.bits[0].(*panel).slab != nil {
+		t.Errorf("Expected detach to undo the merge")
+	}
+}
+
+func TestCubeConsistent(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	c := newCube(nil, &testPart{}, 0, 0, 0, 1)
+	for cnt := 0; cnt < 10000; cnt++ {
+		switch random.Intn(5) {
+		case 0, 1:
+			c.attach()
+		case 2, 3:
+			c.detach()
+		default:
+			c.reset(random.Intn(c.cmax + 2))
+		}
+		if !c.consistent() {
+			t.Fatalf("Op %d: %d cells with %d parts", cnt, c.ccnt, len(c.cells))
+		}
+	}
+	tr := newTrooper(nil, &testPart{}, 3)
+	for cnt := 0; cnt < 2000; cnt++ {
+		if random.Intn(2) == 0 {
+			tr.attachCores(random.Intn(20))
+		} else {
+			tr.detachCores(random.Intn(20))
+		}
+		if tr.neo != nil {
+			continue // merged troopers have no cube cells.
+		}
+		for _, c := range tr.cubes() {
+			if !c.consistent() {
+				t.Fatalf("Op %d: %d cells with %d parts", cnt, c.ccnt, len(c.cells))
+			}
+		}
+	}
+}
+
+func TestSetHealth(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	hm := &testHealthMonitor{}
+	tr.monitorHealth("test", hm)
+	_, mid, max := tr.health()
+	for _, target := range []int{5, max, 3, 0, mid} {
+		updates := hm.updates
+		tr.setHealth(target)
+		if health, _, _ := tr.health(); health != target {
+			t.Errorf("Expected health %d, got %d", target, health)
+		}
+		if hm.updates != updates+1 {
+			t.Errorf("Expected one health update, got %d", hm.updates-updates)
+		}
+		if (tr.neo != nil) != (target == max) {
+			t.Errorf("Expected merged trooper only at full health %d", target)
+		}
+		if err := tr.verifyIntegrity(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFaceToward(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.part.SetRotation(0, 0, 0, 1)
+	dirs := []*lin.V3{{1, 0, 0}, {-1, 0, 0}, {0, 1, 0}, {0, -1, 0}, {0, 0, 1}, {0, 0, -1}}
+	for face, dir := range dirs {
+		if got := tr.faceToward(dir); got != face {
+			t.Errorf("Expected face %d for %v, got %d", face, dir, got)
+		}
+	}
+
+	// a quarter turn around y moves the +x face to -z.
+	tr.part.SetRotation(0, math.Sin(math.Pi/4), 0, math.Cos(math.Pi/4))
+	if got := tr.faceToward(&lin.V3{0, 0, -1}); got != 0 {
+		t.Errorf("Expected face 0 for -z, got %d", got)
+	}
+	if got := tr.faceToward(&lin.V3{1, 0, 0}); got != 4 {
+		t.Errorf("Expected face 4 for +x, got %d", got)
+	}
+}
+
+func TestCubeSubdivision(t *testing.T) {
+	c := newCubeN(nil, &testPart{}, 0, 0, 0, 1, 3)
+	if c.cmax != 27 || len(c.centers) != 27 {
+		t.Fatalf("Expected 27 cells, got %d %d", c.cmax, len(c.centers))
+	}
+	c.edgeSort(0)
+	for cnt := 1; cnt < c.cmax; cnt++ {
+		c.attach()
+		if len(c.cells) != cnt {
+			t.Fatalf("Expected %d cells, got %d", cnt, len(c.cells))
+		}
+	}
+	if size, _, _ := c.cells[0].Scale(); size != gapped(1.0/6, 0.2) {
+		t.Errorf("Expected cell scale %f, got %f", gapped(1.0/6, 0.2), size)
+	}
+	if !c.attach() || len(c.cells) != 1 || !c.consistent() {
+		t.Errorf("Expected a merged cube")
+	}
+	if c.attach() {
+		t.Errorf("Expected a full cube")
+	}
+}
+
+func TestMissingNoise(t *testing.T) {
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	tr.noises["decloak"] = nil
+	tr.resetEnergy()
+	tr.cloak(true)
+	tr.cloak(false)
+	if !tr.quiet["cloak"] || !tr.quiet["decloak"] {
+		t.Errorf("Expected missing sounds to be noted")
+	}
+}
+
+func TestRenderedPartCount(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	_, _, max := tr.health()
+	tr.setHealth(max - 1)
+	detailed := tr.renderedPartCount()
+	tr.setHealth(max)
+	if merged := tr.renderedPartCount(); merged != 2 || detailed < 20*merged {
+		t.Errorf("Expected far fewer merged parts, got %d merged %d detailed", merged, detailed)
+	}
+}
+
+func TestDetachOrder(t *testing.T) {
+	ordered := func(panelsFirst bool) func([]box) []box {
+		return func(bits []box) []box {
+			panels, cubes := []box{}, []box{}
+			for _, b := range bits {
+				if _, ok := b.(*panel); ok {
+					panels = append(panels, b)
+				} else {
+					cubes = append(cubes, b)
+				}
+			}
+			if panelsFirst {
+				return append(panels, cubes...)
+			}
+			return append(cubes, panels...)
+		}
+	}
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.detachOrder = ordered(false)
+	tr.detach()
+	if tr.bits[0].box().ccnt != tr.ipos[0] || tr.bits[6].box().ccnt != tr.ipos[6]-1 {
+		t.Errorf("Expected an edge cell to be removed first")
+	}
+	tr.detachOrder = ordered(true)
+	tr.detach()
+	if tr.bits[0].box().ccnt != tr.ipos[0]-1 {
+		t.Errorf("Expected a panel cell to be removed first")
+	}
+	if _, ok := tr.bits[0].(*panel); !ok {
+		t.Errorf("Expected the bits order to be unchanged")
+	}
+}
+
+func TestDispose(t *testing.T) {
+	parent := &testPart{}
+	tr := newTrooper(nil, parent.AddPart(), 2)
+	tr.parent = parent
+	tr.dispose()
+	if len(parent.parts) != 0 {
+		t.Errorf("Expected no parts, got %d", len(parent.parts))
+	}
+	tr.dispose() // must not panic.
+}
+
+func TestSetOrientation(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	tr.setOrientation(15, 0, 15)
+	tr.setOrientation(30, 10, 0)
+	if spin := tr.part.(*testPart).spin; spin != [3]float64{30, 10, 0} {
+		t.Errorf("Expected rotation 30 10 0, got %v", spin)
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	buf := &bytes.Buffer{}
+	tr.setTelemetry(buf)
+	tr.tick = 1
+	tr.attach()
+	tr.tick = 2
+	tr.updateEnergy()
+	tr.tick = 3
+	tr.detachCores(2)
+	tr.setTelemetry(nil)
+	tr.attach()
+	expected := "1,9,8,64,0,0\n2,9,8,64,1,0\n3,7,8,64,1,0\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s got\n%s", expected, buf.String())
+	}
+}
+
+func TestHealthSegments(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.attachCores(13)
+	segments, maxes := tr.healthSegments(), tr.maxSegments()
+	if len(segments) != len(maxes) {
+		t.Fatalf("Expected %d segments, got %d", len(maxes), len(segments))
+	}
+	sum, maxSum := 0, 0
+	for cnt := range segments {
+		if segments[cnt] > maxes[cnt] {
+			t.Errorf("Segment %d has %d of %d cells", cnt, segments[cnt], maxes[cnt])
+		}
+		sum += segments[cnt]
+		maxSum += maxes[cnt]
+	}
+	if health, _, max := tr.health(); sum != health || maxSum != max {
+		t.Errorf("Expected %d/%d, got %d/%d", health, max, sum, maxSum)
+	}
+}
+
+func TestCellPool(t *testing.T) {
+	c := newCube(nil, &testPart{}, 0, 0, 0, 1)
+	c.edgeSort(4)
+	part := c.part.(*testPart)
+	added := part.added
+	cycles := 100
+	for cnt := 0; cnt < cycles; cnt++ {
+		c.attach()
+		c.detach()
+	}
+	if part.added-added >= cycles {
+		t.Errorf("Expected cells to be reused, got %d new parts", part.added-added)
+	}
+	if !c.consistent() {
+		t.Errorf("Expected a consistent cube")
+	}
+	for _, cell := range c.cells {
+		if !cell.Visible() {
+			t.Errorf("Expected attached cells to be visible")
+		}
+	}
+}
+
+func BenchmarkCellCycle(b *testing.B) {
+	c := newCube(nil, &testPart{}, 0, 0, 0, 1)
+	c.edgeSort(4)
+	for cnt := 0; cnt < b.N; cnt++ {
+		c.attach()
+		c.detach()
+	}
+}
+
+// The cube layout of troopers from before newTrooper was tuned. The
+// layout is the cube count and a position weighted sum of cube centers.
+func TestNewTrooperLayout(t *testing.T) {
+	expect := []struct {
+		level, health, mid, max, bits, cubes int
+		layout                               float64
+	}{
+		{0, 1, 1, 8, 1, 1, 0},
+		{1, 8, 8, 64, 14, 8, 13},
+		{2, 56, 56, 208, 26, 26, 72},
+		{3, 152, 152, 448, 38, 56, 150},
+		{4, 296, 296, 784, 50, 98, 152},
+		{5, 488, 488, 1216, 62, 152, -95},
+	}
+	for _, e := range expect {
+		tr := newTrooper(nil, &testPart{}, e.level)
+		health, mid, max := tr.health()
+		if health != e.health || mid != e.mid || max != e.max {
+			t.Errorf("Level %d expected health %d %d %d, got %d %d %d", e.level, e.health, e.mid, e.max, health, mid, max)
+		}
+		cubes := tr.cubes()
+		if len(tr.bits) != e.bits || len(cubes) != e.cubes {
+			t.Errorf("Level %d expected %d bits %d cubes, got %d %d", e.level, e.bits, e.cubes, len(tr.bits), len(cubes))
+		}
+		layout := 0.0
+		for cnt, c := range cubes {
+			layout += float64(cnt+1) * (c.cx + 2*c.cy + 5*c.cz)
+		}
+		if math.Abs(layout-e.layout) > 0.0001 {
+			t.Errorf("Level %d expected layout %f, got %f", e.level, e.layout, layout)
+		}
+	}
+}
+
+func BenchmarkNewTrooper(b *testing.B) {
+	b.ReportAllocs()
+	for cnt := 0; cnt < b.N; cnt++ {
+		newTrooper(nil, &testPart{}, 8)
+	}
+}
+
+func TestDeath(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	dm := &testDeathMonitor{}
+	tr.monitorDeath("test", dm)
+	tr.detachCores(10)
+	if dm.deaths != 0 {
+		t.Errorf("Expected no death with cells left")
+	}
+	health, _, _ := tr.health()
+	tr.detachCores(health)
+	tr.detach()
+	tr.detachCores(5)
+	if dm.deaths != 1 {
+		t.Errorf("Expected one death, got %d", dm.deaths)
+	}
+	tr.reset()
+	tr.setHealth(0)
+	if dm.deaths != 2 {
+		t.Errorf("Expected reset to rearm death, got %d", dm.deaths)
+	}
+}
+
+// testDeathMonitor counts deaths.
+type testDeathMonitor struct{ deaths int }
+
+func (dm *testDeathMonitor) died() { dm.deaths++ }
+
+func TestCubeResize(t *testing.T) {
+	c := newCube(nil, &testPart{}, 1, 1, 1, 1)
+	c.edgeSort(4)
+	c.resize(2)
+	for cnt, cell := range c.cells {
+		x, y, z := cell.Location()
+		center := c.centers[cnt]
+		if x != center.X || y != center.Y || z != center.Z {
+			t.Errorf("Cell %d expected at %v, got %f %f %f", cnt, center, x, y, z)
+		}
+		if math.Abs(center.X-1) != 0.5 || math.Abs(center.Y-1) != 0.5 || math.Abs(center.Z-1) != 0.5 {
+			t.Errorf("Cell %d expected at a resized center, got %v", cnt, center)
+		}
+	}
+	if size, _, _ := c.cells[0].Scale(); size != gapped(0.5, 0.2) {
+		t.Errorf("Expected cell scale %f, got %f", gapped(0.5, 0.2), size)
+	}
+}
+
+func TestCloak(t *testing.T) {
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	noise := &testSound{}
+	tr.noises["cloak"] = noise
+	tr.cloakEnergy = 0
+	tr.cloak(true)
+	if tr.isCloaked() || noise.plays != 0 {
+		t.Errorf("Expected no cloak without energy")
+	}
+	tr.cloakEnergy = 100
+	tr.cloak(true)
+	tr.cloak(true)
+	if !tr.isCloaked() || noise.plays != 1 {
+		t.Errorf("Expected one cloak sound, got %d", noise.plays)
+	}
+	tr.cloak(false)
+	if tr.isCloaked() {
+		t.Errorf("Expected trooper to be uncloaked")
+	}
+}
+
+func TestUpdateAudio(t *testing.T) {
+	eng := &testEngine{}
+	tr := newTrooper(eng, &testPart{}, 1)
+	tr.updateAudio(0, 0, 0)
+	tr.updateAudio(0, 0, 0)
+	if eng.places != 1 {
+		t.Errorf("Expected one listener update, got %d", eng.places)
+	}
+	tr.part.SetLocation(7, 8, 9) // the HUD trooper is not the listener.
+	tr.updateAudio(1, 2, 3)
+	if eng.places != 2 || eng.x != 1 || eng.y != 2 || eng.z != 3 {
+		t.Errorf("Expected listener at 1 2 3, got %f %f %f", eng.x, eng.y, eng.z)
+	}
+
+	// sounds play at the listener without moving it to the HUD trooper.
+	noise := &testSound{}
+	tr.noises["cloak"] = noise
+	tr.playNoise("cloak")
+	if eng.places != 2 || noise.x != 1 || noise.y != 2 || noise.z != 3 {
+		t.Errorf("Expected the sound at the listener, got %f %f %f", noise.x, noise.y, noise.z)
+	}
+}
+
+func TestTeleportTo(t *testing.T) {
+	eng := &testEngine{}
+	tr := newTrooper(eng, &testPart{}, 1)
+	tr.noises["teleport"] = &testSound{}
+	tr.temax = 10
+	if tr.teleportTo(4, 5, 6) {
+		t.Errorf("Expected teleport to fail without energy")
+	}
+	if x, y, z := tr.loc(); x != 0 || y != 0 || z != 0 {
+		t.Errorf("Expected trooper to stay put, got %f %f %f", x, y, z)
+	}
+	tr.teleportEnergy = tr.temax
+	if !tr.teleportTo(4, 5, 6) {
+		t.Errorf("Expected teleport with full energy")
+	}
+	if x, y, z := tr.loc(); x != 4 || y != 5 || z != 6 {
+		t.Errorf("Expected trooper at 4 5 6, got %f %f %f", x, y, z)
+	}
+	if eng.x != 4 || eng.y != 5 || eng.z != 6 {
+		t.Errorf("Expected listener at 4 5 6, got %f %f %f", eng.x, eng.y, eng.z)
+	}
+}
+
+func TestPanelOwnership(t *testing.T) {
+	for level := 2; level <= 5; level++ {
+		tr := newTrooper(nil, &testPart{}, level)
+		if err := tr.auditPanelOwnership(); err != nil {
+			t.Errorf("Level %d: %s", level, err)
+		}
+		tr.detach()
+		if err := tr.auditPanelOwnership(); err != nil {
+			t.Errorf("Level %d after detach: %s", level, err)
+		}
+	}
+
+	// panel capacity comes from its cubes, whatever their size.
+	tr := newTrooper(nil, &testPart{}, 3)
+	p, _ := tr.panel(0)
+	for _, c := range p.cubes {
+		c.cmax = 27
+	}
+	if err := tr.auditPanelOwnership(); err == nil {
+		t.Errorf("Expected a panel capacity mismatch")
+	}
+	p.cmax = 27 * len(p.cubes)
+	if err := tr.auditPanelOwnership(); err != nil {
+		t.Errorf("Expected subdivided cubes to be allowed: %s", err)
+	}
+}
+
+func TestEnergyPaused(t *testing.T) {
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	tr.teleportEnergy, tr.cloakEnergy, tr.cloaked = 0, 100, true
+	tr.setEnergyPaused(true)
+	for cnt := 0; cnt < 10; cnt++ {
+		tr.updateEnergy()
+	}
+	if tr.teleportEnergy != 0 || tr.cloakEnergy != 100 || !tr.isCloaked() {
+		t.Errorf("Expected frozen energy, got %d %d", tr.teleportEnergy, tr.cloakEnergy)
+	}
+	tr.setEnergyPaused(false)
+	for cnt := 0; cnt < 10; cnt++ {
+		tr.updateEnergy()
+	}
+	if tr.teleportEnergy != 10 {
+		t.Errorf("Expected teleport energy 10, got %d", tr.teleportEnergy)
+	}
+}
+
+func TestMergeDisabled(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.setMergeDisabled(true)
+	for tr.attachCell() {
+	}
+	health, _, max := tr.health()
+	if tr.neo != nil || health != max {
+		t.Errorf("Expected a full unmerged trooper, got %d of %d", health, max)
+	}
+	for _, c := range tr.cubes() {
+		if len(c.cells) != c.cmax {
+			t.Errorf("Expected %d detailed cells, got %d", c.cmax, len(c.cells))
+		}
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+	tr.detach()
+	if got, _, _ := tr.health(); got != max-1 {
+		t.Errorf("Expected health %d, got %d", max-1, got)
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+	tr.setMergeDisabled(false)
+	tr.attach()
+	if tr.neo == nil {
+		t.Errorf("Expected the trooper to merge once merging is enabled")
+	}
+}
+
+func TestLevelUp(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	if tr.level() != 2 || tr.canLevelUp() {
+		t.Errorf("Expected a partial level 2 trooper")
+	}
+	for tr.attachCell() {
+	}
+	if !tr.canLevelUp() || tr.nextLevel() != 3 {
+		t.Errorf("Expected a full trooper to level up to 3, got %d", tr.nextLevel())
+	}
+	tr.setMaxLevel(2)
+	if tr.nextLevel() != 2 {
+		t.Errorf("Expected next level capped at 2, got %d", tr.nextLevel())
+	}
+}
+
+func TestMonitorOrder(t *testing.T) {
+	for run := 0; run < 10; run++ {
+		tr := newTrooper(nil, &testPart{}, 1)
+		notified := []string{}
+		for _, id := range []string{"c", "a", "d", "b"} {
+			mon := &testOrderMonitor{id: id, notified: &notified}
+			tr.monitorHealth(id, mon)
+			tr.monitorEnergy(id, mon)
+		}
+		tr.ignoreHealth("d")
+		tr.ignoreEnergy("d")
+		tr.healthChanged(tr.health())
+		tr.energyChanged()
+		expected := []string{"c", "a", "b", "c", "a", "b"}
+		if !reflect.DeepEqual(notified, expected) {
+			t.Fatalf("Expected %v, got %v", expected, notified)
+		}
+	}
+}
+
+// testOrderMonitor records the order that monitors are notified.
+type testOrderMonitor struct {
+	id       string
+	notified *[]string
+}
+
+func (om *testOrderMonitor) healthUpdated(health, high, warn int) {
+	*om.notified = append(*om.notified, om.id)
+}
+func (om *testOrderMonitor) energyUpdated(teleportEnergy, tmax, cloakEnergy, cmax int) {
+	*om.notified = append(*om.notified, om.id)
+}
+
+func TestVisited(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	tr.markVisited(2, 3)
+	tr.markVisited(2, 3)
+	tr.markVisited(-1, 4)
+	if !tr.isVisited(2, 3) || !tr.isVisited(-1, 4) || tr.isVisited(3, 2) {
+		t.Errorf("Expected 2,3 and -1,4 to be visited")
+	}
+	if spots := tr.visitedCells(); len(spots) != 2 {
+		t.Errorf("Expected 2 visited cells, got %v", spots)
+	}
+	tr.reset()
+	if tr.isVisited(2, 3) || len(tr.visitedCells()) != 0 {
+		t.Errorf("Expected reset to clear visited cells")
+	}
+}
+
+func TestHealthEnergyStrings(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	health, _, max := tr.health()
+	if got, expected := tr.healthString(), fmt.Sprintf("%d / %d", health, max); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	expected := map[[2]int]string{
+		{1000, 800}: "Cloak 80% • Teleport Ready",
+		{400, 0}:    "Cloak Empty • Teleport 40%",
+		{0, 1000}:   "Cloak 100% • Teleport 0%",
+	}
+	for energy, text := range expected {
+		tr.teleportEnergy, tr.cloakEnergy = energy[0], energy[1]
+		if got := tr.energyString(); got != text {
+			t.Errorf("Expected %q, got %q", text, got)
+		}
+	}
+}
+
+func TestResetHealthOnly(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.teleportEnergy, tr.cloakEnergy = 123, 456
+	tr.markVisited(1, 1)
+	for cnt := 0; cnt < 10; cnt++ {
+		tr.attach()
+	}
+	tr.resetHealthOnly()
+	if health, mid, _ := tr.health(); health != mid {
+		t.Errorf("Expected health %d, got %d", mid, health)
+	}
+	if tr.teleportEnergy != 123 || tr.cloakEnergy != 456 || !tr.isVisited(1, 1) {
+		t.Errorf("Expected energy and visits to be kept, got %d %d", tr.teleportEnergy, tr.cloakEnergy)
+	}
+}
+
+func TestScatterCells(t *testing.T) {
+	part := &testPart{}
+	tr := newTrooper(nil, part, 2)
+	tr.ani = &animator{}
+	tr.detachCores(3)
+	if len(tr.ani.animations) != 0 {
+		t.Errorf("Expected no scattering by default")
+	}
+	tr.scatterCells = true
+	parts := len(part.parts)
+	tr.detachCores(3)
+	if len(tr.ani.animations) != 3 || len(part.parts) != parts+3 {
+		t.Errorf("Expected 3 scattered cells, got %d", len(tr.ani.animations))
+	}
+	for len(tr.ani.animations) > 0 {
+		tr.ani.animate(0.02)
+	}
+	if len(part.parts) != parts {
+		t.Errorf("Expected scattered cells to be removed, got %d parts", len(part.parts)-parts)
+	}
+}
+
+func TestPanelAccess(t *testing.T) {
+	if p, ok := newTrooper(nil, &testPart{}, 0).panel(0); ok || p != nil {
+		t.Errorf("Expected no panels for a level 0 trooper")
+	}
+	tr := newTrooper(nil, &testPart{}, 2)
+	for face := 0; face < 6; face++ {
+		if _, ok := tr.panel(face); !ok {
+			t.Errorf("Expected a panel for face %d", face)
+		}
+	}
+	for _, face := range []int{-1, 6} {
+		if _, ok := tr.panel(face); ok {
+			t.Errorf("Expected no panel for face %d", face)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	desc := newTrooper(nil, &testPart{}, 1).describe()
+	if panels := strings.Count(desc, "\n  panel "); panels != 6 {
+		t.Errorf("Expected 6 panels, got %d in\n%s", panels, desc)
+	}
+	if cubes := strings.Count(desc, "\n  cube "); cubes != 8 {
+		t.Errorf("Expected 8 edge cubes, got %d in\n%s", cubes, desc)
+	}
+	if !strings.Contains(desc, "\n  center\n") {
+		t.Errorf("Expected a center in\n%s", desc)
+	}
+}
+
+func TestCloakInverted(t *testing.T) {
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	tr.cloakEnergy = 10
+	tr.setCloakInverted(true)
+	tr.cloak(true)
+	for cnt := 0; cnt < 10; cnt++ {
+		tr.updateEnergy()
+	}
+	if expected := 10 + 10*cloakDrain[cloakFull]; tr.cloakEnergy != expected || !tr.isCloaked() {
+		t.Errorf("Expected cloak energy %d while cloaked, got %d", expected, tr.cloakEnergy)
+	}
+	for cnt := 0; cnt < tr.cemax; cnt++ {
+		tr.updateEnergy()
+	}
+	if tr.cloakEnergy != tr.cemax || !tr.isCloaked() {
+		t.Errorf("Expected cloak energy to stop at %d, got %d", tr.cemax, tr.cloakEnergy)
+	}
+	tr.setCloakInverted(false)
+	tr.updateEnergy()
+	if tr.cloakEnergy != tr.cemax-cloakDrain[cloakFull] {
+		t.Errorf("Expected cloak energy to drain again, got %d", tr.cloakEnergy)
+	}
+}
+
+func TestDominantColor(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	_, _, max := tr.health()
+	tr.setHealth(max)
+	blue := materialColors["tblue"]
+	if r, g, b := tr.dominantColor(); r != blue[0] || g != blue[1] || b != blue[2] {
+		t.Errorf("Expected the merged color %v, got %f %f %f", blue, r, g, b)
+	}
+	tr.setHealth(0)
+	if r, g, b := tr.dominantColor(); r != 0.5 || g != 0.5 || b != 0.5 {
+		t.Errorf("Expected a neutral color, got %f %f %f", r, g, b)
+	}
+	tr.setHealth(max / 2)
+	if r, _, b := tr.dominantColor(); r <= blue[0] || b >= blue[2] {
+		t.Errorf("Expected a blend of cell colors, got %f %f", r, b)
+	}
+}
+
+func TestVisualHash(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	hash := tr.visualHash()
+	tr.health()
+	tr.cellBounds()
+	if again := tr.visualHash(); again != hash {
+		t.Errorf("Expected a stable hash, got %x and %x", hash, again)
+	}
+	tr.attach()
+	attached := tr.visualHash()
+	if attached == hash {
+		t.Errorf("Expected the hash to change after an attach")
+	}
+	tr.setScale(2)
+	if tr.visualHash() == attached {
+		t.Errorf("Expected the hash to change after scaling")
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.setRegenDelay(5)
+	tr.attachCores(4)
+	tr.detachCores(1)
+	tr.teleportEnergy = 0
+	for cnt := 0; cnt < 3; cnt++ {
+		tr.advance()
+	}
+	if tr.tick != 3 || tr.teleportEnergy != 3 || tr.damageCooldown != 2 {
+		t.Errorf("Expected tick 3, energy 3, cooldown 2, got %d %d %d", tr.tick, tr.teleportEnergy, tr.damageCooldown)
+	}
+	for cnt := 0; cnt < 3; cnt++ {
+		tr.advance()
+	}
+	if tr.damageCooldown != 0 || tr.regenCores(1) != 1 {
+		t.Errorf("Expected regeneration after the delay, got cooldown %d", tr.damageCooldown)
+	}
+}
+
+func TestDifficultyProfile(t *testing.T) {
+	profile := difficultyProfile{cores: []int{0, 0, 70}, teleport: []int{100, 200}, cloak: []int{50}, regen: []float64{2}}
+	tr := newTrooperProfile(nil, &testPart{}, 2, profile)
+	if tr.temax != 200 || tr.cemax != 50 || tr.teleportRate != 2 {
+		t.Errorf("Expected energy maximums 200 50 rate 2, got %d %d %f", tr.temax, tr.cemax, tr.teleportRate)
+	}
+	tr.attachCores(1000)
+	if health, _, max := tr.health(); health != 70 || max != 70 || tr.neo != nil {
+		t.Errorf("Expected health capped at 70, got %d of %d", health, max)
+	}
+	if !tr.canLevelUp() || !tr.fullHealth() {
+		t.Errorf("Expected a capped trooper to level up")
+	}
+	if tr.attachNearest(&lin.V3{1, 0, 0}) {
+		t.Errorf("Expected pickups to respect the core cap")
+	}
+	plain := newTrooperProfile(nil, &testPart{}, 2, defaultProfile)
+	_, _, max := newTrooper(nil, &testPart{}, 2).health()
+	if _, _, got := plain.health(); got != max || plain.temax != maxEnergy || plain.cemax != maxEnergy {
+		t.Errorf("Expected the default profile to match newTrooper, got max %d", got)
+	}
+}
+
+func TestCloakLevels(t *testing.T) {
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	tr.cloakEnergy = 100
+	tr.setCloakLevel(cloakPartial)
+	if !tr.isCloaked() || tr.concealment() <= 0 || tr.concealment() >= 1 {
+		t.Errorf("Expected partial concealment, got %f", tr.concealment())
+	}
+	for cnt := 0; cnt < 10; cnt++ {
+		tr.updateEnergy()
+	}
+	if expected := 100 - 10*cloakDrain[cloakPartial]; tr.cloakEnergy != expected {
+		t.Errorf("Expected cloak energy %d, got %d", expected, tr.cloakEnergy)
+	}
+	tr.cloak(true)
+	tr.updateEnergy()
+	if expected := 100 - 10*cloakDrain[cloakPartial] - cloakDrain[cloakFull]; tr.cloakEnergy != expected {
+		t.Errorf("Expected cloak energy %d, got %d", expected, tr.cloakEnergy)
+	}
+	if tr.concealment() != 1 {
+		t.Errorf("Expected full concealment, got %f", tr.concealment())
+	}
+	tr.cloak(false)
+	if tr.isCloaked() || tr.concealment() != 0 {
+		t.Errorf("Expected no concealment")
+	}
+}
+
+func TestApplyDeltas(t *testing.T) {
+	source := newTrooper(nil, &testPart{}, 2)
+	target := newTrooper(nil, &testPart{}, 2)
+	before := source.snapshot()
+	for cnt := 0; cnt < 20; cnt++ {
+		source.attach()
+	}
+	source.detachCores(3)
+	deltas := diffTrooper(before, source.snapshot())
+	if len(deltas) == 0 {
+		t.Fatalf("Expected cell deltas")
+	}
+	applyDeltas(target, deltas)
+	if !reflect.DeepEqual(target.snapshot().ccnt, source.snapshot().ccnt) {
+		t.Errorf("Expected %v, got %v", source.snapshot().ccnt, target.snapshot().ccnt)
+	}
+
+	// cross the merge boundary both ways.
+	full := source.snapshot()
+	for source.attachCell() {
+	}
+	applyDeltas(target, diffTrooper(full, source.snapshot()))
+	if target.neo == nil {
+		t.Errorf("Expected a merged trooper")
+	}
+	applyDeltas(target, diffTrooper(source.snapshot(), full))
+	if health, _, _ := target.health(); target.neo != nil || health != sumCells(full) {
+		t.Errorf("Expected a split trooper with health %d, got %d", sumCells(full), health)
+	}
+	if err := target.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+}
+
+// sumCells returns the total number of cells in a trooper state.
+func sumCells(s trooperState) (cells int) {
+	for _, ccnt := range s.ccnt {
+		cells += ccnt
+	}
+	return cells
+}
+
+func TestCubesNearMerge(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	cubes := tr.cubes()
+	for cnt, ccnt := range []int{8, 7, 6, 2, 0} {
+		cubes[cnt].reset(ccnt)
+		if cubes[cnt].toMerge() != 8-ccnt {
+			t.Errorf("Expected %d to merge, got %d", 8-ccnt, cubes[cnt].toMerge())
+		}
+	}
+	for cnt := 5; cnt < len(cubes); cnt++ {
+		cubes[cnt].reset(8)
+	}
+	for threshold, expected := range map[int]int{0: 0, 1: 1, 2: 2, 7: 3, 8: 4} {
+		if got := tr.cubesNearMerge(threshold); got != expected {
+			t.Errorf("Threshold %d expected %d cubes, got %d", threshold, expected, got)
+		}
+	}
+}
+
+func TestTrashOrder(t *testing.T) {
+	removed := []vu.Part{}
+	tr := newTrooper(nil, &testPart{removed: &removed}, 2)
+	tr.bits[0].reset(tr.bits[0].box().cmax) // a slab.
+	for _, b := range tr.bits {
+		if c, ok := b.(*cube); ok {
+			c.reset(7)
+		}
+	}
+	kinds := map[vu.Part]int{tr.center: 2, tr.bits[0].(*panel).slab: 1}
+	for _, c := range tr.cubes() {
+		for _, cell := range c.cells {
+			kinds[cell] = 0
+		}
+	}
+	removed = removed[:0]
+	tr.reset()
+	last, cells := 0, 0
+	for _, part := range removed {
+		kind, ok := kinds[part]
+		if !ok {
+			continue
+		}
+		if kind < last {
+			t.Fatalf("Expected children to be removed before parents")
+		}
+		if kind == 0 {
+			cells++
+		}
+		last = kind
+	}
+	if cells == 0 || last != 2 {
+		t.Errorf("Expected cells, slab, and center removals, got %d cells and %d", cells, last)
+	}
+}
+
+func TestEnergyNormalized(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	expected := map[[2]int][2]float64{
+		{1000, 1000}: {1, 1},
+		{0, 0}:       {0, 0},
+		{500, 500}:   {0.5, 0.5},
+		{250, 20000}: {0.25, 1},
+	}
+	for energy, fractions := range expected {
+		tr.teleportEnergy, tr.cloakEnergy = energy[0], energy[1]
+		if teleport, cloak := tr.energyNormalized(); teleport != fractions[0] || cloak != fractions[1] {
+			t.Errorf("Expected %v, got %f %f", fractions, teleport, cloak)
+		}
+	}
+	tr.temax, tr.cemax = 0, 0
+	if teleport, cloak := tr.energyNormalized(); teleport != 0 || cloak != 0 {
+		t.Errorf("Expected 0 for zero maximums, got %f %f", teleport, cloak)
+	}
+}
+
+func TestNewTrooperAt(t *testing.T) {
+	_, mid, max := newTrooper(nil, &testPart{}, 2).health()
+	for start, expected := range map[int]int{(mid + max) / 2: (mid + max) / 2, -5: 0, max + 5: max} {
+		tr := newTrooperAt(nil, &testPart{}, 2, start)
+		if health, _, _ := tr.health(); health != expected {
+			t.Errorf("Start %d expected health %d, got %d", start, expected, health)
+		}
+		if err := tr.verifyIntegrity(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestShield(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	health, _, max := tr.health()
+	tr.addShield(3)
+	if added := tr.attachCores(max + 5); added != max-health+3 {
+		t.Errorf("Expected %d cells added, got %d", max-health+3, added)
+	}
+	if health, _, _ := tr.health(); health != max {
+		t.Errorf("Expected the shield to be separate from health %d, got %d", max, health)
+	}
+	if cells, smax := tr.shield(); cells != 3 || smax != 3 {
+		t.Errorf("Expected a full shield of 3, got %d/%d", cells, smax)
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+	if material := tr.shields[0].(*testPart).material; material != "tgold" {
+		t.Errorf("Expected shield material tgold, got %s", material)
+	}
+
+	// damage eats the shield before the normal cells.
+	tr.detachCores(2)
+	if health, _, _ := tr.health(); health != max {
+		t.Errorf("Expected health %d, got %d", max, health)
+	}
+	tr.detachCores(3)
+	if cells, _ := tr.shield(); cells != 0 {
+		t.Errorf("Expected no shield cells, got %d", cells)
+	}
+	if health, _, _ := tr.health(); health != max-2 {
+		t.Errorf("Expected health %d, got %d", max-2, health)
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+
+	// the shield refills once the trooper is full again.
+	tr.attachCores(3)
+	if cells, _ := tr.shield(); cells != 1 {
+		t.Errorf("Expected 1 shield cell, got %d", cells)
+	}
+	tr.dropShield()
+	if cells, smax := tr.shield(); cells != 0 || smax != 0 || tr.attachCores(1) != 0 {
+		t.Errorf("Expected the shield to be gone, got %d/%d", cells, smax)
+	}
+}
+
+func TestSortTies(t *testing.T) {
+	points := func() []*lin.V3 {
+		return []*lin.V3{{1, 0, 0}, {0, 0, -1}, {0, 1, 0}, {-1, 0, 0}, {0, 0, 1}, {0, -1, 0}}
+	}
+	expected := []lin.V3{{-1, 0, 0}, {0, -1, 0}, {0, 0, -1}, {0, 0, 1}, {0, 1, 0}, {1, 0, 0}}
+	for _, reversed := range []bool{false, true} {
+		c := csort(points())
+		if reversed {
+			for i, j := 0, len(c)-1; i < j; i, j = i+1, j-1 {
+				c[i], c[j] = c[j], c[i]
+			}
+		}
+		sort.Sort(c)
+		for cnt, v := range c {
+			if *v != expected[cnt] {
+				t.Errorf("csort %d expected %v, got %v", cnt, expected[cnt], *v)
+			}
+		}
+
+		// the points tie against an x plane except for the x axis points.
+		s := ssort{points(), 1, 0, 0}
+		if reversed {
+			sort.Sort(sort.Reverse(s))
+		}
+		sort.Sort(s)
+		order := []lin.V3{{0, -1, 0}, {0, 0, -1}, {0, 0, 1}, {0, 1, 0}, {-1, 0, 0}, {1, 0, 0}}
+		for cnt, v := range s.c {
+			if *v != order[cnt] {
+				t.Errorf("ssort %d expected %v, got %v", cnt, order[cnt], *v)
+			}
+		}
+	}
+}
+
+func TestCombinedEnergy(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	tr.temax, tr.cemax = 1000, 3000
+	expected := map[[2]int]float64{
+		{1000, 3000}: 1,
+		{0, 0}:       0,
+		{1000, 0}:    0.25,
+		{0, 3000}:    0.75,
+		{500, 1500}:  0.5,
+		{2000, 1500}: 0.625, // teleport energy is capped at its maximum.
+	}
+	for energy, combined := range expected {
+		tr.teleportEnergy, tr.cloakEnergy = energy[0], energy[1]
+		if got := tr.combinedEnergy(); math.Abs(got-combined) > 1e-9 {
+			t.Errorf("Energy %v expected %f, got %f", energy, combined, got)
+		}
+	}
+	tr.temax, tr.cemax = 0, 0
+	if got := tr.combinedEnergy(); got != 0 {
+		t.Errorf("Expected 0 for zero maximums, got %f", got)
+	}
+}
+
+func TestCritical(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.ani = &animator{}
+	_, _, max := tr.health()
+	tr.setHealth(int(criticalHealth*float64(max)) - 1)
+	if !tr.isCritical() || len(tr.ani.animations) != 1 {
+		t.Fatalf("Expected the critical animation, got %d animations", len(tr.ani.animations))
+	}
+	tr.ani.step(0.02)
+	tr.ani.step(0.02)
+	var cell vu.Part
+	for _, c := range tr.cubes() {
+		if len(c.cells) > 0 {
+			cell = c.cells[0]
+		}
+	}
+	if alpha := cell.Alpha(); alpha >= 1 {
+		t.Errorf("Expected the cells to pulse, got alpha %f", alpha)
+	}
+	if health, _, _ := tr.health(); health != int(criticalHealth*float64(max))-1 {
+		t.Errorf("Expected the health to be unchanged, got %d", health)
+	}
+
+	// healing past the threshold removes the warning.
+	tr.setHealth(max / 2)
+	tr.ani.step(0.02)
+	if tr.isCritical() || len(tr.ani.animations) != 0 {
+		t.Errorf("Expected no critical animation, got %d animations", len(tr.ani.animations))
+	}
+	if alpha := cell.Alpha(); alpha != 1 {
+		t.Errorf("Expected the cells to be restored, got alpha %f", alpha)
+	}
+}
+
+func TestCriticalHysteresis(t *testing.T) {
+	defer setCriticalThresholds(criticalHealth, criticalRecovery)
+	setCriticalThresholds(0.2, 0.3)
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.ani = &animator{}
+	_, _, max := tr.health()
+	enter := int(0.2 * float64(max))
+	for cnt := 0; cnt < 4; cnt++ {
+		tr.setHealth(enter - 1)
+		if !tr.isCritical() {
+			t.Fatalf("Expected the warning below %d, pass %d", enter, cnt)
+		}
+		tr.setHealth(enter + 1)
+		if !tr.isCritical() {
+			t.Errorf("Expected the warning to continue at %d, pass %d", enter+1, cnt)
+		}
+	}
+	tr.setHealth(int(0.3*float64(max)) + 1)
+	tr.ani.step(0.02)
+	if tr.isCritical() {
+		t.Errorf("Expected the warning to stop above the recovery threshold")
+	}
+	setCriticalThresholds(0.5, 0.1)
+	if criticalHealth != 0.5 || criticalRecovery != 0.5 {
+		t.Errorf("Expected the recovery threshold raised to 0.5, got %f", criticalRecovery)
+	}
+}
+
+func TestCapacities(t *testing.T) {
+	for level := 0; level < 5; level++ {
+		tr := newTrooper(nil, &testPart{}, level)
+		panels := tr.panelCapacities()
+		total := tr.edgeCapacity()
+		for face, cells := range panels {
+			if level > 1 && cells != (level-1)*(level-1)*8 || level <= 1 && cells != 0 {
+				t.Errorf("Level %d panel %d unexpected capacity %d", level, face, cells)
+			}
+			total += cells
+		}
+		if _, _, max := tr.health(); total != max {
+			t.Errorf("Level %d expected capacities to total %d, got %d", level, max, total)
+		}
+	}
+}
+
+func TestNewTrooperSafe(t *testing.T) {
+	invalid := map[string]struct {
+		eng   vu.Engine
+		part  vu.Part
+		level int
+	}{
+		"nil engine":     {nil, &testPart{}, 1},
+		"nil part":       {&testEngine{}, nil, 1},
+		"negative level": {&testEngine{}, &testPart{}, -1},
+	}
+	for name, in := range invalid {
+		if tr, err := newTrooperSafe(in.eng, in.part, in.level); err == nil || tr != nil {
+			t.Errorf("Expected an error for a %s", name)
+		}
+	}
+	tr, err := newTrooperSafe(&testEngine{}, &testPart{}, 2)
+	if err != nil || tr.level() != 2 {
+		t.Errorf("Expected a level 2 trooper, got %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected newTrooper to panic for a negative level")
+		}
+	}()
+	newTrooper(nil, &testPart{}, -1)
+}
+
+func TestPreviewReattach(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	tr.setMergeDisabled(true) // keep the cells so their locations can be checked.
+	tr.detachCores(40)
+	health, _, max := tr.health()
+	before := tr.snapshot()
+	preview := tr.previewReattach(30)
+	if !reflect.DeepEqual(tr.snapshot(), before) || len(preview) != 30 {
+		t.Fatalf("Expected 30 points and no changes, got %d points", len(preview))
+	}
+	for cnt, point := range preview {
+		cells := map[*cube]int{}
+		for _, c := range tr.cubes() {
+			cells[c] = len(c.cells)
+		}
+		tr.attach()
+		for _, c := range tr.cubes() {
+			if len(c.cells) > cells[c] {
+				x, y, z := c.cells[len(c.cells)-1].Location()
+				if x != point.X || y != point.Y || z != point.Z {
+					t.Errorf("Cell %d expected %v, got %f %f %f", cnt, *point, x, y, z)
+				}
+			}
+		}
+	}
+	if got := len(tr.previewReattach(max)); got != max-health-30 {
+		t.Errorf("Expected %d points before full, got %d", max-health-30, got)
+	}
+}
+
+func TestTeleportRate(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	tr.setTeleportRate(0.5)
+	tr.teleportEnergy = 0
+	for cnt := 1; cnt <= 6; cnt++ {
+		tr.updateEnergy()
+		if teng, _, _, _ := tr.energy(); teng != cnt/2 {
+			t.Errorf("Update %d expected teleport energy %d, got %d", cnt, cnt/2, teng)
+		}
+	}
+}
+
+func TestActiveNoises(t *testing.T) {
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	noise := &testSound{}
+	tr.noises["cloak"] = noise
+	tr.cloakEnergy = 100
+	tr.cloak(true)
+	if active := tr.activeNoises(); !reflect.DeepEqual(active, []string{"cloak"}) {
+		t.Errorf("Expected the cloak sound to be active, got %v", active)
+	}
+	tr.stopAll()
+	if active := tr.activeNoises(); len(active) != 0 || noise.stops != 1 {
+		t.Errorf("Expected one stopped sound, got %v and %d stops", active, noise.stops)
+	}
+
+	// sounds are assumed to finish after noiseTicks updates.
+	tr.playNoise("cloak")
+	for cnt := 0; cnt < noiseTicks; cnt++ {
+		tr.updateAudio(0, 0, 0)
+	}
+	if active := tr.activeNoises(); len(active) != 0 {
+		t.Errorf("Expected the cloak sound to have finished, got %v", active)
+	}
+}
+
+func TestPanelMerge(t *testing.T) {
+	defer setPanelMerge(1)
+	setPanelMerge(0.9)
+	tr := newTrooper(nil, &testPart{}, 3)
+	p, _ := tr.panel(0)
+	early := p.mergeCount()
+	if early >= p.cmax {
+		t.Fatalf("Expected an early merge, got %d of %d", early, p.cmax)
+	}
+	check := func(cells int, slab bool) {
+		if p.ccnt != cells || (p.slab != nil) != slab {
+			t.Errorf("Expected %d cells and slab %t, got %d cells", cells, slab, p.ccnt)
+		}
+		if err := tr.verifyIntegrity(); err != nil {
+			t.Error(err)
+		}
+		if err := tr.auditPanelOwnership(); err != nil {
+			t.Error(err)
+		}
+	}
+	p.reset(early - 1)
+	check(early-1, false)
+	p.attach()
+	check(early, true)
+	p.attach()
+	check(early+1, true)
+	p.detach()
+	p.detach()
+	check(early-1, false)
+}
+
+func TestShake(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.setScale(100)
+	tr.setLoc(10, 20, 0)
+	g := &game{mp: &bampf{ani: &animator{}}, cl: &level{player: tr, center: &testPart{}}}
+	tr.monitorHealth("game", g)
+	tr.detachCores(5)
+	if len(g.mp.ani.animations) != 1 {
+		t.Fatalf("Expected a shake animation, got %d", len(g.mp.ani.animations))
+	}
+	moved := false
+	for len(g.mp.ani.animations) > 0 {
+		g.mp.ani.step(0.02)
+		if x, y, _ := tr.loc(); x != 10 || y != 20 {
+			moved = true
+		}
+	}
+	if x, y, z := tr.loc(); !moved || x != 10 || y != 20 || z != 0 {
+		t.Errorf("Expected a shake back to 10 20 0, got %f %f %f", x, y, z)
+	}
+
+	// a second hit while shaking restarts the shake.
+	tr.detachCores(5)
+	g.mp.ani.step(0.02)
+	g.mp.ani.step(0.02)
+	tr.detachCores(5)
+	if len(g.mp.ani.animations) != 1 {
+		t.Errorf("Expected one shake, got %d animations", len(g.mp.ani.animations))
+	}
+	for len(g.mp.ani.animations) > 0 {
+		g.mp.ani.step(0.02)
+	}
+	if x, y, z := tr.loc(); x != 10 || y != 20 || z != 0 || tr.shaking != nil {
+		t.Errorf("Expected the second shake back to 10 20 0, got %f %f %f", x, y, z)
+	}
+	defer setShake(true, 1)
+	setShake(false, 1)
+	if g.tookDamage(5); len(g.mp.ani.animations) != 0 {
+		t.Errorf("Expected no shake when turned off")
+	}
+}
+
+func TestLevelForCores(t *testing.T) {
+	for _, cores := range []int{-5, 0, 1, 8} {
+		if level := levelForCores(cores); level != 0 {
+			t.Errorf("Expected level 0 for %d cores, got %d", cores, level)
+		}
+	}
+	for level := 1; level < 10; level++ {
+		_, _, _, _, max := levelStats(level)
+		expected := map[int]int{max - 1: level, max: level, max + 1: level + 1}
+		for cores, want := range expected {
+			if got := levelForCores(cores); got != want {
+				t.Errorf("Expected level %d for %d cores, got %d", want, cores, got)
+			}
+		}
+	}
+	if level := levelForCores(1 << 40); level <= 0 {
+		t.Errorf("Expected a large level, got %d", level)
+	} else if _, _, _, _, max := levelStats(level); max < 1<<40 {
+		t.Errorf("Expected level %d to hold %d cores, got %d", level, 1<<40, max)
+	}
+	if level := levelForCores(math.MaxInt64); level <= 0 {
+		t.Errorf("Expected a large level, got %d", level)
+	}
+}
+
+func TestMaxReachableLevel(t *testing.T) {
+	if level := maxReachableLevel(-5); level != 0 {
+		t.Errorf("Expected level 0 for negative cores, got %d", level)
+	}
+	for level := 1; level <= 5; level++ {
+		_, mid, _ := coreTotals(level)
+		if got := maxReachableLevel(mid - 1); got != level-1 {
+			t.Errorf("Expected level %d for %d cores, got %d", level-1, mid-1, got)
+		}
+		if got := maxReachableLevel(mid); got != level {
+			t.Errorf("Expected level %d for %d cores, got %d", level, mid, got)
+		}
+	}
+	if level := maxReachableLevel(math.MaxInt64); level != coreTotalsCap {
+		t.Errorf("Expected the level to stop at %d, got %d", coreTotalsCap, level)
+	}
+}
+
+func TestShellOnly(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	health, _, _ := tr.health()
+	detailed := tr.renderedPartCount()
+	tr.setShellOnly(true)
+	if shell := tr.renderedPartCount(); shell >= detailed || tr.center != nil {
+		t.Errorf("Expected fewer than %d parts and no center, got %d", detailed, shell)
+	}
+	if got, _, _ := tr.health(); got != health {
+		t.Errorf("Expected health %d, got %d", health, got)
+	}
+	tr.detachCores(10)
+	tr.attachCores(10)
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+	if err := tr.auditPanelOwnership(); err != nil {
+		t.Error(err)
+	}
+	tr.setShellOnly(false)
+	if got := tr.renderedPartCount(); got != detailed || tr.center == nil {
+		t.Errorf("Expected the %d detailed parts back, got %d", detailed, got)
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrooperAlpha(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	if tr.alpha() != 1 {
+		t.Errorf("Expected a default alpha of 1, got %f", tr.alpha())
+	}
+	tr.setAlpha(0.5)
+	var check func(p *testPart)
+	check = func(p *testPart) {
+		for _, child := range p.parts {
+			if len(child.parts) == 0 && child.alpha != 0.5 {
+				t.Errorf("Expected part alpha 0.5, got %f", child.alpha)
+			}
+			check(child)
+		}
+	}
+	check(tr.part.(*testPart))
+	if tr.alpha() != 0.5 {
+		t.Errorf("Expected alpha 0.5, got %f", tr.alpha())
+	}
+	for alpha, expected := range map[float64]float64{-1: 0, 2: 1} {
+		if tr.setAlpha(alpha); tr.alpha() != expected {
+			t.Errorf("Expected alpha %f to be clamped to %f, got %f", alpha, expected, tr.alpha())
+		}
+	}
+
+	// parts created after setAlpha are faded as well.
+	tr = newTrooper(nil, &testPart{}, 3)
+	tr.setAlpha(0.5)
+	faded := func(when string) {
+		parts := append([]vu.Part{tr.neo, tr.center}, tr.shields...)
+		for _, b := range tr.bits {
+			if p, ok := b.(*panel); ok {
+				parts = append(parts, p.slab)
+			}
+		}
+		for _, c := range tr.cubes() {
+			parts = append(parts, c.cells...)
+		}
+		for _, part := range parts {
+			if part != nil && part.(*testPart).alpha != 0.5 {
+				t.Errorf("Expected alpha 0.5 %s, got %f", when, part.(*testPart).alpha)
+			}
+		}
+	}
+	for cnt := 0; cnt < 20; cnt++ {
+		tr.attach()
+	}
+	faded("after attaching cells")
+	for tr.attachCell() {
+	}
+	tr.merge()
+	tr.attachShield()
+	faded("after merging")
+	tr.detachCores(30)
+	faded("after demerging")
+	tr.promote()
+	faded("after a promotion")
+}
+
+func TestScore(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	sm := &testScoreMonitor{}
+	tr.monitorHealth("score", sm)
+	tr.attach()
+	tr.attachCores(5)
+	tr.detachCores(3)
+	if sm.score != 6*4 {
+		t.Errorf("Expected a score of %d, got %d", 6*4, sm.score)
+	}
+	tr.cellPoints = func(level int) int { return level * 10 }
+	tr.attach()
+	if sm.score != 6*4+30 {
+		t.Errorf("Expected a score of %d, got %d", 6*4+30, sm.score)
+	}
+}
+
+// testScoreMonitor adds up the score.
+type testScoreMonitor struct{ score int }
+
+func (sm *testScoreMonitor) healthUpdated(health, mid, max int) {}
+func (sm *testScoreMonitor) scored(delta int)                   { sm.score += delta }
+
+func TestClosestCell(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.setScale(2)
+	tr.setLoc(10, 0, 0)
+	tr.detachCores(10)
+	probe := &lin.V3{12, 1, -1}
+	center, distance := tr.closestCell(probe)
+	if center == nil {
+		t.Fatalf("Expected a closest cell")
+	}
+	found := false
+	for _, bound := range tr.cellBounds() {
+		dx, dy, dz := bound.center.X-probe.X, bound.center.Y-probe.Y, bound.center.Z-probe.Z
+		if math.Sqrt(dx*dx+dy*dy+dz*dz) < distance {
+			t.Errorf("Cell %v is closer than %v", bound.center, *center)
+		}
+		found = found || bound.center == *center
+	}
+	if !found {
+		t.Errorf("Expected %v to be a cell center", *center)
+	}
+	tr.setHealth(0)
+	if center, distance := tr.closestCell(probe); center != nil || distance != -1 {
+		t.Errorf("Expected no cell, got %v %f", center, distance)
+	}
+}
+
+func TestSafeFacade(t *testing.T) {
+	part := &testPart{}
+	safeFacade(part, "cube", "flata", "tred")
+	if part.material != "tred" || part.shader != "flata" {
+		t.Errorf("Expected tred flata, got %s %s", part.material, part.shader)
+	}
+	safeFacade(part, "cube", "flata", "missing")
+	if part.material != fallbackMaterial {
+		t.Errorf("Expected fallback %s, got %s", fallbackMaterial, part.material)
+	}
+}
+
+func TestAttachNearest(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	tr.setScale(2)
+	tr.setLoc(5, 0, 0)
+	tr.detachCores(40)
+	center, ok := nextBitCenter(tr.bits[1])
+	if !ok {
+		t.Fatalf("Expected room on the -x panel")
+	}
+	before := []int{}
+	for _, b := range tr.bits {
+		before = append(before, b.box().ccnt)
+	}
+	if !tr.attachNearest(&lin.V3{5 + center.X*2, center.Y * 2, center.Z * 2}) {
+		t.Fatalf("Expected a cell to be attached")
+	}
+	for cnt, b := range tr.bits {
+		expect := before[cnt]
+		if cnt == 1 {
+			expect++
+		}
+		if b.box().ccnt != expect {
+			t.Errorf("Bit %d expected %d cells, got %d", cnt, expect, b.box().ccnt)
+		}
+	}
+	_, _, max := tr.health()
+	tr.setHealth(max)
+	if tr.attachNearest(&lin.V3{}) {
+		t.Errorf("Expected a full trooper to refuse cells")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	part := &testPart{}
+	tr := newTrooper(nil, part, 2)
+	_, _, max := tr.health()
+	tr.setHealth(max)
+	tr.addCloakEnergy()
+	teng, _, ceng, _ := tr.energy()
+	if tr.neo == nil {
+		t.Fatalf("Expected a merged trooper")
+	}
+	if !tr.promote() {
+		t.Fatalf("Expected a promotion")
+	}
+	health, mid, max := tr.health()
+	if tr.lvl != 3 || mid != 152 {
+		t.Errorf("Expected level 3 with minimum 152, got %d %d", tr.lvl, mid)
+	}
+	if health <= mid || health > max {
+		t.Errorf("Expected carried over health above %d, got %d", mid, health)
+	}
+	if nteng, _, nceng, _ := tr.energy(); nteng != teng || nceng != ceng {
+		t.Errorf("Expected energy %d %d, got %d %d", teng, ceng, nteng, nceng)
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Errorf("Expected a consistent trooper after promotion: %s", err)
+	}
+	tr.setMaxLevel(3)
+	if tr.promote() {
+		t.Errorf("Expected no promotion past the maximum level")
+	}
+
+	// disabled merging carries over to the promoted trooper.
+	tr = newTrooper(nil, &testPart{}, 2)
+	tr.setMergeDisabled(true)
+	tr.promote()
+	for tr.attachCell() {
+	}
+	if tr.neo != nil {
+		t.Errorf("Expected no merged trooper after promotion")
+	}
+	for _, c := range tr.cubes() {
+		if len(c.cells) != c.cmax {
+			t.Errorf("Expected %d detailed cells, got %d", c.cmax, len(c.cells))
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	part := &testPart{}
+	tr := newTrooper(nil, part, 2)
+	tr.setScale(3)
+	before, _, _ := tr.health()
+	tr.setMirror(true)
+	if part.sx != -3 || part.sy != 3 || part.sz != 3 {
+		t.Errorf("Expected a -3 3 3 scale, got %f %f %f", part.sx, part.sy, part.sz)
+	}
+	tr.setScale(2)
+	if part.sx != -2 || part.sy != 2 {
+		t.Errorf("Expected mirroring to survive scaling, got %f %f", part.sx, part.sy)
+	}
+	if health, _, _ := tr.health(); health != before {
+		t.Errorf("Expected health %d, got %d", before, health)
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Errorf("Expected a consistent mirrored trooper: %s", err)
+	}
+	tr.setMirror(false)
+	if part.sx != 2 {
+		t.Errorf("Expected a positive x scale, got %f", part.sx)
+	}
+}
+
+func TestCanTeleport(t *testing.T) {
+	tr := newTrooper(&testEngine{}, &testPart{}, 1)
+	tr.noises["teleport"] = &testSound{}
+	for _, energy := range []struct {
+		amount int
+		expect bool
+	}{{tr.temax, true}, {tr.temax / 2, false}, {0, false}, {tr.temax + 50, true}} {
+		tr.teleportEnergy = energy.amount
+		if tr.canTeleport() != energy.expect {
+			t.Errorf("Energy %d expected canTeleport %t", energy.amount, energy.expect)
+		}
+	}
+	tr.teleCooldownTicks = 10
+	if !tr.teleport() || tr.canTeleport() {
+		t.Errorf("Expected teleport to use the energy")
+	}
+	tr.teleportEnergy = tr.temax
+	if tr.canTeleport() {
+		t.Errorf("Expected no teleport during the cooldown")
+	}
+}
+
+func TestFaceColors(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	colors := [6]string{"tred", "tgreen", "tgold", "tblue", "red", "white"}
+	tr.setFaceColors(colors)
+	for face, color := range colors {
+		p, _ := tr.panel(face)
+		for p.attach() {
+		}
+		if p.slab == nil {
+			t.Fatalf("Expected face %d to merge", face)
+		}
+		if material := p.slab.(*testPart).material; material != color {
+			t.Errorf("Face %d expected %s, got %s", face, color, material)
+		}
+	}
+	tr.setFaceColors([6]string{"tblue", "tblue", "tblue", "tblue", "tblue", "tblue"})
+	if p, _ := tr.panel(0); p.slab.(*testPart).material != "tblue" {
+		t.Errorf("Expected merged panels to change color")
+	}
+}
+
+func TestCenterAtZeroHealth(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	health, _, _ := tr.health()
+	tr.detachCores(health)
+	if tr.center != nil {
+		t.Errorf("Expected no center without cells")
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Errorf("Expected a consistent empty trooper: %s", err)
+	}
+	tr.attachCores(1)
+	if tr.center == nil {
+		t.Errorf("Expected the center to be restored")
+	}
+	if err := tr.verifyIntegrity(); err != nil {
+		t.Errorf("Expected a consistent trooper: %s", err)
+	}
+}
+
+func TestCoreTotals(t *testing.T) {
+	for level := 0; level <= 10; level++ {
+		tr := newTrooper(nil, &testPart{}, level)
+		max := 0
+		for _, b := range tr.bits {
+			max += b.box().cmax
+		}
+		min, mid, total := coreTotals(level)
+		if min != 0 || mid != tr.mid || total != max {
+			t.Errorf("Level %d expected 0 %d %d, got %d %d %d", level, tr.mid, max, min, mid, total)
+		}
+	}
+	if _, mid, max := coreTotals(coreTotalsCap + 1); mid <= 0 || max <= mid {
+		t.Errorf("Expected totals past the table, got %d %d", mid, max)
+	}
+}
+
+func TestHealthTint(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.setHealthTint(true)
+	tr.setHealth(20)
+	colors := func() map[string]int {
+		counts := map[string]int{}
+		for _, c := range tr.cubes() {
+			for _, cell := range c.cells {
+				counts[cell.(*testPart).material]++
+			}
+		}
+		return counts
+	}
+	if counts := colors(); len(counts) != 1 || counts["tred"] == 0 {
+		t.Errorf("Expected only tred cells at low health, got %v", counts)
+	}
+	_, _, max := tr.health()
+	tr.setHealth(max / 2)
+	if counts := colors(); len(counts) != 1 || counts["tgold"] == 0 {
+		t.Errorf("Expected only tgold cells at half health, got %v", counts)
+	}
+	tr.setHealthTint(false)
+	if counts := colors(); len(counts) != 1 || counts["tgreen"] == 0 {
+		t.Errorf("Expected cells to revert to tgreen, got %v", counts)
+	}
+}
+
+func TestClampEnergy(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 1)
+	tr.setEnergy(-20, -50)
+	if _, _, ceng, _ := tr.energy(); ceng != 0 {
+		t.Errorf("Expected negative cloak energy to report 0, got %d", ceng)
+	}
+	tr.clampEnergy()
+	if tr.teleportEnergy != 0 || tr.cloakEnergy != 0 {
+		t.Errorf("Expected energy 0 0, got %d %d", tr.teleportEnergy, tr.cloakEnergy)
+	}
+	tr.setEnergy(tr.temax+30, -5)
+	tr.updateEnergy()
+	if teng, tmax, ceng, _ := tr.energy(); teng != tmax || ceng != 0 {
+		t.Errorf("Expected energy %d 0 after an update, got %d %d", tmax, teng, ceng)
+	}
+	tr.setEnergy(0, tr.cemax+40)
+	tr.clampEnergy()
+	if tr.cloakEnergy != tr.cemax {
+		t.Errorf("Expected cloak energy clamped to %d, got %d", tr.cemax, tr.cloakEnergy)
+	}
+
+	// the debug hook raises the maximum so the longer cloak survives clamping.
+	cemax := tr.cemax
+	(&level{player: tr}).increaseCloak()
+	tr.clampEnergy()
+	if tr.cemax != cemax*11 || tr.cloakEnergy != tr.cemax {
+		t.Errorf("Expected a long cloak of %d, got %d of %d", cemax*11, tr.cloakEnergy, tr.cemax)
+	}
+}
+
+func TestRegenDelay(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.setRegenDelay(3)
+	tr.attachCores(4)
+	tr.detachCores(2)
+	if added := tr.regenCores(1); added != 0 {
+		t.Errorf("Expected regeneration to wait after damage, got %d", added)
+	}
+	if added := tr.attachCores(1); added != 1 {
+		t.Errorf("Expected pickups to ignore the delay, got %d", added)
+	}
+	for cnt := 0; cnt < 3; cnt++ {
+		tr.updateEnergy()
+	}
+	if added := tr.regenCores(1); added != 1 {
+		t.Errorf("Expected regeneration after the delay, got %d", added)
+	}
+
+	// the start screen player counts down as it rotates.
+	sa := &startAnimation{parent: &testPart{}, scale: 200}
+	sa.showLevel(2)
+	sa.player.setRegenDelay(3)
+	sa.player.detachCores(5)
+	health, _, _ := sa.player.health()
+	for cnt := 0; cnt < 2; cnt++ {
+		sa.rotate(0, 1)
+	}
+	if now, _, _ := sa.player.health(); now != health {
+		t.Errorf("Expected no regeneration during the delay, got %d of %d", now, health)
+	}
+	sa.rotate(0, 1)
+	if now, _, _ := sa.player.health(); now <= health {
+		t.Errorf("Expected regeneration after the delay, got %d of %d", now, health)
+	}
+}
+
+func TestTrooperView(t *testing.T) {
+	for _, level := range []int{0, 1, 3} {
+		tr := newTrooper(nil, &testPart{}, level)
+		tr.detachCores(3)
+		tr.addCloakEnergy()
+		state := tr.snapshot()
+		view := newTrooperView(state)
+		state.ccnt[0] = -1 // the view keeps its own copy.
+		health, mid, max := tr.health()
+		vhealth, vmid, vmax := view.health()
+		if view.level() != level || vhealth != health || vmid != mid || vmax != max {
+			t.Errorf("Level %d expected %d %d %d, got %d %d %d", level, health, mid, max, vhealth, vmid, vmax)
+		}
+		teng, tmax, ceng, cmax := tr.energy()
+		if vteng, vtmax, vceng, vcmax := view.energy(); vteng != teng || vtmax != tmax || vceng != ceng || vcmax != cmax {
+			t.Errorf("Level %d expected energy %d %d, got %d %d", level, teng, ceng, vteng, vceng)
+		}
+		segments, maxes := view.healthSegments(), view.maxSegments()
+		if fmt.Sprint(segments) != fmt.Sprint(tr.healthSegments()) || fmt.Sprint(maxes) != fmt.Sprint(tr.maxSegments()) {
+			t.Errorf("Level %d expected segments %v %v, got %v %v", level, tr.healthSegments(), tr.maxSegments(), segments, maxes)
+		}
+	}
+
+	// cell bounds match a trooper restored from the same state.
+	for _, level := range []int{0, 1, 2, 3} {
+		for _, loss := range []int{0, 1, 5, 30} {
+			tr := newTrooper(nil, &testPart{}, level)
+			tr.setScale(1)
+			for tr.attachCell() {
+			}
+			tr.detachCores(loss)
+			state := tr.snapshot()
+			if err := tr.restore(state); err != nil {
+				t.Fatal(err)
+			}
+			expect, got := tr.cellBounds(), newTrooperView(state).cellBounds()
+			if fmt.Sprint(got) != fmt.Sprint(expect) {
+				t.Errorf("Level %d loss %d expected bounds %v, got %v", level, loss, expect, got)
+			}
+		}
+	}
+}
+
+func TestMergeScale(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	var full *cube
+	for _, b := range tr.bits {
+		if c, ok := b.(*cube); ok {
+			for c.attach() {
+			}
+			full = c
+			break
+		}
+	}
+	normal := full.cells[0].(*testPart).sx
+	tr.setMergeScale(1.1)
+	if scale := full.cells[0].(*testPart).sx; math.Abs(scale-normal*1.1) > 1e-9 {
+		t.Errorf("Expected merged scale %f, got %f", normal*1.1, scale)
+	}
+	p, _ := tr.panel(0)
+	for p.attach() {
+	}
+	sx, sy, sz := p.slab.(*testPart).Scale()
+	if thin := math.Min(sx, math.Min(sy, sz)); math.Abs(thin-p.csize*0.5*1.1) > 1e-9 {
+		t.Errorf("Expected slab thickness %f, got %f", p.csize*0.5*1.1, thin)
+	}
+	tr.setMergeScale(5)
+	if tr.mergeScale != 1.2 {
+		t.Errorf("Expected the merge scale to be limited to 1.2, got %f", tr.mergeScale)
+	}
+}
+
+// testPanelMonitor records panel state changes.
+type testPanelMonitor struct{ events []string }
+
+func (pm *testPanelMonitor) healthUpdated(health, mid, max int) {}
+func (pm *testPanelMonitor) panelMerged(face int)               { pm.record("merged", face) }
+func (pm *testPanelMonitor) panelDemerged(face int)             { pm.record("demerged", face) }
+func (pm *testPanelMonitor) record(event string, face int) {
+	pm.events = append(pm.events, fmt.Sprintf("%s %d", event, face))
+}
+
+func TestPanelState(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 3)
+	pm := &testPanelMonitor{}
+	tr.monitorHealth("test", pm)
+	p, _ := tr.panel(2)
+	for p.attach() {
+	}
+	tr.setMergeScale(1.1) // redrawing the slab is not a change.
+	tr.detachFace(2, 3)
+	if fmt.Sprint(pm.events) != "[merged 2 demerged 2]" {
+		t.Errorf("Expected face 2 to merge and demerge, got %v", pm.events)
+	}
+
+	// redrawing the same cells is not a change either.
+	for p.attach() {
+	}
+	pm.events = nil
+	if err := tr.restore(tr.snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	tr.setMergeDisabled(false) // already enabled.
+	if len(pm.events) != 0 {
+		t.Errorf("Expected no panel events when redrawing, got %v", pm.events)
+	}
+	tr.resetHealthOnly()
+	if fmt.Sprint(pm.events) != "[demerged 2]" {
+		t.Errorf("Expected face 2 to demerge on reset, got %v", pm.events)
+	}
+}
+
+func TestTrooperPanelState(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	pm := &testPanelMonitor{}
+	tr.monitorHealth("test", pm)
+	for !tr.filled() {
+		tr.attach()
+	}
+	if tr.neo == nil || fmt.Sprint(pm.events) != "[merged 0 merged 1 merged 2 merged 3 merged 4 merged 5]" {
+		t.Errorf("Expected each face to merge once, got %v", pm.events)
+	}
+
+	// only the face that loses a cell breaks up.
+	pm.events = nil
+	tr.detach()
+	if fmt.Sprint(pm.events) != "[demerged 0]" {
+		t.Errorf("Expected face 0 to demerge, got %v", pm.events)
+	}
+}
+
+func TestClearCube(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	before := tr.healthSegments()
+	health, _, _ := tr.health()
+	if removed := tr.clearCube(0); removed != 0 {
+		t.Errorf("Expected panels to be skipped, got %d", removed)
+	}
+	if removed := tr.clearCube(len(tr.bits)); removed != 0 {
+		t.Errorf("Expected an invalid index to be ignored, got %d", removed)
+	}
+	index := 6 // the first edge cube.
+	removed := tr.clearCube(index)
+	if removed != before[index] || removed == 0 {
+		t.Errorf("Expected %d cells removed, got %d", before[index], removed)
+	}
+	for cnt, cells := range tr.healthSegments() {
+		if expect := before[cnt]; cnt == index && cells != 0 || cnt != index && cells != expect {
+			t.Errorf("Bit %d expected %d cells, got %d", cnt, expect, cells)
+		}
+	}
+	if now, _, _ := tr.health(); now != health-removed {
+		t.Errorf("Expected health %d, got %d", health-removed, now)
+	}
+}
+
+func TestShowCenter(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.showCenter(true)
+	if tr.center == nil || !tr.center.Visible() {
+		t.Fatalf("Expected a visible center")
+	}
+	tr.showCenter(false)
+	if tr.center.Visible() {
+		t.Errorf("Expected the center to be hidden")
+	}
+	tr.reset()
+	if tr.center == nil || tr.center.Visible() {
+		t.Errorf("Expected the recreated center to stay hidden")
+	}
+	tr.showCenter(true)
+	if !tr.center.Visible() {
+		t.Errorf("Expected the center to be shown again")
+	}
+}
+
+func TestWorldAABB(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	tr.part.SetLocation(10, -4, 3)
+	tr.setScale(2)
+	min, max := tr.worldAABB()
+	if max.X-min.X != 2 || max.Y-min.Y != 2 || max.Z-min.Z != 2 {
+		t.Errorf("Expected a box of size 2, got %v %v", min, max)
+	}
+	inside := func(p lin.V3) bool {
+		return p.X >= min.X && p.X <= max.X && p.Y >= min.Y && p.Y <= max.Y && p.Z >= min.Z && p.Z <= max.Z
+	}
+	for _, bound := range tr.cellBounds() {
+		if !inside(bound.center) {
+			t.Errorf("Expected %v inside %v %v", bound.center, min, max)
+		}
+	}
+
+	// a 45 degree turn about y widens the box in x and z.
+	tr.part.SetRotation(0, math.Sin(math.Pi/8), 0, math.Cos(math.Pi/8))
+	min, max = tr.worldAABB()
+	if width := max.X - min.X; math.Abs(width-2*math.Sqrt2) > 0.0001 || max.Y-min.Y != 2 {
+		t.Errorf("Expected a rotated box width of %f, got %f", 2*math.Sqrt2, width)
+	}
+}
+
+func TestExploded(t *testing.T) {
+	tr := newTrooper(nil, &testPart{}, 2)
+	location := func(b box) (x, y, z float64) {
+		switch bit := b.(type) {
+		case *cube:
+			return bit.part.Location()
+		case *panel:
+			return bit.part.Location()
+		}
+		return 0, 0, 0
+	}
+	tr.setExploded(1)
+	for cnt, b := range tr.bits {
+		x, y, z := location(b)
+		bx := b.box()
+		if x != bx.cx || y != bx.cy || z != bx.cz || x*x+y*y+z*z == 0 {
+			t.Errorf("Bit %d expected to move out to %f %f %f, got %f %f %f", cnt, bx.cx, bx.cy, bx.cz, x, y, z)
+		}
+	}
+	tr.setExploded(0)
+	for cnt, b := range tr.bits {
+		if x, y, z := location(b); x != 0 || y != 0 || z != 0 {
+			t.Errorf("Bit %d expected to return to 0 0 0, got %f %f %f", cnt, x, y, z)
+		}
+	}
+}